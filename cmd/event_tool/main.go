@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/outbox"
+	"github.com/initialed85/uneventful/pkg/models/states"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	toolName                 = "event_tool"
+	usage                    = "usage: event_tool (export|import|shred|verify|tail) [flags]"
+	shredEvictionGracePeriod = time.Second // for writer hosts to take down the shredded entity's writer
+)
+
+func parseTime(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("-%v: %v", name, err)
+	}
+
+	return t, nil
+}
+
+func doExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+
+	domain := flags.String("domain", "", "only export events for this domain (e.g. wallet)")
+	entityID := flags.String("entity", "", "only export events for this entity (requires -domain)")
+	typeName := flags.String("type", "", "only export events whose type name matches this pattern (e.g. wallet.*.credit)")
+	rawSince := flags.String("since", "", "only export events at or after this RFC3339 timestamp")
+	rawUntil := flags.String("until", "", "only export events before this RFC3339 timestamp")
+	includeRejected := flags.Bool("rejected", false, "also export events that were rejected by their writer")
+	tenantID := flags.String("tenant", tenants.DefaultTenantID, "only export events for this tenant (* for every tenant)")
+	path := flags.String("out", "-", "file to write JSONL to (- for stdout)")
+
+	_ = flags.Parse(args)
+
+	err := tenants.Validate(*tenantID, true)
+	if err != nil {
+		return fmt.Errorf("-tenant: %v", err)
+	}
+
+	since, err := parseTime("since", *rawSince)
+	if err != nil {
+		return err
+	}
+
+	until, err := parseTime("until", *rawUntil)
+	if err != nil {
+		return err
+	}
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+
+	if *path != "-" {
+		file, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = file.Close()
+		}()
+
+		w = file
+	}
+
+	buffer := bufio.NewWriter(w)
+
+	count, err := events.Export(
+		db,
+		events.Filter{
+			Domain:          *domain,
+			EntityID:        *entityID,
+			TypeName:        *typeName,
+			Since:           since,
+			Until:           until,
+			IncludeRejected: *includeRejected,
+			TenantID:        *tenantID,
+		},
+		buffer,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = buffer.Flush()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("exported %v events", count)
+
+	return nil
+}
+
+func doImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+
+	path := flags.String("in", "-", "file to read JSONL from (- for stdin)")
+	unhandled := flags.Bool("unhandled", false, "record the events as unhandled (writers won't replay them)")
+
+	_ = flags.Parse(args)
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	err = migrations.Migrate(db)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+
+	if *path != "-" {
+		file, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = file.Close()
+		}()
+
+		r = file
+	}
+
+	handledByName := toolName
+	if *unhandled {
+		handledByName = ""
+	}
+
+	encryptData, err := events.GetEncryptData()
+	if err != nil {
+		return err
+	}
+
+	hashKey, err := events.GetHashKey()
+	if err != nil {
+		return err
+	}
+
+	eventStore := events.NewEventStoreWithOverrides(db, encryptData, hashKey)
+
+	imported, skipped, err := events.Import(eventStore, bufio.NewReader(r), handledByName, ksuid.New().String())
+
+	log.Printf("imported %v events (skipped %v already present)", imported, skipped)
+
+	return err
+}
+
+func doShred(args []string) error {
+	flags := flag.NewFlagSet("shred", flag.ExitOnError)
+
+	streamID := flags.String("stream", "", "the stream to shred (e.g. wallet.[entity ksuid] or tenant.[tenant id].wallet.[entity ksuid])")
+
+	_ = flags.Parse(args)
+
+	if *streamID == "" {
+		return fmt.Errorf("-stream is required")
+	}
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	err = migrations.Migrate(db)
+	if err != nil {
+		return err
+	}
+
+	natsConn, err := helpers.GetNatsConn()
+	if err != nil {
+		return err
+	}
+
+	defer natsConn.Close()
+
+	redisClient, err := helpers.GetRedisClient()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = redisClient.Close()
+	}()
+
+	shredded, err := events.Shred(db, *streamID)
+	if err != nil {
+		return err
+	}
+
+	if !shredded {
+		log.Printf("warning: stream=%#+v had no data key (were its events encrypted?)", *streamID)
+	}
+
+	// the snapshots were built from the plaintext, so they have to go too (before anything can be brought up from them)
+	purged, err := states.Purge(db, *streamID)
+	if err != nil {
+		return err
+	}
+
+	// as does anything that's yet to be relayed (e.g. its state for Redis)
+	discarded, err := outbox.Discard(db, *streamID)
+	if err != nil {
+		return err
+	}
+
+	// a writer that's up still has the plaintext in its state; taken down, it comes back up empty
+	err = models.Evict(natsConn, *streamID)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(shredEvictionGracePeriod)
+
+	// then whatever it may have snapshotted or relayed in the meantime
+	purgedAfter, err := states.Purge(db, *streamID)
+	if err != nil {
+		return err
+	}
+
+	discardedAfter, err := outbox.Discard(db, *streamID)
+	if err != nil {
+		return err
+	}
+
+	// and the read model that was built from it (see WriterImplementation.setStateInTx)
+	deleted, err := redisClient.Del(context.Background(), *streamID).Result()
+	if err != nil {
+		return err
+	}
+
+	log.Printf(
+		"shredded stream=%#+v (purged %v snapshots, discarded %v outbox messages and deleted %v state keys)",
+		*streamID,
+		purged+purgedAfter,
+		discarded+discardedAfter,
+		deleted,
+	)
+
+	log.Printf("the history writer's event store (and any other) has its own keys; shred the stream there as well")
+
+	return nil
+}
+
+func doVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+
+	streamID := flags.String("stream", "", "the stream to verify (e.g. wallet.[entity ksuid] or tenant.[tenant id].wallet.[entity ksuid]); all of them if not given")
+	requireSigned := flags.Bool("signed", false, "treat events that aren't HMAC-signed as a break")
+
+	_ = flags.Parse(args)
+
+	hashKey, err := events.GetHashKey()
+	if err != nil {
+		return err
+	}
+
+	if *requireSigned && hashKey == nil {
+		return fmt.Errorf("-signed requires EVENT_HMAC_KEY")
+	}
+
+	// no migrations here; an audit mustn't write to the database it's auditing
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	verification, err := events.Verify(db, *streamID, hashKey, *requireSigned)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(
+		"verified %v events across %v streams (%v unhashed and %v dropped from the start of their streams)",
+		verification.Verified,
+		verification.Streams,
+		verification.Unhashed,
+		verification.Dropped,
+	)
+
+	if verification.Break != nil {
+		return verification.Break
+	}
+
+	return nil
+}
+
+func doTail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+
+	name := flags.String("name", "event_tool", "what to checkpoint the position as (so a tail with the same name carries on from where the last one left off)")
+	typeName := flags.String("type", ">", "only print events whose type name matches this pattern (e.g. wallet.*.credit)")
+	tenantID := flags.String("tenant", tenants.DefaultTenantID, "only print events for this tenant (* for every tenant)")
+
+	_ = flags.Parse(args)
+
+	err := tenants.Validate(*tenantID, true)
+	if err != nil {
+		return fmt.Errorf("-tenant: %v", err)
+	}
+
+	subscriber := models.NewSubscriber(
+		*name,
+		*tenantID,
+		*typeName,
+		func(event *events.Event) error {
+			b, err := event.ToJSON()
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintln(os.Stdout, string(b))
+
+			return err
+		},
+	)
+
+	lifecycles.Run(subscriber)
+
+	return nil
+}
+
+func main() {
+	helpers.SetLogFormat()
+
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "export":
+		err = doExport(os.Args[2:])
+	case "import":
+		err = doImport(os.Args[2:])
+	case "shred":
+		err = doShred(os.Args[2:])
+	case "verify":
+		err = doVerify(os.Args[2:])
+	case "tail":
+		err = doTail(os.Args[2:])
+	default:
+		log.Fatal(usage)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/initialed85/uneventful/pkg/applications/history"
 	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/retention"
 )
 
 func main() {
@@ -14,7 +16,29 @@ func main() {
 		log.Fatal(err)
 	}
 
-	writer := history.NewWriter(entityID)
+	tenantID, err := tenants.GetTenantID()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writer := history.NewWriterForTenant(tenantID, entityID)
+
+	// the history writer owns the event.> firehose, so it's also the one that keeps the tables in check
+	archiver, err := retention.NewArchiver("history")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	worker := lifecycles.NewLazyWorker(
+		"history_writer",
+		func() error {
+			// the writer migrates the tables that the archiver applies its policies to, so it goes first
+			return lifecycles.Setup(writer, archiver)
+		},
+		func() error {
+			return lifecycles.Teardown(archiver, writer)
+		},
+	)
 
-	lifecycles.Run(writer)
+	lifecycles.Run(worker)
 }
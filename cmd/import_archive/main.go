@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/retention"
+)
+
+func main() {
+	helpers.SetLogFormat()
+
+	table := flag.String("table", "", "table the archives came from (event or state)")
+	flag.Parse()
+
+	if *table == "" || flag.NArg() == 0 {
+		log.Fatal("usage: import_archive -table (event|state) path [path ...]")
+	}
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = migrations.Migrate(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, path := range flag.Args() {
+		count, err := retention.Import(db, *table, path)
+		if err != nil {
+			log.Fatalf("failed to import %#+v: %v", path, err)
+		}
+
+		log.Printf("imported %v rows into %v from %#+v", count, *table, path)
+	}
+
+	// archives from before there were positions don't have them
+	if *table == "event" {
+		err = events.BackfillPositions(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
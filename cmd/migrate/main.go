@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"gorm.io/gorm"
+)
+
+const (
+	usage = "usage: migrate (up|down|status) [flags]"
+)
+
+// getCurrentVersion returns the version of the last migration that's been applied (or 0 if none have)
+func getCurrentVersion(db *gorm.DB) (int64, []*migrations.Status, error) {
+	statuses, err := migrations.GetStatus(db)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var version int64
+
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			version = status.Version
+		}
+	}
+
+	return version, statuses, nil
+}
+
+func doUp(args []string) error {
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+
+	to := flags.Int64("to", migrations.GetLatestVersion(), "the version to migrate up to")
+
+	_ = flags.Parse(args)
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	version, _, err := getCurrentVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if *to < version {
+		return fmt.Errorf("-to %v is below the current version=%v (use down)", *to, version)
+	}
+
+	err = migrations.MigrateTo(db, *to)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrated up to version=%v", *to)
+
+	return nil
+}
+
+func doDown(args []string) error {
+	flags := flag.NewFlagSet("down", flag.ExitOnError)
+
+	to := flags.Int64("to", -1, "the version to migrate down to (0 reverts everything); the one before the current version if not given")
+
+	_ = flags.Parse(args)
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	version, statuses, err := getCurrentVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if *to < 0 {
+		*to = 0
+
+		for _, status := range statuses {
+			if status.AppliedAt != nil && status.Version < version {
+				*to = status.Version
+			}
+		}
+	}
+
+	if *to > version {
+		return fmt.Errorf("-to %v is above the current version=%v (use up)", *to, version)
+	}
+
+	err = migrations.MigrateTo(db, *to)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrated down to version=%v", *to)
+
+	return nil
+}
+
+func doStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+
+	_ = flags.Parse(args)
+
+	db, err := helpers.GetDatabase()
+	if err != nil {
+		return err
+	}
+
+	_, statuses, err := getCurrentVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.String()
+		}
+
+		fmt.Printf("%v\t%v\t%v\n", status.Version, status.Name, appliedAt)
+	}
+
+	return nil
+}
+
+func main() {
+	helpers.SetLogFormat()
+
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "up":
+		err = doUp(os.Args[2:])
+	case "down":
+		err = doDown(os.Args[2:])
+	case "status":
+		err = doStatus(os.Args[2:])
+	default:
+		log.Fatal(usage)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
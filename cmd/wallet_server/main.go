@@ -1,12 +1,31 @@
 package main
 
 import (
+	"log"
+
+	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/initialed85/uneventful/pkg/applications/wallet"
 	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 )
 
 func main() {
-	server := wallet.NewServer()
+	tenantID, err := tenants.GetTenantID()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// GET /events reads the history writer's database, so it's only served where that's reachable
+	serveEvents, err := helpers.GetEnvironmentVariable("SERVE_EVENTS", false, "0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := wallet.NewServerForTenant(tenantID)
+
+	if serveEvents == "1" {
+		server = wallet.NewServerWithEvents(tenantID)
+	}
 
 	lifecycles.Run(server)
 }
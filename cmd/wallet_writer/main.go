@@ -3,18 +3,18 @@ package main
 import (
 	"log"
 
-	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/initialed85/uneventful/pkg/applications/wallet"
 	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 )
 
 func main() {
-	entityID, err := helpers.GetEntityIDFromEnvironmentVariable("")
+	tenantID, err := tenants.GetTenantID()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	writer := wallet.NewWriter(entityID)
+	writerHost := wallet.NewWriterHost(tenantID)
 
-	lifecycles.Run(writer)
+	lifecycles.Run(writerHost)
 }
@@ -1,11 +1,13 @@
 package constants
 
 const (
-	ISO8601TimeFormat       = "2006-01-02T15:04:05-0700"
-	DefaultNatsURL          = "nats://message_broker:4222"
-	DefaultRedisURL         = "cache:6379"
-	DefaultPostgresPort     = "5432"
-	DefaultPostgresUser     = "postgres"
-	DefaultPostgresPassword = "Password1"
-	DefaultPostgresDatabase = "datastore"
+	ISO8601TimeFormat        = "2006-01-02T15:04:05-0700"
+	DefaultNatsURL           = "nats://message_broker:4222"
+	DefaultRedisURL          = "cache:6379"
+	DefaultPostgresPort      = "5432"
+	DefaultPostgresUser      = "postgres"
+	DefaultPostgresPassword  = "Password1"
+	DefaultPostgresDatabase  = "datastore"
+	DefaultSQLitePath        = "/var/lib/sqlite/data/datastore.db"
+	DefaultSQLiteBusyTimeout = "5s"
 )
@@ -3,6 +3,8 @@ package helpers
 import (
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"github.com/initialed85/uneventful/internal/constants"
@@ -17,7 +19,28 @@ func GetDatabase() (db *gorm.DB, err error) {
 	}
 
 	if useSQLite == "1" {
-		db, err = gorm.Open(sqlite.Open("/var/lib/sqlite/data/datastore.db"), &gorm.Config{})
+		var sqlitePath string
+
+		sqlitePath, err = GetEnvironmentVariable("SQLITE_PATH", false, constants.DefaultSQLitePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var rawBusyTimeout string
+
+		rawBusyTimeout, err = GetEnvironmentVariable("SQLITE_BUSY_TIMEOUT", false, constants.DefaultSQLiteBusyTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var busyTimeout time.Duration
+
+		busyTimeout, err = time.ParseDuration(rawBusyTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		db, err = gorm.Open(sqlite.Open(withBusyTimeout(sqlitePath, busyTimeout)), &gorm.Config{TranslateError: true})
 	} else {
 		postgresHost, err := GetEnvironmentVariable("POSTGRES_HOST", true, "")
 		if err != nil {
@@ -46,7 +69,7 @@ func GetDatabase() (db *gorm.DB, err error) {
 
 		dsn := fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=disable TimeZone=Australia/Perth", postgresHost, postgresPort, postgresUser, postgresPassword, postgresDatabase)
 
-		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	}
 
 	if err != nil {
@@ -55,3 +78,19 @@ func GetDatabase() (db *gorm.DB, err error) {
 
 	return db, nil
 }
+
+// withBusyTimeout has SQLite wait (up to the given timeout) for a lock held by another connection (e.g. a migration
+// running in another process) rather than failing straight away with SQLITE_BUSY
+func withBusyTimeout(sqlitePath string, busyTimeout time.Duration) string {
+	separator := "?"
+	if strings.Contains(sqlitePath, "?") {
+		separator = "&"
+	}
+
+	return fmt.Sprintf("%v%v_pragma=busy_timeout(%v)", sqlitePath, separator, busyTimeout.Milliseconds())
+}
+
+// IsSQLite reports whether the given database is SQLite (rather than Postgres / TimescaleDB)
+func IsSQLite(db *gorm.DB) bool {
+	return db.Dialector.Name() == sqlite.DriverName
+}
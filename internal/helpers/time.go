@@ -1,7 +1,43 @@
 package helpers
 
-import "time"
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where GetNow gets the time from; swap it (with SetClock) for one that's fixed or stepped to make anything that
+// stamps times (e.g. events) reproducible
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function (e.g. time.Now) into a Clock
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+var (
+	clockMu sync.RWMutex
+	clock   Clock = ClockFunc(time.Now)
+)
+
+// SetClock has GetNow get the time from the given clock (or the system clock, given nil)
+func SetClock(c Clock) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+
+	if c == nil {
+		c = ClockFunc(time.Now)
+	}
+
+	clock = c
+}
 
 func GetNow() time.Time {
-	return time.Now().UTC()
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+
+	return clock.Now().UTC()
 }
@@ -2,6 +2,7 @@ package history
 
 import (
 	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/segmentio/ksuid"
 )
 
@@ -10,17 +11,24 @@ type Writer struct {
 	name string
 }
 
+// NewWriter is as per NewWriterForTenant, for the default tenant
 func NewWriter(entityID ksuid.KSUID) *Writer {
+	return NewWriterForTenant(tenants.DefaultTenantID, entityID)
+}
+
+func NewWriterForTenant(tenantID string, entityID ksuid.KSUID) *Writer {
 	name := domainName
 
 	w := Writer{name: name}
 
-	w.Writer = models.NewWriterWithOverrides(
+	w.Writer = models.NewWriterForTenantWithOverrides(
 		name,
+		tenantID,
 		entityID,
 		func() (interface{}, error) {
 			return nil, nil
 		},
+		nil,
 		"event.>",
 		name,
 		true,
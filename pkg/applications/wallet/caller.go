@@ -1,9 +1,11 @@
 package wallet
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/segmentio/ksuid"
 )
 
@@ -16,38 +18,56 @@ func NewCaller(name string, entityID ksuid.KSUID) *Caller {
 
 	c.Caller = models.NewCaller(name, entityID)
 
-	_ = c.Caller.AddHandler("credit", func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
-		return c.call(entityID, requestBody, c.Credit)
+	addUpcasters(c.Caller)
+
+	_ = models.AddTypedHandler(c.Caller, credit, func(ctx models.HandlerContext, tenantID string, entityID ksuid.KSUID, amount Amount) (interface{}, error) {
+		return nil, c.CreditWithContext(ctx, tenantID, entityID, amount.Amount)
 	})
 
-	_ = c.Caller.AddHandler("debit", func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
-		return c.call(entityID, requestBody, c.Debit)
+	_ = models.AddTypedHandler(c.Caller, debit, func(ctx models.HandlerContext, tenantID string, entityID ksuid.KSUID, amount Amount) (interface{}, error) {
+		return nil, c.DebitWithContext(ctx, tenantID, entityID, amount.Amount)
 	})
 
 	return &c
 }
 
-func (c *Caller) call(entityID ksuid.KSUID, requestBody interface{}, method func(ksuid.KSUID, float64) error) (interface{}, error) {
-	amount, err := castRequestBodyToAmount(requestBody)
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, method(entityID, amount.Amount)
+// Credit is as per CreditForTenant, for the default tenant
+func (c *Caller) Credit(entityID ksuid.KSUID, amount float64) error {
+	return c.CreditForTenant(tenants.DefaultTenantID, entityID, amount)
 }
 
-func (c *Caller) Credit(entityID ksuid.KSUID, amount float64) error {
-	amountRequest := Amount{Amount: amount}
+func (c *Caller) CreditForTenant(tenantID string, entityID ksuid.KSUID, amount float64) error {
+	return c.CreditWithIdempotencyKey(tenantID, entityID, amount, "")
+}
 
-	data, err := json.Marshal(amountRequest)
-	if err != nil {
-		return err
-	}
+func (c *Caller) CreditWithIdempotencyKey(tenantID string, entityID ksuid.KSUID, amount float64, idempotencyKey string) error {
+	return c.call(context.Background(), entityID, credit, amount, models.CallOptions{TenantID: tenantID, IdempotencyKey: idempotencyKey})
+}
 
-	return c.Call(domainName, entityID, credit, data)
+// CreditWithContext is as per Credit, but the call is made with the given context (see models.Caller.CallWithContext)
+func (c *Caller) CreditWithContext(ctx context.Context, tenantID string, entityID ksuid.KSUID, amount float64) error {
+	return c.call(ctx, entityID, credit, amount, models.CallOptions{TenantID: tenantID})
 }
 
+// Debit is as per DebitForTenant, for the default tenant
 func (c *Caller) Debit(entityID ksuid.KSUID, amount float64) error {
+	return c.DebitForTenant(tenants.DefaultTenantID, entityID, amount)
+}
+
+func (c *Caller) DebitForTenant(tenantID string, entityID ksuid.KSUID, amount float64) error {
+	return c.DebitWithIdempotencyKey(tenantID, entityID, amount, "")
+}
+
+func (c *Caller) DebitWithIdempotencyKey(tenantID string, entityID ksuid.KSUID, amount float64, idempotencyKey string) error {
+	return c.call(context.Background(), entityID, debit, amount, models.CallOptions{TenantID: tenantID, IdempotencyKey: idempotencyKey})
+}
+
+// DebitWithContext is as per Debit, but the call is made with the given context (see models.Caller.CallWithContext)
+func (c *Caller) DebitWithContext(ctx context.Context, tenantID string, entityID ksuid.KSUID, amount float64) error {
+	return c.call(ctx, entityID, debit, amount, models.CallOptions{TenantID: tenantID})
+}
+
+func (c *Caller) call(ctx context.Context, entityID ksuid.KSUID, endpoint string, amount float64, options models.CallOptions) error {
 	amountRequest := Amount{Amount: amount}
 
 	data, err := json.Marshal(amountRequest)
@@ -55,5 +75,5 @@ func (c *Caller) Debit(entityID ksuid.KSUID, amount float64) error {
 		return err
 	}
 
-	return c.Call(domainName, entityID, debit, data)
+	return c.CallWithContext(ctx, domainName, entityID, endpoint, data, options)
 }
@@ -4,4 +4,10 @@ const (
 	domainName = "wallet"
 	credit     = "credit"
 	debit      = "debit"
+	credited   = "credited"
+	debited    = "debited"
+
+	// for outgoing events
+	notificationsDomainName = "notifications"
+	walletDebited           = "wallet_debited"
 )
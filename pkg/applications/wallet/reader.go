@@ -1,7 +1,11 @@
 package wallet
 
 import (
+	"context"
+
 	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/segmentio/ksuid"
 )
 
@@ -14,45 +18,106 @@ func NewReader(name string) *Reader {
 
 	r.Reader = models.NewReader(name)
 
-	_ = r.Reader.AddHandler("balance", func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
-		return r.GetBalance(entityID)
+	_ = r.Reader.AddHandlerWithContext("balance", func(ctx models.HandlerContext, tenantID string, entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
+		walletState, err := r.getWalletState(ctx, tenantID, entityID, requestBody)
+		if err != nil {
+			return nil, err
+		}
+
+		return toBalance(walletState), nil
 	})
 
-	_ = r.Reader.AddHandler("transactions", func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
-		return r.GetTransactions(entityID)
+	_ = r.Reader.AddHandlerWithContext("transactions", func(ctx models.HandlerContext, tenantID string, entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
+		walletState, err := r.getWalletState(ctx, tenantID, entityID, requestBody)
+		if err != nil {
+			return nil, err
+		}
+
+		return toTransactions(walletState), nil
 	})
 
 	return &r
 }
 
+// getWalletState returns the current state, or the state as of the point in history the request body asks for (see
+// models.GetAsOf)
+func (r *Reader) getWalletState(ctx context.Context, tenantID string, entityID ksuid.KSUID, requestBody interface{}) (*State, error) {
+	asOf, err := models.GetAsOf(requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if asOf != nil {
+		return r.GetWalletStateAsOfWithContext(ctx, tenantID, entityID, *asOf)
+	}
+
+	return r.GetWalletStateWithContext(ctx, tenantID, entityID)
+}
+
+// GetWalletState is as per GetWalletStateForTenant, for the default tenant
 func (r *Reader) GetWalletState(entityID ksuid.KSUID) (*State, error) {
-	state, err := r.GetState(domainName, entityID)
+	return r.GetWalletStateForTenant(tenants.DefaultTenantID, entityID)
+}
+
+func (r *Reader) GetWalletStateForTenant(tenantID string, entityID ksuid.KSUID) (*State, error) {
+	return r.GetWalletStateWithContext(context.Background(), tenantID, entityID)
+}
+
+func (r *Reader) GetWalletStateWithContext(ctx context.Context, tenantID string, entityID ksuid.KSUID) (*State, error) {
+	state, err := r.GetStateWithContext(ctx, tenantID, domainName, entityID)
 	if err != nil {
 		return nil, err
 	}
 
-	walletState, err := FromJSON(state.Data)
+	return FromJSON(state.Data)
+}
+
+// GetWalletStateAsOf returns the state of the wallet as of the given point in its history (e.g. midnight on the 1st)
+func (r *Reader) GetWalletStateAsOf(tenantID string, entityID ksuid.KSUID, asOf calls.AsOf) (*State, error) {
+	return r.GetWalletStateAsOfWithContext(context.Background(), tenantID, entityID, asOf)
+}
+
+func (r *Reader) GetWalletStateAsOfWithContext(ctx context.Context, tenantID string, entityID ksuid.KSUID, asOf calls.AsOf) (*State, error) {
+	state, err := r.GetStateAsOfWithContext(ctx, tenantID, domainName, entityID, asOf)
 	if err != nil {
 		return nil, err
 	}
 
-	return walletState, nil
+	return FromJSON(state.Data)
 }
 
+// GetBalance is as per GetBalanceForTenant, for the default tenant
 func (r *Reader) GetBalance(entityID ksuid.KSUID) (*Balance, error) {
-	walletState, err := r.GetWalletState(entityID)
+	return r.GetBalanceForTenant(tenants.DefaultTenantID, entityID)
+}
+
+func (r *Reader) GetBalanceForTenant(tenantID string, entityID ksuid.KSUID) (*Balance, error) {
+	walletState, err := r.GetWalletStateForTenant(tenantID, entityID)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Balance{Timestamp: walletState.Timestamp, Balance: walletState.Balance}, nil
+	return toBalance(walletState), nil
 }
 
+// GetTransactions is as per GetTransactionsForTenant, for the default tenant
 func (r *Reader) GetTransactions(entityID ksuid.KSUID) (*Transactions, error) {
-	walletState, err := r.GetWalletState(entityID)
+	return r.GetTransactionsForTenant(tenants.DefaultTenantID, entityID)
+}
+
+func (r *Reader) GetTransactionsForTenant(tenantID string, entityID ksuid.KSUID) (*Transactions, error) {
+	walletState, err := r.GetWalletStateForTenant(tenantID, entityID)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Transactions{Timestamp: walletState.Timestamp, Transactions: walletState.Transactions}, nil
+	return toTransactions(walletState), nil
+}
+
+func toBalance(walletState *State) *Balance {
+	return &Balance{Timestamp: walletState.Timestamp, Balance: walletState.Balance}
+}
+
+func toTransactions(walletState *State) *Transactions {
+	return &Transactions{Timestamp: walletState.Timestamp, Transactions: walletState.Transactions}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/initialed85/uneventful/pkg/domains"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/segmentio/ksuid"
 )
 
@@ -11,10 +12,24 @@ type Server struct {
 	domains.Server
 }
 
+// NewServer is as per NewServerForTenant, for the default tenant
 func NewServer() *Server {
+	return NewServerForTenant(tenants.DefaultTenantID)
+}
+
+func NewServerForTenant(tenantID string) *Server {
+	name := fmt.Sprintf("server_%v", domainName)
+
+	s := Server{Server: domains.NewServerForTenant(name, domainName, tenantID, NewReader(name), NewCaller(name, ksuid.New()))}
+
+	return &s
+}
+
+// NewServerWithEvents is as per NewServerForTenant, but also serves GET /events (see domains.NewServerWithEvents)
+func NewServerWithEvents(tenantID string) *Server {
 	name := fmt.Sprintf("server_%v", domainName)
 
-	s := Server{Server: domains.NewServer(name, domainName, NewReader(name), NewCaller(name, ksuid.New()))}
+	s := Server{Server: domains.NewServerWithEvents(name, domainName, tenantID, NewReader(name), NewCaller(name, ksuid.New()))}
 
 	return &s
 }
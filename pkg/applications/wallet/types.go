@@ -14,8 +14,13 @@ type Transaction struct {
 	Amount         float64     `json:"amount"`
 }
 
+// NewTransaction is as per NewTransactionAt, as of now
 func NewTransaction(sourceEntityID ksuid.KSUID, amount float64) Transaction {
-	t := Transaction{Timestamp: helpers.GetNow(), SourceEntityID: sourceEntityID, Amount: amount}
+	return NewTransactionAt(helpers.GetNow(), sourceEntityID, amount)
+}
+
+func NewTransactionAt(timestamp time.Time, sourceEntityID ksuid.KSUID, amount float64) Transaction {
+	t := Transaction{Timestamp: timestamp, SourceEntityID: sourceEntityID, Amount: amount}
 
 	return t
 }
@@ -47,7 +52,7 @@ func (s *State) ToJSON() ([]byte, error) {
 }
 
 type Amount struct {
-	Amount float64 `json:"amount"`
+	Amount float64 `json:"amount" validate:"required,gt=0"`
 }
 
 type Balance struct {
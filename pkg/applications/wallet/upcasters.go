@@ -0,0 +1,31 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/events"
+)
+
+// upcastAmountFromSchemaVersion0 handles everything written before events carried a schema version; Amount hasn't
+// changed shape since, so it only checks the data is what we expect, but it means new events are stamped as schema
+// version 1 and the next change to Amount has a version to upcast from
+func upcastAmountFromSchemaVersion0(data json.RawMessage) (json.RawMessage, error) {
+	amount := Amount{}
+
+	err := json.Unmarshal(data, &amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(amount)
+}
+
+// addUpcasters is shared by the writer (so that it can handle old events) and the caller (so that it stamps new
+// events with the current schema version)
+func addUpcasters(upcasters events.Upcasters) {
+	for _, endpoint := range []string{credit, debit} {
+		_ = upcasters.AddUpcaster(fmt.Sprintf("%v.*.%v", domainName, endpoint), 0, models.NewRequestDataUpcaster(upcastAmountFromSchemaVersion0))
+	}
+}
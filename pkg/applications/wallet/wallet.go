@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/segmentio/ksuid"
 )
 
@@ -15,39 +16,95 @@ type Wallet struct {
 }
 
 func NewWallet(entityID ksuid.KSUID) *Wallet {
-	w := Wallet{entityID: entityID, state: State{Timestamp: time.Now(), Balance: 0, Transactions: make([]Transaction, 0)}}
+	w := Wallet{entityID: entityID, state: State{Timestamp: helpers.GetNow(), Balance: 0, Transactions: make([]Transaction, 0)}}
 
 	return &w
 }
 
-func (w *Wallet) applyTransaction(transaction Transaction) error {
+func (w *Wallet) Restore(state State) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if state.Transactions == nil {
+		state.Transactions = make([]Transaction, 0)
+	}
+
+	w.state = state
+}
+
+// GetState returns a copy of the wallet's state (so it can be read while the wallet carries on taking transactions)
+func (w *Wallet) GetState() State {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	state := w.state
+	state.Transactions = append(make([]Transaction, 0, len(w.state.Transactions)), w.state.Transactions...)
+
+	return state
+}
+
+// checkTransaction returns an error if the wallet can't take the given transaction
+func (w *Wallet) checkTransaction(transaction Transaction) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	proposedBalance := w.state.Balance + transaction.Amount
 
-	if w.state.Balance+transaction.Amount < 0 {
+	if proposedBalance < 0 {
 		return fmt.Errorf("%#+v rejected; would cause balance of %#+v (overdrawn)", transaction, proposedBalance)
 	}
 
-	w.state.Balance = proposedBalance
-	w.state.Transactions = append(w.state.Transactions, transaction)
-
 	return nil
 }
 
+// Apply takes the given transaction (credited or debited); it's already been decided on, so there's nothing to check
+func (w *Wallet) Apply(transaction Transaction) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.state.Timestamp = transaction.Timestamp
+	w.state.Balance += transaction.Amount
+	w.state.Transactions = append(w.state.Transactions, transaction)
+}
+
+// Credit takes a credit of the given amount as of now
 func (w *Wallet) Credit(sourceEntityID ksuid.KSUID, amount float64) error {
+	return w.take(w.DecideCredit(helpers.GetNow(), sourceEntityID, amount))
+}
+
+// DecideCredit decides on the transaction for a credit of the given amount at the given time, without taking it
+func (w *Wallet) DecideCredit(timestamp time.Time, sourceEntityID ksuid.KSUID, amount float64) (Transaction, error) {
 	if amount <= 0 {
-		return fmt.Errorf("credit amount must be greater than 0")
+		return Transaction{}, fmt.Errorf("credit amount must be greater than 0")
 	}
 
-	return w.applyTransaction(NewTransaction(sourceEntityID, amount))
+	transaction := NewTransactionAt(timestamp, sourceEntityID, amount)
+
+	return transaction, w.checkTransaction(transaction)
 }
 
+// Debit takes a debit of the given amount as of now
 func (w *Wallet) Debit(sourceEntityID ksuid.KSUID, amount float64) error {
+	return w.take(w.DecideDebit(helpers.GetNow(), sourceEntityID, amount))
+}
+
+// DecideDebit decides on the transaction for a debit of the given amount at the given time, without taking it
+func (w *Wallet) DecideDebit(timestamp time.Time, sourceEntityID ksuid.KSUID, amount float64) (Transaction, error) {
 	if amount <= 0 {
-		return fmt.Errorf("debit amount must be greater than 0")
+		return Transaction{}, fmt.Errorf("debit amount must be greater than 0")
+	}
+
+	transaction := NewTransactionAt(timestamp, sourceEntityID, -amount)
+
+	return transaction, w.checkTransaction(transaction)
+}
+
+func (w *Wallet) take(transaction Transaction, err error) error {
+	if err != nil {
+		return err
 	}
 
-	return w.applyTransaction(NewTransaction(sourceEntityID, -amount))
+	w.Apply(transaction)
+
+	return nil
 }
@@ -0,0 +1,468 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/states"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/segmentio/ksuid"
+)
+
+// setup wires a writer host, a reader, a caller and a server together over in-memory dependencies
+func setup(t *testing.T) (*Caller, *Reader, string, *in_memory.Dependencies) {
+	t.Helper()
+
+	d := in_memory.Setup(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	_ = listener.Close()
+
+	t.Setenv("HTTP_PORT", fmt.Sprint(port))
+
+	writerHost := NewWriterHost("")
+	caller := NewCaller("test", ksuid.New())
+	reader := NewReader("test")
+	server := NewServer()
+
+	in_memory.Start(t, writerHost, caller, reader, server)
+
+	return caller, reader, fmt.Sprintf("http://127.0.0.1:%v/wallet", port), d
+}
+
+func getBalance(t *testing.T, reader *Reader, entityID ksuid.KSUID) float64 {
+	t.Helper()
+
+	balance, err := reader.GetBalance(entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return balance.Balance
+}
+
+func do(t *testing.T, method string, url string, body string) (int, []byte) {
+	t.Helper()
+
+	var response *http.Response
+
+	// the server may still be coming up
+	deadline := time.Now().Add(time.Second * 5)
+
+	for {
+		request, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err = http.DefaultClient.Do(request)
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, data
+}
+
+func TestWallet(t *testing.T) {
+	caller, reader, _, _ := setup(t)
+
+	entityID := ksuid.New()
+	otherEntityID := ksuid.New()
+
+	err := caller.Credit(entityID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = caller.Debit(entityID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance := getBalance(t, reader, entityID); balance != 7 {
+		t.Errorf("expected balance=7, got %v", balance)
+	}
+
+	err = caller.Debit(entityID, 100)
+	if err == nil || !strings.Contains(err.Error(), "overdrawn") {
+		t.Errorf("expected an overdrawn debit to be rejected, got %v", err)
+	}
+
+	if balance := getBalance(t, reader, entityID); balance != 7 {
+		t.Errorf("expected a rejected debit to leave balance=7, got %v", balance)
+	}
+
+	// a retry with the same idempotency key is only applied the once
+	for i := 0; i < 2; i++ {
+		err = caller.CreditWithIdempotencyKey("", entityID, 5, "some-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if balance := getBalance(t, reader, entityID); balance != 12 {
+		t.Errorf("expected balance=12, got %v", balance)
+	}
+
+	err = caller.Credit(otherEntityID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance := getBalance(t, reader, otherEntityID); balance != 1 {
+		t.Errorf("expected the other wallet's balance=1, got %v", balance)
+	}
+
+	transactions, err := reader.GetTransactions(entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions.Transactions) != 3 {
+		t.Errorf("expected 3 transactions, got %v", transactions.Transactions)
+	}
+}
+
+func TestWalletServer(t *testing.T) {
+	_, reader, url, _ := setup(t)
+
+	entityID := ksuid.New()
+	url = fmt.Sprintf("%v/%v", url, entityID)
+
+	cases := []struct {
+		name       string
+		method     string
+		endpoint   string
+		body       string
+		statusCode int
+	}{
+		{name: "credit", method: http.MethodPost, endpoint: "credit", body: `{"amount": 10}`, statusCode: 200},
+		{name: "debit", method: http.MethodPost, endpoint: "debit", body: `{"amount": 4}`, statusCode: 200},
+		{name: "overdrawn", method: http.MethodPost, endpoint: "debit", body: `{"amount": 100}`, statusCode: 400},
+		{name: "negative", method: http.MethodPost, endpoint: "credit", body: `{"amount": -1}`, statusCode: 400},
+		{name: "not a number", method: http.MethodPost, endpoint: "credit", body: `{"amount": "lots"}`, statusCode: 400},
+		{name: "unknown endpoint", method: http.MethodPost, endpoint: "steal", body: `{"amount": 1}`, statusCode: 400},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			statusCode, data := do(t, c.method, fmt.Sprintf("%v/%v", url, c.endpoint), c.body)
+			if statusCode != c.statusCode {
+				t.Errorf("expected status=%v, got status=%v (%s)", c.statusCode, statusCode, data)
+			}
+		})
+	}
+
+	statusCode, data := do(t, http.MethodGet, url+"/balance", "")
+	if statusCode != 200 {
+		t.Fatalf("expected status=200, got status=%v (%s)", statusCode, data)
+	}
+
+	balance := Balance{}
+
+	err := json.Unmarshal(data, &balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance.Balance != 6 {
+		t.Errorf("expected balance=6, got %v (%s)", balance.Balance, data)
+	}
+
+	if balance := getBalance(t, reader, entityID); balance != 6 {
+		t.Errorf("expected the reader to agree on balance=6, got %v", balance)
+	}
+}
+
+func TestWalletAsOf(t *testing.T) {
+	// a snapshot after every second transaction and nothing else
+	t.Setenv("SNAPSHOT_EVENTS", "2")
+	t.Setenv("SNAPSHOT_INTERVAL", "0s")
+
+	caller, reader, url, d := setup(t)
+
+	entityID := ksuid.New()
+
+	// as_of is against when events were appended, so we note the time between each (the debit makes for a snapshot at
+	// sequence=2)
+	var betweens []time.Time
+
+	for _, call := range []func() error{
+		func() error { return caller.Credit(entityID, 10) },
+		func() error { return caller.Debit(entityID, 3) },
+		func() error { return caller.Credit(entityID, 5) },
+	} {
+		time.Sleep(time.Millisecond * 10)
+		betweens = append(betweens, time.Now())
+		time.Sleep(time.Millisecond * 10)
+
+		err := call()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	betweens = append(betweens, time.Now())
+
+	databaseStates, err := states.GetAll(d.GetTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(databaseStates) != 1 || databaseStates[0].Sequence != 2 {
+		t.Fatalf("expected a snapshot at sequence=2, got %v", databaseStates)
+	}
+
+	cases := []struct {
+		name         string
+		asOf         calls.AsOf
+		balance      float64
+		transactions int
+	}{
+		{name: "before the first event", asOf: calls.AsOf{Timestamp: betweens[0]}, balance: 0, transactions: 0},
+		{name: "between events", asOf: calls.AsOf{Timestamp: betweens[1]}, balance: 10, transactions: 1},
+		{name: "at the snapshot", asOf: calls.AsOf{Timestamp: betweens[2]}, balance: 7, transactions: 2},
+		{name: "after the snapshot", asOf: calls.AsOf{Timestamp: betweens[3]}, balance: 12, transactions: 3},
+		{name: "by sequence", asOf: calls.AsOf{Sequence: 1}, balance: 10, transactions: 1},
+		{name: "by the earlier of the two", asOf: calls.AsOf{Timestamp: betweens[3], Sequence: 2}, balance: 7, transactions: 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			walletState, err := reader.GetWalletStateAsOf(tenants.DefaultTenantID, entityID, c.asOf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if walletState.Balance != c.balance || len(walletState.Transactions) != c.transactions {
+				t.Errorf("expected balance=%v with %v transactions, got %#+v", c.balance, c.transactions, walletState)
+			}
+		})
+	}
+
+	// and the live state is left alone
+	if balance := getBalance(t, reader, entityID); balance != 12 {
+		t.Errorf("expected balance=12, got %v", balance)
+	}
+
+	url = fmt.Sprintf("%v/%v/balance", url, entityID)
+
+	statusCode, data := do(t, http.MethodGet, fmt.Sprintf("%v?as_of=%v", url, betweens[1].UTC().Format(time.RFC3339Nano)), "")
+	if statusCode != 200 {
+		t.Fatalf("expected status=200, got status=%v (%s)", statusCode, data)
+	}
+
+	balance := Balance{}
+
+	err = json.Unmarshal(data, &balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance.Balance != 10 {
+		t.Errorf("expected balance=10 as of between events, got %v (%s)", balance.Balance, data)
+	}
+
+	for _, query := range []string{"as_of=yesterday", "as_of_sequence=0"} {
+		statusCode, data = do(t, http.MethodGet, fmt.Sprintf("%v?%v", url, query), "")
+		if statusCode != 400 {
+			t.Errorf("expected status=400 for %v, got status=%v (%s)", query, statusCode, data)
+		}
+	}
+}
+
+type tenantSubscription struct {
+	mu     sync.Mutex
+	events []*events.Event
+}
+
+func (s *tenantSubscription) handle(event *events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, event)
+
+	return nil
+}
+
+// getTenantIDs returns the tenant of each event the subscription has had
+func (s *tenantSubscription) getTenantIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenantIDs := make([]string, 0)
+	for _, event := range s.events {
+		tenantIDs = append(tenantIDs, event.TenantID)
+	}
+
+	return tenantIDs
+}
+
+func TestWalletTenantIsolation(t *testing.T) {
+	d := in_memory.Setup(t)
+
+	tenantIDs := []string{"acme", "globex"}
+
+	caller := NewCaller("test", ksuid.New())
+	reader := NewReader("test")
+
+	workers := []lifecycles.Worker{caller, reader}
+	for _, tenantID := range tenantIDs {
+		workers = append(workers, NewWriterHost(tenantID))
+	}
+
+	in_memory.Start(t, workers...)
+
+	subscribe := func(name string, tenantID string) *tenantSubscription {
+		subscription := tenantSubscription{}
+
+		subscriber := models.NewSubscriber(name, tenantID, "wallet.>", subscription.handle)
+
+		in_memory.Start(t, subscriber)
+
+		return &subscription
+	}
+
+	// one subscription per tenant that sees the events as they happen, and (below) one that catches up on them
+	live := map[string]*tenantSubscription{}
+	for _, tenantID := range tenantIDs {
+		live[tenantID] = subscribe("live", tenantID)
+	}
+
+	// the same wallet for both tenants
+	entityID := ksuid.New()
+
+	err := caller.CreditForTenant("acme", entityID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = caller.CreditForTenant("globex", entityID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// which would be fine against acme's balance
+	err = caller.DebitForTenant("globex", entityID, 5)
+	if err == nil || !strings.Contains(err.Error(), "overdrawn") {
+		t.Errorf("expected an overdrawn debit to be rejected, got %v", err)
+	}
+
+	err = caller.DebitForTenant("acme", entityID, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct {
+		balance      float64
+		transactions int
+		events       int // handled
+	}{
+		"acme":   {balance: 6, transactions: 2, events: 2},
+		"globex": {balance: 3, transactions: 1, events: 1},
+	}
+
+	db := d.GetTestDB(t)
+
+	for _, tenantID := range tenantIDs {
+		t.Run(tenantID, func(t *testing.T) {
+			balance, err := reader.GetBalanceForTenant(tenantID, entityID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if balance.Balance != expected[tenantID].balance {
+				t.Errorf("expected balance=%v, got %v", expected[tenantID].balance, balance.Balance)
+			}
+
+			transactions, err := reader.GetTransactionsForTenant(tenantID, entityID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(transactions.Transactions) != expected[tenantID].transactions {
+				t.Errorf("expected %v transactions, got %v", expected[tenantID].transactions, transactions.Transactions)
+			}
+
+			page, err := events.Query(db, events.Filter{TenantID: tenantID, Domain: domainName, EntityID: entityID.String()}, "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(page.Events) != expected[tenantID].events {
+				t.Errorf("expected %v events, got %v", expected[tenantID].events, len(page.Events))
+			}
+
+			for _, event := range page.Events {
+				if event.TenantID != tenantID || event.StreamID != tenants.GetName(tenantID, fmt.Sprintf("%v.%v", domainName, entityID)) {
+					t.Errorf("expected only events of tenant %v's stream, got %v in %v", tenantID, event.TenantID, event.StreamID)
+				}
+			}
+
+			caughtUp := subscribe("caught_up", tenantID)
+
+			for name, subscription := range map[string]*tenantSubscription{"live": live[tenantID], "caught_up": caughtUp} {
+				// the other tenant's events leave gaps in the positions, which take a moment to be sure of
+				deadline := time.Now().Add(time.Second * 10)
+
+				for len(subscription.getTenantIDs()) < expected[tenantID].events && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond * 10)
+				}
+
+				if got := subscription.getTenantIDs(); fmt.Sprint(got) != fmt.Sprint(repeat(tenantID, expected[tenantID].events)) {
+					t.Errorf("expected %v events for %v (%v), got %v", expected[tenantID].events, tenantID, name, got)
+				}
+			}
+		})
+	}
+
+	// and the default tenant has no such wallet at all
+	_, err = reader.GetBalance(entityID)
+	if err == nil {
+		t.Errorf("expected no wallet for the default tenant")
+	}
+}
+
+func repeat(value string, n int) []string {
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		values = append(values, value)
+	}
+
+	return values
+}
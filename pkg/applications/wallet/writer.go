@@ -1,9 +1,12 @@
 package wallet
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/segmentio/ksuid"
 )
 
@@ -15,7 +18,12 @@ type Writer struct {
 	wallet         *Wallet
 }
 
+// NewWriter is as per NewWriterForTenant, for the default tenant
 func NewWriter(entityID ksuid.KSUID) *Writer {
+	return NewWriterForTenant(tenants.DefaultTenantID, entityID)
+}
+
+func NewWriterForTenant(tenantID string, entityID ksuid.KSUID) *Writer {
 	name := domainName
 
 	w := Writer{
@@ -25,35 +33,105 @@ func NewWriter(entityID ksuid.KSUID) *Writer {
 		wallet:         NewWallet(entityID),
 	}
 
-	w.Writer = models.NewWriter(
+	w.Writer = models.NewWriterForTenant(
 		name,
+		tenantID,
 		entityID,
-		func() (interface{}, error) {
-			return w.wallet.state, nil
-		},
+		getState(w.wallet),
+		restoreState(w.wallet),
 	)
 
-	_ = w.Writer.AddHandler(credit, func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
-		return w.call(entityID, requestBody, w.wallet.Credit)
-	})
+	addUpcasters(w.Writer)
+
+	addHandlers(w.Writer, w.wallet)
 
-	_ = w.Writer.AddHandler(debit, func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
-		return w.call(entityID, requestBody, w.wallet.Debit)
+	w.Writer.SetEvolvers(newEvolvers(w.wallet))
+
+	// a wallet of its own for each rebuild of past state (e.g. the balance as of some time)
+	w.Writer.SetAggregateFactory(func() *models.Aggregate {
+		return newAggregate(entityID)
 	})
 
 	return &w
 }
 
-func (w *Writer) call(entityID ksuid.KSUID, requestBody interface{}, method func(ksuid.KSUID, float64) error) (State, error) {
-	amount, err := castRequestBodyToAmount(requestBody)
-	if err != nil {
-		return State{}, err
+// newAggregate returns a new wallet along with its handlers and evolvers
+func newAggregate(entityID ksuid.KSUID) *models.Aggregate {
+	wallet := NewWallet(entityID)
+
+	handlers := models.NewHandlers()
+
+	addHandlers(handlers, wallet)
+
+	return &models.Aggregate{Handlers: handlers, Evolvers: newEvolvers(wallet), GetState: getState(wallet), RestoreState: restoreState(wallet)}
+}
+
+func getState(wallet *Wallet) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return wallet.GetState(), nil
+	}
+}
+
+func restoreState(wallet *Wallet) func(json.RawMessage) error {
+	return func(data json.RawMessage) error {
+		state, err := FromJSON(data)
+		if err != nil {
+			return err
+		}
+
+		wallet.Restore(*state)
+
+		return nil
 	}
+}
+
+// addHandlers adds the credit and debit handlers for the given wallet; they decide on a transaction (credited or
+// debited) and leave taking it to the evolvers (a debit is also sent on to the notifications domain)
+func addHandlers(handlers models.Handlers, wallet *Wallet) {
+	_ = models.AddDecider(handlers, credit, func(ctx models.HandlerContext, tenantID string, entityID ksuid.KSUID, amount Amount) ([]models.DomainEvent, error) {
+		return decide(ctx, entityID, amount, credited, wallet.DecideCredit)
+	})
 
-	err = method(entityID, amount.Amount)
+	_ = models.AddDecider(handlers, debit, func(ctx models.HandlerContext, tenantID string, entityID ksuid.KSUID, amount Amount) (models.Outcome, error) {
+		domainEvents, err := decide(ctx, entityID, amount, debited, wallet.DecideDebit)
+		if err != nil {
+			return models.Outcome{}, err
+		}
+
+		// so that the notifications domain can let the owner of the wallet know that money went out of it
+		notification := models.OutgoingEvent{
+			Name:     notificationsDomainName,
+			EntityID: wallet.entityID,
+			Endpoint: walletDebited,
+			Data:     domainEvents[0].Data,
+		}
+
+		return models.Outcome{Result: domainEvents, Outgoing: []models.OutgoingEvent{notification}}, nil
+	})
+}
+
+// decide has the given method decide on a transaction, stamped with the time of the request (rather than now, which would
+// change every time a request from before the wallet was event sourced is replayed)
+func decide(ctx models.HandlerContext, entityID ksuid.KSUID, amount Amount, typeName string, method func(time.Time, ksuid.KSUID, float64) (Transaction, error)) ([]models.DomainEvent, error) {
+	transaction, err := method(ctx.Timestamp, entityID, amount.Amount)
 	if err != nil {
-		return State{}, err
+		return nil, err
+	}
+
+	return []models.DomainEvent{{TypeName: typeName, Data: transaction}}, nil
+}
+
+// newEvolvers returns the evolvers for the given wallet; a credited or debited transaction is taken as it is
+func newEvolvers(wallet *Wallet) models.Evolvers {
+	evolvers := models.NewEvolvers()
+
+	for _, typeName := range []string{credited, debited} {
+		_ = models.AddTypedEvolver(evolvers, typeName, func(transaction Transaction) error {
+			wallet.Apply(transaction)
+
+			return nil
+		})
 	}
 
-	return w.wallet.state, nil
+	return evolvers
 }
@@ -0,0 +1,20 @@
+package wallet
+
+import (
+	"github.com/initialed85/uneventful/pkg/models"
+)
+
+type WriterHost struct {
+	models.WriterHost
+}
+
+// NewWriterHost returns the writer for every wallet (as opposed to NewWriter, which is the writer for just the one)
+func NewWriterHost(tenantID string) *WriterHost {
+	h := WriterHost{}
+
+	h.WriterHost = models.NewWriterHost(domainName, tenantID, newAggregate)
+
+	addUpcasters(h.WriterHost)
+
+	return &h
+}
@@ -1,5 +1,9 @@
 package domains
 
 const (
-	defaultHTTPServerPort = 80
+	defaultHTTPServerPort = "80"
+	eventsPath            = "/events"
+	idempotencyKeyHeader  = "Idempotency-Key"
+	traceParentHeader     = "traceparent" // as per W3C Trace Context
+	traceStateHeader      = "tracestate"
 )
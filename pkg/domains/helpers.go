@@ -1,12 +1,109 @@
 package domains
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/validation"
 	"github.com/initialed85/uneventful/pkg/workers/http_worker"
 )
 
+func getHTTPServerPort() (int64, error) {
+	rawPort, err := helpers.GetEnvironmentVariable("HTTP_PORT", false, defaultHTTPServerPort)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(rawPort, 10, 64)
+}
+
+// getRequestContext returns the context of the HTTP request (so that a call made with it is given up on along with the
+// request) carrying the tenant, the idempotency key and metadata (the client's IP and trace headers) of the request
+func getRequestContext(request *http.Request, tenantID string) context.Context {
+	metadata := make(map[string]string)
+
+	clientIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err == nil {
+		metadata[events.MetadataClientIP] = clientIP
+	}
+
+	if request.Header.Get(traceParentHeader) != "" {
+		metadata[events.MetadataTraceParent] = request.Header.Get(traceParentHeader)
+	}
+
+	if request.Header.Get(traceStateHeader) != "" {
+		metadata[events.MetadataTraceState] = request.Header.Get(traceStateHeader)
+	}
+
+	ctx := models.WithTenantID(request.Context(), tenantID)
+	ctx = models.WithMetadata(ctx, metadata)
+
+	if request.Header.Get(idempotencyKeyHeader) != "" {
+		ctx = models.WithIdempotencyKey(ctx, request.Header.Get(idempotencyKeyHeader))
+	}
+
+	return ctx
+}
+
+func parseTime(values url.Values, name string) (time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v %#+v could not be parsed: %v", name, value, err)
+	}
+
+	return t, nil
+}
+
+// getEventsFilter builds a filter from the query parameters correlation_id, causation_id, type (a pattern like
+// "wallet.*.credit"), source_name, source_id, domain, entity (requires domain), since and until (RFC3339) and rejected
+func getEventsFilter(values url.Values) (events.Filter, error) {
+	var err error
+
+	filter := events.Filter{
+		CorrelationID: values.Get("correlation_id"),
+		CausationID:   values.Get("causation_id"),
+		TypeName:      values.Get("type"),
+		SourceName:    values.Get("source_name"),
+		SourceID:      values.Get("source_id"),
+		Domain:        values.Get("domain"),
+		EntityID:      values.Get("entity"),
+	}
+
+	filter.Since, err = parseTime(values, "since")
+	if err != nil {
+		return filter, err
+	}
+
+	filter.Until, err = parseTime(values, "until")
+	if err != nil {
+		return filter, err
+	}
+
+	if values.Get("rejected") != "" {
+		filter.IncludeRejected, err = strconv.ParseBool(values.Get("rejected"))
+		if err != nil {
+			return filter, fmt.Errorf("rejected %#+v could not be parsed: %v", values.Get("rejected"), err)
+		}
+	}
+
+	return filter, nil
+}
+
 func handledErrorResponse(innerErr error, outerErr error, responseWriter http.ResponseWriter, request *http.Request, statusCode int, server Server) bool {
 	if outerErr == nil {
 		outerErr = innerErr
@@ -16,7 +113,15 @@ func handledErrorResponse(innerErr error, outerErr error, responseWriter http.Re
 		return false
 	}
 
-	err := http_worker.HandleErrorResponse(responseWriter, request, statusCode, outerErr)
+	var err error
+	var validationErrors validation.Errors
+
+	if errors.As(innerErr, &validationErrors) {
+		err = http_worker.HandleErrorResponseWithErrors(responseWriter, request, statusCode, outerErr, validationErrors)
+	} else {
+		err = http_worker.HandleErrorResponse(responseWriter, request, statusCode, outerErr)
+	}
+
 	if err != nil {
 		log.Printf("%v - warning: %v", server.GetName(), err)
 	}
@@ -1,13 +1,17 @@
 package domains
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	"github.com/initialed85/uneventful/pkg/lifecycles"
 	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
 	"github.com/initialed85/uneventful/pkg/workers/http_worker"
 	"github.com/segmentio/ksuid"
 )
@@ -18,16 +22,42 @@ type Server interface {
 
 type ServerImplementation struct {
 	lifecycles.Worker
-	domainName string
-	reader     models.Reader
-	caller     models.Caller
-	httpServer *http_worker.Worker
+	name           string
+	domainName     string
+	tenantID       string // the tenant the server is for (or any tenant, named by the header)
+	reader         models.Reader
+	caller         models.Caller
+	databaseWorker database_worker.Worker // for GET /events; nil if the server doesn't serve it
+	httpServer     *http_worker.Worker
 }
 
+// NewServer is as per NewServerForTenant, for the default tenant
 func NewServer(name string, domainName string, reader models.Reader, caller models.Caller) *ServerImplementation {
-	s := ServerImplementation{domainName: domainName, reader: reader, caller: caller}
+	return NewServerForTenant(name, domainName, tenants.DefaultTenantID, reader, caller)
+}
+
+// NewServerForTenant is as per NewServerWithOverrides, without GET /events
+func NewServerForTenant(name string, domainName string, tenantID string, reader models.Reader, caller models.Caller) *ServerImplementation {
+	return NewServerWithOverrides(name, domainName, tenantID, reader, caller, nil)
+}
+
+// NewServerWithEvents is as per NewServerWithOverrides, serving GET /events from the database the environment points at
+// (which has to be the one the history writer writes to)
+func NewServerWithEvents(name string, domainName string, tenantID string, reader models.Reader, caller models.Caller) *ServerImplementation {
+	return NewServerWithOverrides(name, domainName, tenantID, reader, caller, dependencies.Get().NewDatabaseWorker(name))
+}
 
-	s.httpServer = http_worker.New(name, defaultHTTPServerPort, map[string]http.HandlerFunc{fmt.Sprintf("/%v/", domainName): s.handle})
+// NewServerWithOverrides returns a server for the domain; it serves GET /events from the given database worker, unless
+// that's nil
+func NewServerWithOverrides(name string, domainName string, tenantID string, reader models.Reader, caller models.Caller, databaseWorker database_worker.Worker) *ServerImplementation {
+	s := ServerImplementation{
+		name:           name,
+		domainName:     domainName,
+		tenantID:       tenantID,
+		reader:         reader,
+		caller:         caller,
+		databaseWorker: databaseWorker,
+	}
 
 	s.Worker = lifecycles.NewLazyWorker(name, s.setup, s.teardown)
 
@@ -35,11 +65,60 @@ func NewServer(name string, domainName string, reader models.Reader, caller mode
 }
 
 func (s *ServerImplementation) setup() (err error) {
-	return lifecycles.Setup(s.reader, s.caller, s.httpServer)
+	port, err := getHTTPServerPort()
+	if err != nil {
+		return err
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		fmt.Sprintf("/%v/", s.domainName): s.handle,
+	}
+
+	if s.databaseWorker == nil {
+		s.httpServer = http_worker.New(s.name, port, handlers)
+
+		return lifecycles.Setup(s.reader, s.caller, s.httpServer)
+	}
+
+	handlers[eventsPath] = s.handleEvents
+
+	s.httpServer = http_worker.New(s.name, port, handlers)
+
+	return lifecycles.Setup(s.databaseWorker, s.reader, s.caller, s.httpServer)
 }
 
 func (s *ServerImplementation) teardown() (err error) {
-	return lifecycles.Teardown(s.httpServer, s.caller, s.reader)
+	if s.databaseWorker == nil {
+		return lifecycles.Teardown(s.httpServer, s.caller, s.reader)
+	}
+
+	return lifecycles.Teardown(s.httpServer, s.caller, s.reader, s.databaseWorker)
+}
+
+// getTenantID returns the tenant a request is for; that's the server's own tenant (a header naming any other is
+// refused), unless the server is for any tenant, in which case the header is required and trusted (so such a server
+// must only be reachable through something that authenticates the client and sets the header for it)
+func (s *ServerImplementation) getTenantID(request *http.Request) (string, int, error) {
+	tenantID := request.Header.Get(tenants.HTTPHeader)
+
+	if s.tenantID != tenants.AnyTenantID {
+		if tenantID != "" && tenantID != s.tenantID {
+			return "", 403, fmt.Errorf("%v header %#+v is for another tenant than this server's", tenants.HTTPHeader, tenantID)
+		}
+
+		return s.tenantID, 0, nil
+	}
+
+	if tenantID == "" {
+		return "", 400, fmt.Errorf("%v header is required", tenants.HTTPHeader)
+	}
+
+	err := tenants.Validate(tenantID, false)
+	if err != nil {
+		return "", 400, fmt.Errorf("%v header %#+v is invalid: %v", tenants.HTTPHeader, tenantID, err)
+	}
+
+	return tenantID, 0, nil
 }
 
 func (s *ServerImplementation) handle(responseWriter http.ResponseWriter, request *http.Request) {
@@ -64,14 +143,19 @@ func (s *ServerImplementation) handle(responseWriter http.ResponseWriter, reques
 
 	endpoint := pathParts[2]
 
-	var handler models.Handler
+	tenantID, statusCode, err := s.getTenantID(request)
+	if handledErrorResponse(err, nil, responseWriter, request, statusCode, s) {
+		return
+	}
+
+	var handler models.HandlerWithContext
 
 	if request.Method == http.MethodGet {
-		handler, err = s.reader.GetHandler(endpoint)
+		handler, err = s.reader.GetHandlerWithContext(endpoint)
 	}
 
 	if request.Method == http.MethodPost {
-		handler, err = s.caller.GetHandler(endpoint)
+		handler, err = s.caller.GetHandlerWithContext(endpoint)
 	}
 
 	if err != nil {
@@ -84,6 +168,17 @@ func (s *ServerImplementation) handle(responseWriter http.ResponseWriter, reques
 	var requestBody interface{}
 	var responseBody interface{}
 
+	// a read gets the query parameters (e.g. as_of) as its request body
+	if request.Method == http.MethodGet {
+		values := make(map[string]interface{})
+
+		for key := range request.URL.Query() {
+			values[key] = request.URL.Query().Get(key)
+		}
+
+		requestBody = values
+	}
+
 	if request.Method == http.MethodPost {
 		data, err = ioutil.ReadAll(request.Body)
 		if handledErrorResponse(err, fmt.Errorf("failed to read data from request body: %v", err), responseWriter, request, 400, s) {
@@ -94,13 +189,14 @@ func (s *ServerImplementation) handle(responseWriter http.ResponseWriter, reques
 			_ = request.Body.Close()
 		}()
 
-		err = json.Unmarshal(data, &requestBody)
-		if handledErrorResponse(err, fmt.Errorf("failed to parse JSON from request body: %v", err), responseWriter, request, 400, s) {
+		// decoded as the handler's own type (if it has one) and checked against its rules before going any further
+		requestBody, err = models.DecodeAndValidate(s.caller, endpoint, data)
+		if handledErrorResponse(err, fmt.Errorf("request body is invalid: %v", err), responseWriter, request, 400, s) {
 			return
 		}
 	}
 
-	responseBody, err = handler(entityID, requestBody)
+	responseBody, err = handler(models.NewHandlerContext(getRequestContext(request, tenantID), tenantID), tenantID, entityID, requestBody)
 
 	if handledErrorResponse(err, fmt.Errorf("failed to handle endpoint=%#+v: %v", endpoint, err), responseWriter, request, 400, s) {
 		return
@@ -114,3 +210,48 @@ func (s *ServerImplementation) handle(responseWriter http.ResponseWriter, reques
 		_ = http_worker.HandleResponse(responseWriter, request, 200, http_worker.GetSuccessResponse(fmt.Sprintf("handled endpoint=%#+v", endpoint)))
 	}
 }
+
+// handleEvents serves a page of the events for the requesting tenant that match the query parameters (see
+// getEventsFilter), e.g. everything that stemmed from a request with GET /events?correlation_id=[ksuid]
+func (s *ServerImplementation) handleEvents(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		if handledErrorResponse(fmt.Errorf("method must be %v", http.MethodGet), nil, responseWriter, request, 400, s) {
+			return
+		}
+	}
+
+	tenantID, statusCode, err := s.getTenantID(request)
+	if handledErrorResponse(err, nil, responseWriter, request, statusCode, s) {
+		return
+	}
+
+	values := request.URL.Query()
+
+	filter, err := getEventsFilter(values)
+	if handledErrorResponse(err, nil, responseWriter, request, 400, s) {
+		return
+	}
+
+	filter.TenantID = tenantID
+
+	limit := 0
+
+	if values.Get("limit") != "" {
+		limit, err = strconv.Atoi(values.Get("limit"))
+		if handledErrorResponse(err, fmt.Errorf("limit %#+v could not be parsed: %v", values.Get("limit"), err), responseWriter, request, 400, s) {
+			return
+		}
+	}
+
+	db, err := s.databaseWorker.GetDB()
+	if handledErrorResponse(err, nil, responseWriter, request, 500, s) {
+		return
+	}
+
+	page, err := events.Query(db.WithContext(request.Context()), filter, values.Get("cursor"), limit)
+	if handledErrorResponse(err, fmt.Errorf("failed to query events: %v", err), responseWriter, request, 400, s) {
+		return
+	}
+
+	_ = http_worker.HandleResponse(responseWriter, request, 200, page)
+}
@@ -0,0 +1,291 @@
+package domains
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/segmentio/ksuid"
+)
+
+// startTestServer starts a server for the tenant on a free port and returns its URL
+func startTestServer(t *testing.T, tenantID string, databaseWorker database_worker.Worker) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	_ = listener.Close()
+
+	t.Setenv("HTTP_PORT", fmt.Sprint(port))
+
+	server := NewServerWithOverrides("test", "wallet", tenantID, models.NewReader("test"), models.NewCaller("test", ksuid.New()), databaseWorker)
+
+	in_memory.Start(t, server)
+
+	return fmt.Sprintf("http://127.0.0.1:%v", port)
+}
+
+func get(t *testing.T, rawURL string, tenantID string) (int, []byte) {
+	t.Helper()
+
+	var response *http.Response
+
+	// the server may still be coming up
+	deadline := time.Now().Add(time.Second * 5)
+
+	for {
+		request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tenantID != "" {
+			request.Header.Set(tenants.HTTPHeader, tenantID)
+		}
+
+		response, err = http.DefaultClient.Do(request)
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, data
+}
+
+func TestServerEvents(t *testing.T) {
+	d := in_memory.Setup(t)
+
+	db := d.GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	start := time.Date(2024, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	walletID := ksuid.New()
+
+	credit := events.NewWithoutCorrelation(fmt.Sprintf("wallet.%v.credit", walletID), json.RawMessage(`{}`))
+	credit.TenantID = "acme"
+	credit.SetSource("caller_wallet", ksuid.New())
+
+	debit := events.NewCausedBy(credit, fmt.Sprintf("wallet.%v.debit", walletID), json.RawMessage(`{}`))
+	debit.SetSource("writer_wallet", walletID)
+
+	rejected := events.NewCausedBy(credit, fmt.Sprintf("wallet.%v.debit", walletID), json.RawMessage(`{}`))
+	rejected.SetSource("writer_wallet", walletID)
+
+	// the same entity for another tenant
+	otherTenant := events.NewWithoutCorrelation(fmt.Sprintf("wallet.%v.credit", walletID), json.RawMessage(`{}`))
+	otherTenant.TenantID = "other"
+
+	names := map[ksuid.KSUID]string{credit.EventID: "credit", debit.EventID: "debit", rejected.EventID: "rejected", otherTenant.EventID: "other_tenant"}
+
+	for i, event := range []*events.Event{credit, debit, rejected, otherTenant} {
+		event.Timestamp = start.Add(time.Hour * time.Duration(i))
+
+		databaseEvent, err := event.ToDatabaseEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		databaseEvent.IsRejected = event == rejected
+
+		_, err = store.Append(tenants.GetName(event.TenantID, events.GetStreamID(event.TypeName)), events.AnyVersion, databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseURL := startTestServer(t, tenants.AnyTenantID, d.NewDatabaseWorker("test"))
+
+	getPage := func(t *testing.T, query url.Values, tenantID string) (int, *events.Page) {
+		t.Helper()
+
+		statusCode, data := get(t, fmt.Sprintf("%v%v?%v", baseURL, eventsPath, query.Encode()), tenantID)
+
+		if statusCode != 200 {
+			return statusCode, nil
+		}
+
+		page := events.Page{}
+
+		err := json.Unmarshal(data, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return statusCode, &page
+	}
+
+	getNames := func(page *events.Page) []string {
+		pageNames := make([]string, 0)
+
+		for _, event := range page.Events {
+			pageNames = append(pageNames, names[event.EventID])
+		}
+
+		return pageNames
+	}
+
+	cases := []struct {
+		name     string
+		query    url.Values
+		tenantID string
+		names    []string
+	}{
+		{name: "everything for the tenant", query: url.Values{}, tenantID: "acme", names: []string{"credit", "debit"}},
+		{name: "everything for another tenant", query: url.Values{}, tenantID: "other", names: []string{"other_tenant"}},
+		{name: "rejected too", query: url.Values{"rejected": {"true"}}, tenantID: "acme", names: []string{"credit", "debit", "rejected"}},
+		{name: "correlation", query: url.Values{"correlation_id": {credit.EventID.String()}}, tenantID: "acme", names: []string{"credit", "debit"}},
+		{name: "causation", query: url.Values{"causation_id": {credit.EventID.String()}}, tenantID: "acme", names: []string{"debit"}},
+		{name: "type", query: url.Values{"type": {"wallet.*.credit"}}, tenantID: "acme", names: []string{"credit"}},
+		{name: "source name", query: url.Values{"source_name": {"writer_wallet"}}, tenantID: "acme", names: []string{"debit"}},
+		{name: "source ID", query: url.Values{"source_id": {walletID.String()}}, tenantID: "acme", names: []string{"debit"}},
+		{name: "domain", query: url.Values{"domain": {"thing"}}, tenantID: "acme", names: []string{}},
+		{name: "entity", query: url.Values{"domain": {"wallet"}, "entity": {walletID.String()}}, tenantID: "other", names: []string{"other_tenant"}},
+		{name: "since", query: url.Values{"since": {start.Add(time.Hour).Format(time.RFC3339Nano)}}, tenantID: "acme", names: []string{"debit"}},
+		{name: "until", query: url.Values{"until": {start.Add(time.Hour).Format(time.RFC3339Nano)}}, tenantID: "acme", names: []string{"credit"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			statusCode, page := getPage(t, c.query, c.tenantID)
+			if statusCode != 200 {
+				t.Fatalf("expected 200, got %v", statusCode)
+			}
+
+			if pageNames := getNames(page); fmt.Sprint(pageNames) != fmt.Sprint(c.names) {
+				t.Errorf("expected %v, got %v", c.names, pageNames)
+			}
+		})
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		statusCode, page := getPage(t, url.Values{"rejected": {"true"}, "limit": {"2"}}, "acme")
+		if statusCode != 200 {
+			t.Fatalf("expected 200, got %v", statusCode)
+		}
+
+		if pageNames := getNames(page); fmt.Sprint(pageNames) != "[credit debit]" || page.Cursor == "" {
+			t.Fatalf("expected [credit debit] and a cursor, got %v and %#+v", pageNames, page.Cursor)
+		}
+
+		statusCode, page = getPage(t, url.Values{"rejected": {"true"}, "limit": {"2"}, "cursor": {page.Cursor}}, "acme")
+		if statusCode != 200 {
+			t.Fatalf("expected 200, got %v", statusCode)
+		}
+
+		if pageNames := getNames(page); fmt.Sprint(pageNames) != "[rejected]" || page.Cursor != "" {
+			t.Errorf("expected [rejected] and no cursor, got %v and %#+v", pageNames, page.Cursor)
+		}
+	})
+
+	badCases := []struct {
+		name     string
+		query    url.Values
+		tenantID string
+	}{
+		{name: "no tenant", query: url.Values{}, tenantID: ""},
+		{name: "invalid tenant", query: url.Values{}, tenantID: "a b"},
+		{name: "entity without domain", query: url.Values{"entity": {walletID.String()}}, tenantID: "acme"},
+		{name: "bad since", query: url.Values{"since": {"yesterday"}}, tenantID: "acme"},
+		{name: "bad until", query: url.Values{"until": {"tomorrow"}}, tenantID: "acme"},
+		{name: "bad rejected", query: url.Values{"rejected": {"maybe"}}, tenantID: "acme"},
+		{name: "bad limit", query: url.Values{"limit": {"lots"}}, tenantID: "acme"},
+		{name: "bad cursor", query: url.Values{"cursor": {"nope"}}, tenantID: "acme"},
+	}
+
+	for _, c := range badCases {
+		t.Run(c.name, func(t *testing.T) {
+			if statusCode, _ := getPage(t, c.query, c.tenantID); statusCode != 400 {
+				t.Errorf("expected 400, got %v", statusCode)
+			}
+		})
+	}
+}
+
+func TestServerEventsForATenant(t *testing.T) {
+	d := in_memory.Setup(t)
+
+	db := d.GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	for _, tenantID := range []string{"acme", "other"} {
+		event := events.NewWithoutCorrelation(fmt.Sprintf("wallet.%v.credit", ksuid.New()), json.RawMessage(`{}`))
+		event.TenantID = tenantID
+
+		databaseEvent, err := event.ToDatabaseEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.Append(tenants.GetName(tenantID, events.GetStreamID(event.TypeName)), events.AnyVersion, databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	baseURL := startTestServer(t, "acme", d.NewDatabaseWorker("test"))
+
+	// the server's own tenant, whether or not the header names it
+	for _, tenantID := range []string{"", "acme"} {
+		statusCode, data := get(t, baseURL+eventsPath, tenantID)
+		if statusCode != 200 {
+			t.Fatalf("expected 200, got %v: %s", statusCode, data)
+		}
+
+		page := events.Page{}
+
+		err := json.Unmarshal(data, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page.Events) != 1 || page.Events[0].TenantID != "acme" {
+			t.Errorf("expected only the event for acme, got %s", data)
+		}
+	}
+
+	if statusCode, _ := get(t, baseURL+eventsPath, "other"); statusCode != 403 {
+		t.Errorf("expected 403 for another tenant, got %v", statusCode)
+	}
+}
+
+func TestServerWithoutEvents(t *testing.T) {
+	in_memory.Setup(t)
+
+	baseURL := startTestServer(t, tenants.DefaultTenantID, nil)
+
+	if statusCode, _ := get(t, baseURL+eventsPath, ""); statusCode != 404 {
+		t.Errorf("expected 404, got %v", statusCode)
+	}
+}
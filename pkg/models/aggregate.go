@@ -0,0 +1,14 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// Aggregate is a standalone instance of what a writer keeps state for (e.g. a wallet) along with its handlers, so that
+// state can be rebuilt from the event log without touching the writer's own
+type Aggregate struct {
+	Handlers
+	Evolvers     Evolvers // nil unless the writer is event sourced (see Writer.SetEvolvers)
+	GetState     func() (interface{}, error)
+	RestoreState func(json.RawMessage) error
+}
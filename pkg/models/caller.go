@@ -1,43 +1,67 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"time"
 
 	"github.com/initialed85/uneventful/pkg/lifecycles"
 	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/codecs"
 	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
 	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
 	"github.com/segmentio/ksuid"
 )
 
+// CallOptions carries the optional parts of a call; a zero value is the same as a plain Call
+type CallOptions struct {
+	TenantID       string
+	IdempotencyKey string
+	CorrelationID  ksuid.KSUID
+	CausationID    ksuid.KSUID
+	Metadata       map[string]string
+}
+
 type Caller interface {
 	lifecycles.Worker
 	Handlers
+	events.Upcasters
 	Call(name string, entityID ksuid.KSUID, endpoint string, data []byte) error
+	CallWithIdempotencyKey(name string, entityID ksuid.KSUID, endpoint string, data []byte, idempotencyKey string) error
+	CallWithOptions(name string, entityID ksuid.KSUID, endpoint string, data []byte, options CallOptions) error
+	CallWithContext(ctx context.Context, name string, entityID ksuid.KSUID, endpoint string, data []byte, options CallOptions) error
 }
 
 type CallerImplementation struct {
 	lifecycles.Worker
 	Handlers
-	natsWorker *nats_worker.Worker
+	events.Upcasters
+	natsWorker nats_worker.Worker
+	codec      codecs.Codec
 	name       string
 	entityID   ksuid.KSUID
 }
 
 func NewCaller(name string, entityID ksuid.KSUID) *CallerImplementation {
-	c := CallerImplementation{Handlers: NewHandlers(), name: name, entityID: entityID}
+	c := CallerImplementation{Handlers: NewHandlers(), Upcasters: events.NewUpcasters(), name: name, entityID: entityID}
 
 	workerName := fmt.Sprintf("caller_%v.%v", name, entityID)
 
 	c.Worker = lifecycles.NewLazyWorker(workerName, c.setup, c.teardown)
 
-	c.natsWorker = nats_worker.New(workerName)
+	c.natsWorker = dependencies.Get().NewNatsWorker(workerName)
 
 	return &c
 }
 
-func (c *CallerImplementation) setup() error {
+func (c *CallerImplementation) setup() (err error) {
+	c.codec, err = codecs.GetDefault()
+	if err != nil {
+		return err
+	}
+
 	return lifecycles.Setup(c.natsWorker)
 }
 
@@ -46,6 +70,44 @@ func (c *CallerImplementation) teardown() error {
 }
 
 func (c *CallerImplementation) Call(name string, entityID ksuid.KSUID, endpoint string, data []byte) error {
+	return c.CallWithOptions(name, entityID, endpoint, data, CallOptions{})
+}
+
+// CallWithIdempotencyKey is as per Call, but a writer that has already seen the given key for the entity will
+// respond with the outcome of that original call rather than handling it again
+func (c *CallerImplementation) CallWithIdempotencyKey(name string, entityID ksuid.KSUID, endpoint string, data []byte, idempotencyKey string) error {
+	return c.CallWithOptions(name, entityID, endpoint, data, CallOptions{IdempotencyKey: idempotencyKey})
+}
+
+func (c *CallerImplementation) CallWithOptions(name string, entityID ksuid.KSUID, endpoint string, data []byte, options CallOptions) error {
+	return c.CallWithContext(context.Background(), name, entityID, endpoint, data, options)
+}
+
+// CallWithContext is as per CallWithOptions, but gives up when the context is cancelled or reaches its deadline (which
+// the writer is told of, so that it doesn't commit a call that nobody is waiting on anymore); a context without a
+// deadline gets a default one
+//
+// Anything the options leave empty comes from the context if it carries it (see WithTenantID, WithMetadata,
+// WithIdempotencyKey and WithCause, or the HandlerContext of a writer's handler)
+func (c *CallerImplementation) CallWithContext(ctx context.Context, name string, entityID ksuid.KSUID, endpoint string, data []byte, options CallOptions) error {
+	if options.TenantID == "" {
+		options.TenantID, _ = GetTenantID(ctx)
+	}
+
+	if options.IdempotencyKey == "" {
+		options.IdempotencyKey = GetIdempotencyKey(ctx)
+	}
+
+	if options.CorrelationID == ksuid.Nil && options.CausationID == ksuid.Nil {
+		options.CorrelationID, options.CausationID = getCause(ctx)
+	}
+
+	// a call is always on behalf of exactly one tenant
+	err := tenants.Validate(options.TenantID, false)
+	if err != nil {
+		return err
+	}
+
 	natsConn, err := c.natsWorker.GetNatsConn()
 	if err != nil {
 		return err
@@ -60,32 +122,64 @@ func (c *CallerImplementation) Call(name string, entityID ksuid.KSUID, endpoint
 
 	address := fmt.Sprintf("%v.%v.%v", name, entityID, endpoint)
 
-	event := events.NewWithoutCorrelation(address, requestJSON)
+	event := events.NewWithCorrelation(options.CorrelationID, address, requestJSON)
+
+	// a call that isn't part of something else starts a correlation of its own (so it can be traced by its event ID)
+	if event.CorrelationID == ksuid.Nil {
+		event.CorrelationID = event.EventID
+	}
 
 	event.SetSource(c.name, c.entityID)
+	event.TenantID = options.TenantID
+	event.IdempotencyKey = options.IdempotencyKey
+	event.CausationID = options.CausationID
+
+	for key, value := range GetMetadata(ctx) {
+		event.SetMetadata(key, value)
+	}
+
+	for key, value := range options.Metadata {
+		event.SetMetadata(key, value)
+	}
+	event.SchemaVersion = c.GetSchemaVersion(event.TypeName)
 
-	eventJSON, err := event.ToJSON()
+	requestMsg, err := newMsg(tenants.GetName(options.TenantID, fmt.Sprintf("event.%v", address)), event, c.codec)
 	if err != nil {
 		return err
 	}
 
-	msg, err := natsConn.Request(fmt.Sprintf("event.%v", address), eventJSON, time.Second*5)
+	ctx, cancel := withDefaultTimeout(ctx, defaultCallTimeout)
+	defer cancel()
+
+	setTimeoutHeader(requestMsg, ctx)
+
+	msg, err := natsConn.RequestMsgWithContext(ctx, requestMsg)
 	if err != nil {
 		return err
 	}
 
-	responseEvent, err := events.FromJSON(msg.Data)
+	// the writer gives up at the same deadline, so its response may beat ours to saying so; either way it's our deadline
+	err = getContextErr(ctx)
 	if err != nil {
 		return err
 	}
 
+	responseEvent, _, err := decodeMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	if responseEvent.TenantID != options.TenantID {
+		return fmt.Errorf("response for tenant_id=%#+v to a call for tenant_id=%#+v", responseEvent.TenantID, options.TenantID)
+	}
+
 	response, err := calls.ResponseFromJSON(responseEvent.Data)
 	if err != nil {
 		return err
 	}
 
 	if response.Error != "" {
-		return fmt.Errorf(response.Error)
+		return errors.New(response.Error)
 	}
 
 	if !response.Success {
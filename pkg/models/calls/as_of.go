@@ -0,0 +1,28 @@
+package calls
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AsOf is a point in an entity's history to rebuild its state at; the last event at or before the timestamp, the event
+// at the sequence or (given both) whichever of those comes first
+type AsOf struct {
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Sequence  int64     `json:"sequence,omitempty"`
+}
+
+func AsOfFromJSON(data []byte) (*AsOf, error) {
+	a := AsOf{}
+
+	err := json.Unmarshal(data, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (a *AsOf) ToJSON() ([]byte, error) {
+	return json.Marshal(a)
+}
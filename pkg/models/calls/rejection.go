@@ -0,0 +1,33 @@
+package calls
+
+import (
+	"encoding/json"
+)
+
+// Rejection is the data of the event published when a writer rejects a request
+type Rejection struct {
+	Endpoint string          `json:"endpoint"`
+	Data     json.RawMessage `json:"data"`
+	Reason   string          `json:"reason"`
+}
+
+func NewRejection(request *Request, err error) *Rejection {
+	r := Rejection{Endpoint: request.Endpoint, Data: request.Data, Reason: err.Error()}
+
+	return &r
+}
+
+func RejectionFromJSON(data []byte) (*Rejection, error) {
+	r := Rejection{}
+
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (r *Rejection) ToJSON() ([]byte, error) {
+	return json.Marshal(r)
+}
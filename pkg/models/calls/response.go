@@ -5,8 +5,9 @@ import (
 )
 
 type Response struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success bool            `json:"success"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"` // for responses that carry something back (e.g. state as of a point in time)
 }
 
 func NewResponseFromError(err error) *Response {
@@ -0,0 +1,5 @@
+package checkpoints
+
+const (
+	tableName = "checkpoint"
+)
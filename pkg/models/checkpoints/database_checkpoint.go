@@ -0,0 +1,54 @@
+package checkpoints
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DatabaseCheckpoint is how far a named subscriber has got through a given event store
+type DatabaseCheckpoint struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Name      string `gorm:"primaryKey"`
+	StoreID   string
+	Position  int64
+}
+
+func (d *DatabaseCheckpoint) TableName() string {
+	return tableName
+}
+
+// Get returns the position the named subscriber has got to in the given event store (or 0 if it's yet to start, or
+// if its checkpoint is for some other event store)
+func Get(db *gorm.DB, name string, storeID string) (int64, error) {
+	row := DatabaseCheckpoint{}
+
+	returnedDB := db.Where("name = ?", name).Take(&row)
+	if returnedDB.Error != nil {
+		if errors.Is(returnedDB.Error, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+
+		return 0, returnedDB.Error
+	}
+
+	if row.StoreID != storeID {
+		return 0, nil
+	}
+
+	return row.Position, nil
+}
+
+func Save(db *gorm.DB, name string, storeID string, position int64) error {
+	row := DatabaseCheckpoint{Name: name, StoreID: storeID, Position: position}
+
+	returnedDB := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "store_id", "position"}),
+	}).Create(&row)
+
+	return returnedDB.Error
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/nats-io/nats.go"
+)
+
+// newMsg encodes the event with the given codec into a message for the given subject (with the content type header
+// set so that the other end knows how to decode it)
+func newMsg(subject string, event *events.Event, codec codecs.Codec) (*nats.Msg, error) {
+	data, err := event.Encode(codec)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(codecs.ContentTypeHeader, codec.ContentType())
+
+	return msg, nil
+}
+
+// decodeMsg decodes the event in the message with the codec its content type header calls for (JSON if there isn't
+// one), returning that codec so that any reply can be encoded the same way
+func decodeMsg(msg *nats.Msg) (*events.Event, codecs.Codec, error) {
+	codec, err := codecs.Get(msg.Header.Get(codecs.ContentTypeHeader))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	event, err := events.Decode(codec, msg.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return event, codec, nil
+}
@@ -0,0 +1,25 @@
+package codecs
+
+import "github.com/fxamacker/cbor/v2"
+
+// encMode keeps timestamps to the nanosecond (the default is whole seconds)
+var encMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano, TimeTag: cbor.EncTagRequired}.EncMode()
+
+// CBOR is as per MessagePack, but per cbor tags
+type CBOR struct{}
+
+func NewCBOR() *CBOR {
+	return &CBOR{}
+}
+
+func (c *CBOR) ContentType() string {
+	return ContentTypeCBOR
+}
+
+func (c *CBOR) Marshal(v interface{}) ([]byte, error) {
+	return encMode.Marshal(v)
+}
+
+func (c *CBOR) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
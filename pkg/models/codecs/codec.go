@@ -0,0 +1,77 @@
+package codecs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+)
+
+// Codec encodes and decodes values for the wire; the content type goes out alongside the encoded value (as a NATS
+// header) so that whoever receives it knows which codec to decode it with
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Codec)
+)
+
+func init() {
+	Register(NewJSON())
+	Register(NewMessagePack())
+	Register(NewCBOR())
+	Register(NewProtobuf())
+}
+
+// Register makes a codec available by its content type (replacing any codec already registered for it)
+func Register(codec Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	registry[codec.ContentType()] = codec
+}
+
+// Get returns the codec for the given content type; no content type at all means JSON (i.e. anything published before
+// there were codecs)
+func Get(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	codec, ok := registry[contentType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type=%#+v (have %v)", contentType, getContentTypes())
+	}
+
+	return codec, nil
+}
+
+func getContentTypes() []string {
+	contentTypes := make([]string, 0, len(registry))
+
+	for contentType := range registry {
+		contentTypes = append(contentTypes, contentType)
+	}
+
+	sort.Strings(contentTypes)
+
+	return contentTypes
+}
+
+// GetDefault returns the codec this service publishes with (per EVENT_CONTENT_TYPE)
+func GetDefault() (Codec, error) {
+	contentType, err := helpers.GetEnvironmentVariable("EVENT_CONTENT_TYPE", false, defaultContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return Get(contentType)
+}
@@ -0,0 +1,90 @@
+package codecs_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/segmentio/ksuid"
+)
+
+func TestRoundTrip(t *testing.T) {
+	full := events.Event{
+		EventID:        ksuid.New(),
+		TenantID:       "acme",
+		CorrelationID:  ksuid.New(),
+		CausationID:    ksuid.New(),
+		Metadata:       map[string]string{"traceparent": "00-abc-def-01", "client_ip": "10.0.0.1"},
+		IdempotencyKey: "some-key",
+		Timestamp:      time.Date(2024, 2, 29, 13, 14, 15, 123456789, time.UTC),
+		SourceName:     "caller_wallet",
+		SourceID:       ksuid.New(),
+		TypeName:       "wallet.2bRY5JCmNZ0FUHbN1k7N7u6wYQe.credit",
+		SchemaVersion:  2,
+		Position:       1 << 40,
+		Data:           json.RawMessage(`{"amount":1.5,"note":"ünïcødé"}`),
+	}
+
+	minimal := events.Event{
+		EventID:   ksuid.New(),
+		Timestamp: time.Date(1969, 7, 20, 20, 17, 40, 500, time.UTC), // before the epoch
+		TypeName:  "thing.happened",
+		Data:      json.RawMessage(`{}`),
+	}
+
+	for _, contentType := range []string{codecs.ContentTypeJSON, codecs.ContentTypeMessagePack, codecs.ContentTypeCBOR, codecs.ContentTypeProtobuf} {
+		codec, err := codecs.Get(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, event := range map[string]events.Event{"full": full, "minimal": minimal} {
+			t.Run(contentType+"/"+name, func(t *testing.T) {
+				data, err := event.Encode(codec)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				decoded, err := events.Decode(codec, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(*decoded, event) {
+					t.Errorf("expected %#+v, got %#+v", event, *decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	codec, err := codecs.Get("")
+	if err != nil || codec.ContentType() != codecs.ContentTypeJSON {
+		t.Errorf("expected JSON for no content type, got %#+v, %v", codec, err)
+	}
+
+	_, err = codecs.Get("application/xml")
+	if err == nil {
+		t.Errorf("expected an error for an unregistered content type")
+	}
+}
+
+func TestProtobufRefusesOtherValues(t *testing.T) {
+	codec := codecs.NewProtobuf()
+
+	_, err := codec.Marshal(map[string]interface{}{"a": 1})
+	if err == nil {
+		t.Errorf("expected an error marshalling something that isn't a ProtoMessage")
+	}
+
+	var v map[string]interface{}
+
+	err = codec.Unmarshal([]byte{}, &v)
+	if err == nil {
+		t.Errorf("expected an error unmarshalling into something that isn't a ProtoMessage")
+	}
+}
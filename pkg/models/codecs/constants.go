@@ -0,0 +1,10 @@
+package codecs
+
+const (
+	ContentTypeHeader      = "Content-Type"
+	ContentTypeJSON        = "application/json"
+	ContentTypeMessagePack = "application/msgpack"
+	ContentTypeCBOR        = "application/cbor"
+	ContentTypeProtobuf    = "application/protobuf"
+	defaultContentType     = ContentTypeJSON
+)
@@ -0,0 +1,21 @@
+package codecs
+
+import "encoding/json"
+
+type JSON struct{}
+
+func NewJSON() *JSON {
+	return &JSON{}
+}
+
+func (c *JSON) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (c *JSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *JSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
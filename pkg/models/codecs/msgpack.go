@@ -0,0 +1,23 @@
+package codecs
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// MessagePack encodes values as they are (per their msgpack tags) rather than as their JSON, so IDs go as bytes and
+// timestamps as timestamps; anything that's already JSON (e.g. an event's data) goes as those bytes
+type MessagePack struct{}
+
+func NewMessagePack() *MessagePack {
+	return &MessagePack{}
+}
+
+func (c *MessagePack) ContentType() string {
+	return ContentTypeMessagePack
+}
+
+func (c *MessagePack) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (c *MessagePack) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
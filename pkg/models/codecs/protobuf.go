@@ -0,0 +1,39 @@
+package codecs
+
+import "fmt"
+
+// ProtoMessage is something with a protobuf message of its own to be encoded as (e.g. events.Event, per event.proto)
+type ProtoMessage interface {
+	MarshalProto() ([]byte, error)
+	UnmarshalProto(data []byte) error
+}
+
+// Protobuf encodes values as their protobuf message; unlike the other codecs it can't encode just anything, only a
+// ProtoMessage
+type Protobuf struct{}
+
+func NewProtobuf() *Protobuf {
+	return &Protobuf{}
+}
+
+func (c *Protobuf) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (c *Protobuf) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T has no protobuf message to be encoded as", v)
+	}
+
+	return message.MarshalProto()
+}
+
+func (c *Protobuf) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("%T has no protobuf message to be decoded from", v)
+	}
+
+	return message.UnmarshalProto(data)
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+const (
+	replayPageSize          = 1000
+	subscriberBufferSize    = 1024
+	subscriberPollPeriod    = time.Second * 5
+	subscriberGapTimeout    = time.Millisecond * 250
+	defaultSnapshotEvents   = "100"           // 0 = never snapshot based on event count
+	defaultSnapshotInterval = "0s"            // 0s = never snapshot based on time
+	stateRequestTimeout     = time.Second * 5 // unless the context of the request has a deadline of its own
+	defaultCallTimeout      = time.Second * 5 // as above
+	timeoutHeader           = "Timeout"       // how long the sender of a request will wait for a response
+	asOfParameter           = "as_of"
+	asOfSequenceParameter   = "as_of_sequence"
+	hostedEntityBufferSize  = 1024
+	defaultIdleTimeout      = "5m" // 0s = never evict an entity for being idle
+	defaultMaxEntities      = "0"  // 0 = no limit on how many entities a writer host has up at once
+	maxReaperPeriod         = time.Second * 5
+)
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/ksuid"
+)
+
+type contextKey int
+
+const (
+	tenantIDContextKey contextKey = iota
+	metadataContextKey
+	idempotencyKeyContextKey
+	causeContextKey
+)
+
+// cause is the event that whatever's done with a context stems from
+type cause struct {
+	correlationID ksuid.KSUID
+	causationID   ksuid.KSUID
+}
+
+// WithTenantID returns a copy of the context that carries the tenant (for CallWithContext to call on behalf of)
+func WithTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantIDContextKey, tenantID)
+}
+
+// GetTenantID returns the tenant the context carries (and false if it doesn't carry one)
+func GetTenantID(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantIDContextKey).(string)
+
+	return tenantID, ok
+}
+
+// WithMetadata returns a copy of the context that carries the given metadata (e.g. traceparent) on top of any it
+// already carries
+func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	merged := make(map[string]string)
+
+	for key, value := range GetMetadata(ctx) {
+		merged[key] = value
+	}
+
+	for key, value := range metadata {
+		merged[key] = value
+	}
+
+	return context.WithValue(ctx, metadataContextKey, merged)
+}
+
+// GetMetadata returns the metadata the context carries (nil if it doesn't carry any); it mustn't be changed
+func GetMetadata(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(metadataContextKey).(map[string]string)
+
+	return metadata
+}
+
+// WithIdempotencyKey returns a copy of the context that carries the idempotency key for the call made with it
+func WithIdempotencyKey(ctx context.Context, idempotencyKey string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey, idempotencyKey)
+}
+
+func GetIdempotencyKey(ctx context.Context) string {
+	idempotencyKey, _ := ctx.Value(idempotencyKeyContextKey).(string)
+
+	return idempotencyKey
+}
+
+// WithCause returns a copy of the context that carries the tenant, the metadata and the correlation of the given
+// event, so that calls made with it are correlated to and caused by that event
+func WithCause(ctx context.Context, event *events.Event) context.Context {
+	correlationID := event.CorrelationID
+	if correlationID == ksuid.Nil {
+		correlationID = event.EventID
+	}
+
+	ctx = WithTenantID(ctx, event.TenantID)
+	ctx = WithMetadata(ctx, event.Metadata)
+
+	return context.WithValue(ctx, causeContextKey, cause{correlationID: correlationID, causationID: event.EventID})
+}
+
+// getCause returns the correlation and causation IDs the context carries (both ksuid.Nil if it carries none)
+func getCause(ctx context.Context) (ksuid.KSUID, ksuid.KSUID) {
+	c, _ := ctx.Value(causeContextKey).(cause)
+
+	return c.correlationID, c.causationID
+}
+
+// withDefaultTimeout gives the context the given timeout, unless it already has a deadline of its own
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	_, ok := ctx.Deadline()
+	if ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// getContextErr is as per ctx.Err(), but it also counts a deadline that has passed before the context has noticed
+func getContextErr(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+// setTimeoutHeader tells the other end of a request how long is left before the given context's deadline
+func setTimeoutHeader(msg *nats.Msg, ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	msg.Header.Set(timeoutHeader, time.Until(deadline).String())
+}
+
+// getMsgContext returns a context with the deadline the sender of the message gave it (see setTimeoutHeader), less the
+// time since the event in it was made (e.g. waiting behind other messages); a clock behind the sender's doesn't add any
+func getMsgContext(msg *nats.Msg, event *events.Event) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+
+	timeout, err := time.ParseDuration(msg.Header.Get(timeoutHeader))
+	if err != nil {
+		return context.WithCancel(ctx)
+	}
+
+	waited := helpers.GetNow().Sub(event.Timestamp)
+	if waited > 0 {
+		timeout -= waited
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"time"
+
+	"github.com/jackc/pgtype"
+	"gorm.io/gorm"
+)
+
+// ArchivedEvent is a flat (and lossless) copy of a DatabaseEvent that can be written out as JSONL or Parquet
+type ArchivedEvent struct {
+	CreatedAt       time.Time  `json:"created_at" parquet:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" parquet:"updated_at"`
+	DeletedAt       *time.Time `json:"deleted_at" parquet:"deleted_at,optional"`
+	EventID         string     `json:"event_id" parquet:"event_id"`
+	TenantID        string     `json:"tenant_id" parquet:"tenant_id"`
+	StreamID        string     `json:"stream_id" parquet:"stream_id"`
+	Sequence        int64      `json:"sequence" parquet:"sequence"`
+	Position        int64      `json:"position" parquet:"position"`
+	CorrelationID   string     `json:"correlation_id" parquet:"correlation_id"`
+	CausationID     string     `json:"causation_id" parquet:"causation_id"`
+	IdempotencyKey  string     `json:"idempotency_key" parquet:"idempotency_key"`
+	Timestamp       time.Time  `json:"timestamp" parquet:"timestamp"`
+	SourceName      string     `json:"source_name" parquet:"source_name"`
+	SourceID        string     `json:"source_id" parquet:"source_id"`
+	TypeName        string     `json:"type_name" parquet:"type_name"`
+	SchemaVersion   int64      `json:"schema_version" parquet:"schema_version"`
+	Data            string     `json:"data" parquet:"data"`
+	KeyID           string     `json:"key_id" parquet:"key_id"`
+	Metadata        string     `json:"metadata" parquet:"metadata"`
+	IsHandled       bool       `json:"is_handled" parquet:"is_handled"`
+	IsRejected      bool       `json:"is_rejected" parquet:"is_rejected"`
+	RejectionReason string     `json:"rejection_reason" parquet:"rejection_reason"`
+	HandledByName   string     `json:"handled_by_name" parquet:"handled_by_name"`
+	HandledByID     string     `json:"handled_by_id" parquet:"handled_by_id"`
+	DataHash        string     `json:"data_hash" parquet:"data_hash"`
+	PreviousHash    string     `json:"previous_hash" parquet:"previous_hash"`
+	Hash            string     `json:"hash" parquet:"hash"`
+}
+
+func jsonbToString(jsonb pgtype.JSONB) string {
+	if jsonb.Status != pgtype.Present {
+		return ""
+	}
+
+	return string(jsonb.Bytes)
+}
+
+func jsonbFromString(data string) (pgtype.JSONB, error) {
+	jsonb := pgtype.JSONB{Status: pgtype.Null}
+
+	if data == "" {
+		return jsonb, nil
+	}
+
+	err := jsonb.Scan([]byte(data))
+
+	return jsonb, err
+}
+
+func (d *DatabaseEvent) ToArchivedEvent() ArchivedEvent {
+	var deletedAt *time.Time
+	if d.DeletedAt.Valid {
+		deletedAt = &d.DeletedAt.Time
+	}
+
+	return ArchivedEvent{
+		CreatedAt:       d.CreatedAt,
+		UpdatedAt:       d.UpdatedAt,
+		DeletedAt:       deletedAt,
+		EventID:         d.EventID,
+		TenantID:        d.TenantID,
+		StreamID:        d.StreamID,
+		Sequence:        d.Sequence,
+		Position:        d.Position,
+		CorrelationID:   d.CorrelationID,
+		CausationID:     d.CausationID,
+		IdempotencyKey:  d.IdempotencyKey,
+		Timestamp:       d.Timestamp,
+		SourceName:      d.SourceName,
+		SourceID:        d.SourceID,
+		TypeName:        d.TypeName,
+		SchemaVersion:   d.SchemaVersion,
+		Data:            jsonbToString(d.Data),
+		KeyID:           d.KeyID,
+		Metadata:        jsonbToString(d.Metadata),
+		IsHandled:       d.IsHandled,
+		IsRejected:      d.IsRejected,
+		RejectionReason: d.RejectionReason,
+		HandledByName:   d.HandledByName,
+		HandledByID:     d.HandledByID,
+		DataHash:        d.DataHash,
+		PreviousHash:    d.PreviousHash,
+		Hash:            d.Hash,
+	}
+}
+
+func (a *ArchivedEvent) ToDatabaseEvent() (*DatabaseEvent, error) {
+	data, err := jsonbFromString(a.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := jsonbFromString(a.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	deletedAt := gorm.DeletedAt{}
+	if a.DeletedAt != nil {
+		deletedAt = gorm.DeletedAt{Time: *a.DeletedAt, Valid: true}
+	}
+
+	return &DatabaseEvent{
+		CreatedAt:       a.CreatedAt,
+		UpdatedAt:       a.UpdatedAt,
+		DeletedAt:       deletedAt,
+		EventID:         a.EventID,
+		TenantID:        a.TenantID,
+		StreamID:        a.StreamID,
+		Sequence:        a.Sequence,
+		Position:        a.Position,
+		CorrelationID:   a.CorrelationID,
+		CausationID:     a.CausationID,
+		IdempotencyKey:  a.IdempotencyKey,
+		Timestamp:       a.Timestamp,
+		SourceName:      a.SourceName,
+		SourceID:        a.SourceID,
+		TypeName:        a.TypeName,
+		SchemaVersion:   a.SchemaVersion,
+		Data:            data,
+		KeyID:           a.KeyID,
+		Metadata:        metadata,
+		IsHandled:       a.IsHandled,
+		IsRejected:      a.IsRejected,
+		RejectionReason: a.RejectionReason,
+		HandledByName:   a.HandledByName,
+		HandledByID:     a.HandledByID,
+		DataHash:        a.DataHash,
+		PreviousHash:    a.PreviousHash,
+		Hash:            a.Hash,
+	}, nil
+}
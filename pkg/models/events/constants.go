@@ -1,7 +1,44 @@
 package events
 
 const (
-	tableName            = "event"
-	createUniqueIndexSQL = "CREATE UNIQUE INDEX IF NOT EXISTS event_id_created_at ON %v (event_id, created_at DESC);"
-	createdHypertableSQL = "SELECT create_hypertable('%v', 'created_at', 'event_id', 1, chunk_time_interval => INTERVAL '1 day', if_not_exists => true);"
+	tableName               = "event"
+	sequenceTableName       = "event_sequence"
+	positionTableName       = "event_position"
+	keyTableName            = "event_key"
+	watermarkTableName      = "event_watermark"
+	positionRowID           = 1
+	maxAnyVersionAttempts   = 8
+	keySize                 = 32 // i.e. AES-256
+	defaultEncryptData      = "false"
+	hashAlgorithmSHA256     = "sha256"
+	hashAlgorithmHMACSHA256 = "hmac-sha256"
+	verifyPageSize          = 1000
+	exportPageSize          = 1000
+	defaultQueryLimit       = 100
+	maxQueryLimit           = 1000
+	maxQueryScan            = 10000 // events scanned for matches per call to Query
+)
+
+const (
+	nextPositionSQL      = "UPDATE event_position SET position = position + 1 WHERE id = ? RETURNING position;"
+	lockPositionSQL      = "UPDATE event_position SET position = position WHERE id = ?;"
+	maxPositionSQL       = "SELECT COALESCE(MAX(position), 0) FROM event;"
+	backfillPositionsSQL = `UPDATE event SET position = numbered.position FROM (
+	SELECT event_id, created_at, (SELECT COALESCE(MAX(position), 0) FROM event) + ROW_NUMBER() OVER (ORDER BY created_at ASC, stream_id ASC, sequence ASC) AS position
+	FROM event
+	WHERE position IS NULL OR position = 0
+) AS numbered
+WHERE event.event_id = numbered.event_id AND event.created_at = numbered.created_at;`
+)
+
+const (
+	NoStream   int64 = 0  // expected version for a stream that has never been appended to
+	AnyVersion int64 = -1 // expected version that skips the optimistic concurrency check
+)
+
+const (
+	MetadataActingUser  = "acting_user"
+	MetadataClientIP    = "client_ip"
+	MetadataTraceParent = "traceparent"
+	MetadataTraceState  = "tracestate"
 )
@@ -1,28 +1,42 @@
 package events
 
 import (
-	"fmt"
+	"encoding/json"
 	"time"
 
-	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/jackc/pgtype"
+	"github.com/segmentio/ksuid"
 	"gorm.io/gorm"
 )
 
 type DatabaseEvent struct {
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
-	DeletedAt     gorm.DeletedAt `gorm:"index"`
-	EventID       string
-	CorrelationID string       `gorm:"index"`
-	Timestamp     time.Time    `gorm:"index"`
-	SourceName    string       `gorm:"index"`
-	SourceID      string       `gorm:"index"`
-	TypeName      string       `gorm:"index"`
-	Data          pgtype.JSONB `gorm:"type:jsonb"`
-	IsHandled     bool         `gorm:"index"`
-	HandledByName string       `gorm:"index"`
-	HandledByID   string       `gorm:"index"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	DeletedAt       gorm.DeletedAt `gorm:"index"`
+	EventID         string
+	TenantID        string    `gorm:"index;not null;default:''"`
+	StreamID        string    `gorm:"index:event_stream_id_sequence"`
+	Sequence        int64     `gorm:"index:event_stream_id_sequence"`
+	Position        int64     `gorm:"index"` // global (across streams) and only ever increasing
+	CorrelationID   string    `gorm:"index"`
+	CausationID     string    `gorm:"index"`
+	IdempotencyKey  string    `gorm:"index"`
+	Timestamp       time.Time `gorm:"index"`
+	SourceName      string    `gorm:"index"`
+	SourceID        string    `gorm:"index"`
+	TypeName        string    `gorm:"index"`
+	SchemaVersion   int64
+	Data            pgtype.JSONB `gorm:"type:jsonb"`
+	KeyID           string       // the data key the data is sealed with (see DatabaseEventKey); empty if it isn't
+	Metadata        pgtype.JSONB `gorm:"type:jsonb"`
+	IsHandled       bool         `gorm:"index"`
+	IsRejected      bool         `gorm:"index"`
+	RejectionReason string
+	HandledByName   string `gorm:"index"`
+	HandledByID     string `gorm:"index"`
+	DataHash        string // of the data as stored
+	PreviousHash    string // of the event before this one in the stream
+	Hash            string // of the event (see hashEvent); empty for events recorded before there were hashes
 }
 
 func (d *DatabaseEvent) TableName() string {
@@ -35,8 +49,10 @@ func (d *DatabaseEvent) Create(givenDB *gorm.DB) (*gorm.DB, error) {
 	return returnedDB, returnedDB.Error
 }
 
+// Update records how the event was handled; the data is never updated (once appended it may be encrypted at rest, while
+// the in-memory event keeps the plaintext)
 func (d *DatabaseEvent) Update(givenDB *gorm.DB) (*gorm.DB, error) {
-	returnedDB := givenDB.Model(DatabaseEvent{}).Where("event_id = ? AND created_at = ?", d.EventID, d.CreatedAt).Updates(d)
+	returnedDB := givenDB.Model(DatabaseEvent{}).Where("event_id = ? AND created_at = ?", d.EventID, d.CreatedAt).Omit("data", "key_id").Updates(d)
 
 	return returnedDB, returnedDB.Error
 }
@@ -47,26 +63,57 @@ func (d *DatabaseEvent) Delete(givenDB *gorm.DB) (*gorm.DB, error) {
 	return returnedDB, returnedDB.Error
 }
 
-func Migrate(db *gorm.DB) error {
+func parseKSUID(id string) (ksuid.KSUID, error) {
+	if id == "" {
+		return ksuid.Nil, nil
+	}
+
+	return ksuid.Parse(id)
+}
+
+// ToEvent returns the event in its wire format (i.e. without anything about how it was stored or handled)
+func (d *DatabaseEvent) ToEvent() (*Event, error) {
 	var err error
 
-	err = db.AutoMigrate(&DatabaseEvent{})
+	e := Event{
+		TenantID:       d.TenantID,
+		Position:       d.Position,
+		IdempotencyKey: d.IdempotencyKey,
+		Timestamp:      d.Timestamp,
+		SourceName:     d.SourceName,
+		TypeName:       d.TypeName,
+		SchemaVersion:  d.SchemaVersion,
+		Data:           d.Data.Bytes,
+	}
+
+	e.EventID, err = parseKSUID(d.EventID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	db.Exec(fmt.Sprintf(createUniqueIndexSQL, tableName))
+	e.CorrelationID, err = parseKSUID(d.CorrelationID)
+	if err != nil {
+		return nil, err
+	}
 
-	useSQLite, err := helpers.GetEnvironmentVariable("USE_SQLITE", false, "0")
+	e.CausationID, err = parseKSUID(d.CausationID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if useSQLite != "1" {
-		db.Exec(fmt.Sprintf(createdHypertableSQL, tableName))
+	e.SourceID, err = parseKSUID(d.SourceID)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	if d.Metadata.Status == pgtype.Present {
+		err = json.Unmarshal(d.Metadata.Bytes, &e.Metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &e, nil
 }
 
 func GetAll(db *gorm.DB) ([]*DatabaseEvent, error) {
@@ -76,3 +123,12 @@ func GetAll(db *gorm.DB) ([]*DatabaseEvent, error) {
 
 	return rows, returnedDB.Error
 }
+
+// GetRejected returns the commands on the given stream that were recorded but rejected by the handler, in sequence order
+func GetRejected(db *gorm.DB, streamID string) ([]*DatabaseEvent, error) {
+	rows := make([]*DatabaseEvent, 0)
+
+	returnedDB := db.Where("stream_id = ? AND is_rejected = ?", streamID, true).Order("sequence ASC").Find(&rows)
+
+	return rows, returnedDB.Error
+}
@@ -0,0 +1,197 @@
+package events
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/segmentio/ksuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DatabaseEventKey is the data key that the data of a stream's events is encrypted with (if it's encrypted at all);
+// it lives outside of the event hypertable (and so outside of retention and archival) so that deleting it is all it
+// takes to render every copy of those events' data unreadable
+type DatabaseEventKey struct {
+	CreatedAt time.Time
+	KeyID     string `gorm:"primaryKey"`
+	StreamID  string `gorm:"uniqueIndex"` // a shredded stream that's appended to again gets a new key
+	Key       []byte
+}
+
+func (d *DatabaseEventKey) TableName() string {
+	return keyTableName
+}
+
+func getKey(db *gorm.DB, query string, args ...interface{}) (*DatabaseEventKey, error) {
+	rows := make([]*DatabaseEventKey, 0)
+
+	returnedDB := db.Where(query, args...).Limit(1).Find(&rows)
+	if returnedDB.Error != nil {
+		return nil, returnedDB.Error
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return rows[0], nil
+}
+
+// getOrCreateKey returns the stream's data key, creating it if this is the first encrypted event on the stream
+func getOrCreateKey(db *gorm.DB, streamID string) (*DatabaseEventKey, error) {
+	key := make([]byte, keySize)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// whoever got there first (including us) wins
+	err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&DatabaseEventKey{KeyID: ksuid.New().String(), StreamID: streamID, Key: key}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := getKey(db, "stream_id = ?", streamID)
+	if err != nil {
+		return nil, err
+	}
+
+	if row == nil {
+		return nil, fmt.Errorf("stream=%#+v has no data key after creating one", streamID)
+	}
+
+	return row, nil
+}
+
+// Shred deletes the stream's data key, rendering the data of its encrypted events (including any archived or
+// backed-up copies of them) permanently unreadable; it returns false if the stream had no key
+func Shred(db *gorm.DB, streamID string) (bool, error) {
+	returnedDB := db.Where("stream_id = ?", streamID).Delete(&DatabaseEventKey{})
+
+	return returnedDB.RowsAffected > 0, returnedDB.Error
+}
+
+func getAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptData seals the data (bound to the event it belongs to) and wraps it as a JSON string so that it can still
+// live in a jsonb column
+func encryptData(key []byte, eventID string, data pgtype.JSONB) (pgtype.JSONB, error) {
+	aead, err := getAEAD(key)
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	sealed := aead.Seal(nonce, nonce, data.Bytes, []byte(eventID))
+
+	encrypted, err := json.Marshal(base64.StdEncoding.EncodeToString(sealed))
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	return pgtype.JSONB{Bytes: encrypted, Status: pgtype.Present}, nil
+}
+
+func decryptData(key []byte, eventID string, data pgtype.JSONB) (pgtype.JSONB, error) {
+	var encoded string
+
+	err := json.Unmarshal(data.Bytes, &encoded)
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	aead, err := getAEAD(key)
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return pgtype.JSONB{}, errors.New("encrypted data is too short")
+	}
+
+	decrypted, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(eventID))
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+
+	return pgtype.JSONB{Bytes: decrypted, Status: pgtype.Present}, nil
+}
+
+// Decrypter decrypts the data of events read back from the store, caching data keys by stream; it's meant to live
+// for as long as a single read (e.g. a replay or an export) so that it doesn't outlive a shredding for long
+type Decrypter struct {
+	db   *gorm.DB
+	keys map[string][]byte // by key ID; nil for a shredded key
+}
+
+func NewDecrypter(db *gorm.DB) *Decrypter {
+	d := Decrypter{
+		db:   db,
+		keys: make(map[string][]byte),
+	}
+
+	return &d
+}
+
+// Decrypt replaces the event's data with the decrypted data (if it was encrypted); it returns ErrShredded if the
+// stream's data key has been deleted
+func (d *Decrypter) Decrypt(databaseEvent *DatabaseEvent) error {
+	if databaseEvent.KeyID == "" {
+		return nil
+	}
+
+	key, ok := d.keys[databaseEvent.KeyID]
+	if !ok {
+		row, err := getKey(d.db, "key_id = ?", databaseEvent.KeyID)
+		if err != nil {
+			return err
+		}
+
+		if row != nil {
+			key = row.Key
+		}
+
+		d.keys[databaseEvent.KeyID] = key
+	}
+
+	if key == nil {
+		return fmt.Errorf("%w; stream=%#+v event_id=%v", ErrShredded, databaseEvent.StreamID, databaseEvent.EventID)
+	}
+
+	data, err := decryptData(key, databaseEvent.EventID, databaseEvent.Data)
+	if err != nil {
+		return fmt.Errorf("stream=%#+v event_id=%v: failed to decrypt: %v", databaseEvent.StreamID, databaseEvent.EventID, err)
+	}
+
+	databaseEvent.Data = data
+	databaseEvent.KeyID = ""
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package events_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"gorm.io/gorm"
+)
+
+func getStored(t *testing.T, db *gorm.DB, streamID string) []*events.DatabaseEvent {
+	t.Helper()
+
+	databaseEvents := make([]*events.DatabaseEvent, 0)
+
+	err := db.Where("stream_id = ?", streamID).Order("sequence ASC").Find(&databaseEvents).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return databaseEvents
+}
+
+func TestShred(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStoreWithOverrides(db, true, nil)
+
+	for _, streamID := range []string{"thing.1", "thing.2"} {
+		_, err := store.Append(streamID, events.AnyVersion, newDatabaseEvent(t, `{"secret": "hunter2"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, databaseEvent := range getStored(t, db, "thing.1") {
+		if databaseEvent.KeyID == "" || strings.Contains(string(databaseEvent.Data.Bytes), "hunter2") {
+			t.Fatalf("expected the data to be encrypted at rest, got %s", databaseEvent.Data.Bytes)
+		}
+
+		err := events.NewDecrypter(db).Decrypt(databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(databaseEvent.Data.Bytes), "hunter2") {
+			t.Errorf("expected the decrypted data, got %s", databaseEvent.Data.Bytes)
+		}
+	}
+
+	shredded, err := events.Shred(db, "thing.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !shredded {
+		t.Errorf("expected the stream to have had a key to shred")
+	}
+
+	for _, databaseEvent := range getStored(t, db, "thing.1") {
+		err = events.NewDecrypter(db).Decrypt(databaseEvent)
+		if !errors.Is(err, events.ErrShredded) {
+			t.Errorf("expected the data to have been shredded, got %v", err)
+		}
+	}
+
+	// other streams have keys of their own
+	for _, databaseEvent := range getStored(t, db, "thing.2") {
+		err = events.NewDecrypter(db).Decrypt(databaseEvent)
+		if err != nil {
+			t.Errorf("expected another stream's data to be unaffected, got %v", err)
+		}
+	}
+
+	shredded, err = events.Shred(db, "thing.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shredded {
+		t.Errorf("expected nothing left to shred")
+	}
+
+	// appending afterwards gets a new key
+	_, err = store.Append("thing.1", events.AnyVersion, newDatabaseEvent(t, `{"secret": "hunter3"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	databaseEvents := getStored(t, db, "thing.1")
+
+	err = events.NewDecrypter(db).Decrypt(databaseEvents[len(databaseEvents)-1])
+	if err != nil {
+		t.Errorf("expected an event appended after shredding to be readable, got %v", err)
+	}
+
+	// shredding doesn't break the hash chain (it covers the data as stored)
+	verification, err := events.Verify(db, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verification.Break != nil {
+		t.Errorf("expected no break after shredding, got %v", verification.Break)
+	}
+}
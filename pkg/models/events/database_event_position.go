@@ -0,0 +1,90 @@
+package events
+
+import (
+	"errors"
+
+	"github.com/segmentio/ksuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DatabaseEventPosition is the single row that hands out global positions; taking the next position locks it until
+// the appending transaction finishes, so positions become visible in the order they were handed out (at the cost of
+// serialising appends across streams)
+type DatabaseEventPosition struct {
+	ID       int64  `gorm:"primaryKey;autoIncrement:false"`
+	StoreID  string // identifies this event store (and so this sequence of positions) to consumers
+	Position int64
+}
+
+func (d *DatabaseEventPosition) TableName() string {
+	return positionTableName
+}
+
+func nextPosition(db *gorm.DB) (int64, error) {
+	var position int64
+
+	returnedDB := db.Raw(nextPositionSQL, positionRowID).Scan(&position)
+	if returnedDB.Error != nil {
+		return 0, returnedDB.Error
+	}
+
+	if returnedDB.RowsAffected == 0 {
+		return 0, errors.New("no event position row; has the event store been migrated?")
+	}
+
+	return position, nil
+}
+
+func getPositionRow(db *gorm.DB) (*DatabaseEventPosition, error) {
+	row := DatabaseEventPosition{}
+
+	returnedDB := db.Where("id = ?", positionRowID).Take(&row)
+	if returnedDB.Error != nil {
+		return nil, returnedDB.Error
+	}
+
+	return &row, nil
+}
+
+// BackfillPositions creates the position row (with a new store ID) if there isn't one and gives any events without a
+// position (e.g. from before there were positions, or imported from archives of them) a position, in the order they
+// were created
+func BackfillPositions(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&DatabaseEventPosition{ID: positionRowID, StoreID: ksuid.New().String()}).Error
+		if err != nil {
+			return err
+		}
+
+		// this takes the lock so that nothing can append while we're backfilling
+		err = tx.Exec(lockPositionSQL, positionRowID).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(backfillPositionsSQL).Error
+		if err != nil {
+			return err
+		}
+
+		row, err := getPositionRow(tx)
+		if err != nil {
+			return err
+		}
+
+		var maxPosition int64
+
+		err = tx.Raw(maxPositionSQL).Scan(&maxPosition).Error
+		if err != nil {
+			return err
+		}
+
+		// positions are never handed out twice, even if the events that had them have since been dropped
+		if maxPosition <= row.Position {
+			return nil
+		}
+
+		return tx.Model(&DatabaseEventPosition{}).Where("id = ?", positionRowID).Update("position", maxPosition).Error
+	})
+}
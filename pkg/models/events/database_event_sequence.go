@@ -0,0 +1,95 @@
+package events
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DatabaseEventSequence lives outside of the event hypertable so that (stream_id, sequence) can be
+// enforced as unique on TimescaleDB (which only permits unique indexes that include the partition column)
+type DatabaseEventSequence struct {
+	CreatedAt      time.Time
+	StreamID       string `gorm:"primaryKey;uniqueIndex:event_sequence_stream_id_event_id;index:event_sequence_stream_id_idempotency_key,unique,where:idempotency_key <> ''"`
+	Sequence       int64  `gorm:"primaryKey;autoIncrement:false"`
+	EventID        string `gorm:"uniqueIndex:event_sequence_stream_id_event_id"`
+	IdempotencyKey string `gorm:"index:event_sequence_stream_id_idempotency_key,unique,where:idempotency_key <> ''"`
+	Hash           string // of the event at this sequence; outlives the event itself, so the chain survives retention
+}
+
+func (d *DatabaseEventSequence) TableName() string {
+	return sequenceTableName
+}
+
+func (d *DatabaseEventSequence) Create(givenDB *gorm.DB) (*gorm.DB, error) {
+	returnedDB := givenDB.Create(d)
+
+	return returnedDB, returnedDB.Error
+}
+
+func getVersion(db *gorm.DB, streamID string) (int64, error) {
+	var version int64
+
+	returnedDB := db.Model(&DatabaseEventSequence{}).Select("COALESCE(MAX(sequence), 0)").Where("stream_id = ?", streamID).Scan(&version)
+
+	return version, returnedDB.Error
+}
+
+// getVersionAt returns the version the stream was at as of the given time (per when events were appended to it, rather
+// than the timestamps the events were created with)
+func getVersionAt(db *gorm.DB, streamID string, timestamp time.Time) (int64, error) {
+	var version int64
+
+	// gorm stamps created_at in local time and SQLite compares times as text, so we have to ask in local time too
+	returnedDB := db.Model(&DatabaseEventSequence{}).Select("COALESCE(MAX(sequence), 0)").Where("stream_id = ? AND created_at <= ?", streamID, timestamp.Local()).Scan(&version)
+
+	return version, returnedDB.Error
+}
+
+// getHash returns the hash of the event at the given sequence ("" for the start of a stream or an unhashed event)
+func getHash(db *gorm.DB, streamID string, sequence int64) (string, error) {
+	rows := make([]*DatabaseEventSequence, 0)
+
+	returnedDB := db.Where("stream_id = ? AND sequence = ?", streamID, sequence).Limit(1).Find(&rows)
+	if returnedDB.Error != nil {
+		return "", returnedDB.Error
+	}
+
+	if len(rows) == 0 {
+		return "", nil
+	}
+
+	return rows[0].Hash, nil
+}
+
+func findDuplicate(db *gorm.DB, streamID string, databaseEvents []*DatabaseEvent) (*DatabaseEventSequence, error) {
+	eventIDs := make([]string, 0, len(databaseEvents))
+	idempotencyKeys := make([]string, 0, len(databaseEvents))
+
+	for _, databaseEvent := range databaseEvents {
+		eventIDs = append(eventIDs, databaseEvent.EventID)
+
+		if databaseEvent.IdempotencyKey != "" {
+			idempotencyKeys = append(idempotencyKeys, databaseEvent.IdempotencyKey)
+		}
+	}
+
+	query := db.Where("stream_id = ? AND event_id IN ?", streamID, eventIDs)
+
+	if len(idempotencyKeys) > 0 {
+		query = db.Where("stream_id = ? AND (event_id IN ? OR idempotency_key IN ?)", streamID, eventIDs, idempotencyKeys)
+	}
+
+	rows := make([]*DatabaseEventSequence, 0)
+
+	returnedDB := query.Limit(1).Find(&rows)
+	if returnedDB.Error != nil {
+		return nil, returnedDB.Error
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return rows[0], nil
+}
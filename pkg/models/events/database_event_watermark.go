@@ -0,0 +1,65 @@
+package events
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DatabaseEventWatermark is the sequence through which a stream's events have been dropped by retention; verification
+// only excuses events missing from the start of a stream if a watermark covers them (see Verify)
+type DatabaseEventWatermark struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	StreamID  string `gorm:"primaryKey"`
+	Sequence  int64
+}
+
+func (d *DatabaseEventWatermark) TableName() string {
+	return watermarkTableName
+}
+
+// getWatermark returns the sequence through which the stream's events have been dropped (0 if none have been)
+func getWatermark(db *gorm.DB, streamID string) (int64, error) {
+	var sequence int64
+
+	returnedDB := db.Model(&DatabaseEventWatermark{}).Select("COALESCE(MAX(sequence), 0)").Where("stream_id = ?", streamID).Scan(&sequence)
+
+	return sequence, returnedDB.Error
+}
+
+// RecordWatermarks raises the watermark of every stream with events created in the given window to the last of them;
+// retention calls it (in the same transaction) before it drops that window
+func RecordWatermarks(tx *gorm.DB, start time.Time, end time.Time) error {
+	var windowWatermarks []*DatabaseEventWatermark
+
+	returnedDB := tx.Unscoped().Model(&DatabaseEvent{}).
+		Select("stream_id, MAX(sequence) AS sequence").
+		Where("created_at >= ? AND created_at < ?", start, end).
+		Group("stream_id").
+		Scan(&windowWatermarks)
+	if returnedDB.Error != nil {
+		return returnedDB.Error
+	}
+
+	for _, windowWatermark := range windowWatermarks {
+		watermarks := make([]*DatabaseEventWatermark, 0)
+
+		returnedDB = tx.Where("stream_id = ?", windowWatermark.StreamID).Limit(1).Find(&watermarks)
+		if returnedDB.Error != nil {
+			return returnedDB.Error
+		}
+
+		if len(watermarks) == 0 {
+			returnedDB = tx.Create(windowWatermark)
+		} else if windowWatermark.Sequence > watermarks[0].Sequence {
+			returnedDB = tx.Model(watermarks[0]).Update("sequence", windowWatermark.Sequence)
+		}
+
+		if returnedDB.Error != nil {
+			return returnedDB.Error
+		}
+	}
+
+	return nil
+}
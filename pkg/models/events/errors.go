@@ -0,0 +1,9 @@
+package events
+
+import "errors"
+
+var (
+	ErrVersionConflict = errors.New("version conflict")
+	ErrDuplicateEvent  = errors.New("duplicate event")
+	ErrShredded        = errors.New("event data has been shredded")
+)
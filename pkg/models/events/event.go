@@ -6,18 +6,27 @@ import (
 	"time"
 
 	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/codecs"
 	"github.com/jackc/pgtype"
 	"github.com/segmentio/ksuid"
 )
 
+// Event is the wire format of everything that goes over NATS; its data is always JSON (whatever codec the rest of it is
+// encoded with)
 type Event struct {
-	EventID       ksuid.KSUID     `json:"event_id"`
-	CorrelationID ksuid.KSUID     `json:"correlation_id"`
-	Timestamp     time.Time       `json:"timestamp"`
-	SourceName    string          `json:"source_name"`
-	SourceID      ksuid.KSUID     `json:"source_uuid"`
-	TypeName      string          `json:"type_name"`
-	Data          json.RawMessage `json:"data"`
+	EventID        ksuid.KSUID       `json:"event_id" msgpack:"event_id" cbor:"event_id"`
+	TenantID       string            `json:"tenant_id,omitempty" msgpack:"tenant_id,omitempty" cbor:"tenant_id,omitempty"`
+	CorrelationID  ksuid.KSUID       `json:"correlation_id" msgpack:"correlation_id" cbor:"correlation_id"`
+	CausationID    ksuid.KSUID       `json:"causation_id" msgpack:"causation_id" cbor:"causation_id"`
+	Metadata       map[string]string `json:"metadata,omitempty" msgpack:"metadata,omitempty" cbor:"metadata,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty" msgpack:"idempotency_key,omitempty" cbor:"idempotency_key,omitempty"`
+	Timestamp      time.Time         `json:"timestamp" msgpack:"timestamp" cbor:"timestamp"`
+	SourceName     string            `json:"source_name" msgpack:"source_name" cbor:"source_name"`
+	SourceID       ksuid.KSUID       `json:"source_uuid" msgpack:"source_uuid" cbor:"source_uuid"`
+	TypeName       string            `json:"type_name" msgpack:"type_name" cbor:"type_name"`
+	SchemaVersion  int64             `json:"schema_version,omitempty" msgpack:"schema_version,omitempty" cbor:"schema_version,omitempty"`
+	Position       int64             `json:"position,omitempty" msgpack:"position,omitempty" cbor:"position,omitempty"` // only known once the event has been stored
+	Data           json.RawMessage   `json:"data" msgpack:"data" cbor:"data"`
 }
 
 func ToJSON(e *Event) ([]byte, error) {
@@ -25,7 +34,7 @@ func ToJSON(e *Event) ([]byte, error) {
 }
 
 func (e *Event) String() string {
-	return fmt.Sprintf("Event{id=%s, type=%#+v, size=%vB}", e.EventID, e.TypeName, len(e.Data))
+	return fmt.Sprintf("Event{id=%s, type=%#+v, schema=%v, size=%vB}", e.EventID, e.TypeName, e.SchemaVersion, len(e.Data))
 }
 
 func FromJSON(data []byte) (*Event, error) {
@@ -36,12 +45,50 @@ func FromJSON(data []byte) (*Event, error) {
 	return &e, err
 }
 
+// Decode returns the event from its wire format in the given codec
+func Decode(codec codecs.Codec, data []byte) (*Event, error) {
+	e := Event{}
+
+	err := codec.Unmarshal(data, &e)
+	if err != nil {
+		return &e, err
+	}
+
+	// timestamps are always UTC, but not every codec says so (e.g. MessagePack decodes them as local time)
+	e.Timestamp = e.Timestamp.UTC()
+
+	return &e, nil
+}
+
 func NewWithCorrelation(correlationID ksuid.KSUID, typeName string, data json.RawMessage) *Event {
 	e := Event{EventID: ksuid.New(), CorrelationID: correlationID, TypeName: typeName, Data: data, Timestamp: helpers.GetNow()}
 
 	return &e
 }
 
+// NewCausedBy returns an event that was directly caused by the given event; it shares the correlation ID (or is
+// correlated to the given event if that's where it all started) and inherits the tenant and the metadata
+func NewCausedBy(cause *Event, typeName string, data json.RawMessage) *Event {
+	correlationID := cause.CorrelationID
+	if correlationID == ksuid.Nil {
+		correlationID = cause.EventID
+	}
+
+	e := NewWithCorrelation(correlationID, typeName, data)
+
+	e.CausationID = cause.EventID
+	e.TenantID = cause.TenantID
+
+	if cause.Metadata != nil {
+		e.Metadata = make(map[string]string, len(cause.Metadata))
+		for key, value := range cause.Metadata {
+			e.Metadata[key] = value
+		}
+	}
+
+	return e
+}
+
 func NewWithoutCorrelation(typeName string, data json.RawMessage) *Event {
 	e := Event{EventID: ksuid.New(), Timestamp: helpers.GetNow(), TypeName: typeName, Data: data}
 
@@ -53,10 +100,23 @@ func (e *Event) SetSource(name string, id ksuid.KSUID) {
 	e.SourceID = id
 }
 
+func (e *Event) SetMetadata(key string, value string) {
+	if e.Metadata == nil {
+		e.Metadata = make(map[string]string)
+	}
+
+	e.Metadata[key] = value
+}
+
 func (e *Event) ToJSON() ([]byte, error) {
 	return ToJSON(e)
 }
 
+// Encode returns the event in its wire format in the given codec
+func (e *Event) Encode(codec codecs.Codec) ([]byte, error) {
+	return codec.Marshal(e)
+}
+
 func (e *Event) FromJSON(data []byte) error {
 	event, err := FromJSON(data)
 	if err != nil {
@@ -64,17 +124,27 @@ func (e *Event) FromJSON(data []byte) error {
 	}
 
 	e.EventID = event.EventID
+	e.TenantID = event.TenantID
 	e.CorrelationID = event.CorrelationID
+	e.CausationID = event.CausationID
+	e.Metadata = event.Metadata
+	e.IdempotencyKey = event.IdempotencyKey
 	e.Timestamp = event.Timestamp
 	e.SourceName = event.SourceName
 	e.SourceID = event.SourceID
 	e.TypeName = event.TypeName
+	e.SchemaVersion = event.SchemaVersion
+	e.Position = event.Position
 	e.Data = event.Data
 
 	return nil
 }
 
 func (e *Event) ToConsumedDatabaseEvent() (*DatabaseEvent, error) {
+	return e.ToDatabaseEvent()
+}
+
+func (e *Event) ToDatabaseEvent() (*DatabaseEvent, error) {
 	jsonData, err := e.Data.MarshalJSON()
 	if err != nil {
 		return nil, err
@@ -87,21 +157,17 @@ func (e *Event) ToConsumedDatabaseEvent() (*DatabaseEvent, error) {
 		return nil, err
 	}
 
-	return &DatabaseEvent{EventID: e.EventID.String(), CorrelationID: e.CorrelationID.String(), Timestamp: e.Timestamp, SourceName: e.SourceName, SourceID: e.SourceID.String(), TypeName: e.TypeName, Data: jsonbData, IsHandled: false}, nil
-}
-
-func (e *Event) ToDatabaseEvent() (*DatabaseEvent, error) {
-	jsonData, err := e.Data.MarshalJSON()
+	jsonMetadata, err := json.Marshal(e.Metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	jsonbData := pgtype.JSONB{}
+	jsonbMetadata := pgtype.JSONB{}
 
-	err = jsonbData.Scan(jsonData)
+	err = jsonbMetadata.Scan(jsonMetadata)
 	if err != nil {
 		return nil, err
 	}
 
-	return &DatabaseEvent{EventID: e.EventID.String(), CorrelationID: e.CorrelationID.String(), Timestamp: e.Timestamp, SourceName: e.SourceName, SourceID: e.SourceID.String(), TypeName: e.TypeName, Data: jsonbData, IsHandled: false}, nil
+	return &DatabaseEvent{EventID: e.EventID.String(), TenantID: e.TenantID, CorrelationID: e.CorrelationID.String(), CausationID: e.CausationID.String(), IdempotencyKey: e.IdempotencyKey, Timestamp: e.Timestamp, SourceName: e.SourceName, SourceID: e.SourceID.String(), TypeName: e.TypeName, SchemaVersion: e.SchemaVersion, Data: jsonbData, Metadata: jsonbMetadata, IsHandled: false}, nil
 }
@@ -0,0 +1,295 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/segmentio/ksuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var _ codecs.ProtoMessage = &Event{}
+
+// field numbers per event.proto
+const (
+	protoEventID        = 1
+	protoTenantID       = 2
+	protoCorrelationID  = 3
+	protoCausationID    = 4
+	protoMetadata       = 5
+	protoIdempotencyKey = 6
+	protoTimestamp      = 7
+	protoSourceName     = 8
+	protoSourceID       = 9
+	protoTypeName       = 10
+	protoSchemaVersion  = 11
+	protoPosition       = 12
+	protoData           = 13
+
+	protoMapKey   = 1
+	protoMapValue = 2
+
+	protoTimestampSeconds = 1
+	protoTimestampNanos   = 2
+)
+
+func appendProtoBytes(b []byte, number protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+
+	return protowire.AppendBytes(b, v)
+}
+
+func appendProtoString(b []byte, number protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+
+	return protowire.AppendString(b, v)
+}
+
+func appendProtoKSUID(b []byte, number protowire.Number, v ksuid.KSUID) []byte {
+	if v == ksuid.Nil {
+		return b
+	}
+
+	return appendProtoBytes(b, number, v.Bytes())
+}
+
+func appendProtoInt64(b []byte, number protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// MarshalProto encodes the event as per event.proto (see codecs.Protobuf)
+func (e *Event) MarshalProto() ([]byte, error) {
+	b := make([]byte, 0, 128+len(e.Data))
+
+	b = appendProtoKSUID(b, protoEventID, e.EventID)
+	b = appendProtoString(b, protoTenantID, e.TenantID)
+	b = appendProtoKSUID(b, protoCorrelationID, e.CorrelationID)
+	b = appendProtoKSUID(b, protoCausationID, e.CausationID)
+
+	// sorted so that the same event always comes out the same
+	keys := make([]string, 0, len(e.Metadata))
+	for key := range e.Metadata {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, protoMapKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, key)
+		entry = protowire.AppendTag(entry, protoMapValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, e.Metadata[key])
+
+		b = protowire.AppendTag(b, protoMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	b = appendProtoString(b, protoIdempotencyKey, e.IdempotencyKey)
+
+	if !e.Timestamp.IsZero() {
+		var timestamp []byte
+		timestamp = appendProtoInt64(timestamp, protoTimestampSeconds, e.Timestamp.Unix())
+		timestamp = appendProtoInt64(timestamp, protoTimestampNanos, int64(e.Timestamp.Nanosecond()))
+
+		b = protowire.AppendTag(b, protoTimestamp, protowire.BytesType)
+		b = protowire.AppendBytes(b, timestamp)
+	}
+
+	b = appendProtoString(b, protoSourceName, e.SourceName)
+	b = appendProtoKSUID(b, protoSourceID, e.SourceID)
+	b = appendProtoString(b, protoTypeName, e.TypeName)
+	b = appendProtoInt64(b, protoSchemaVersion, e.SchemaVersion)
+	b = appendProtoInt64(b, protoPosition, e.Position)
+	b = appendProtoBytes(b, protoData, e.Data)
+
+	return b, nil
+}
+
+// consumeProtoFields calls handle with each field of the given message, skipping the field if handle returns -1
+func consumeProtoFields(b []byte, handle func(number protowire.Number, wireType protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		n = handle(number, wireType, b)
+		if n == -1 {
+			n = protowire.ConsumeFieldValue(number, wireType, b)
+		}
+
+		if n < 0 {
+			return fmt.Errorf("field %v: %v", number, protowire.ParseError(n))
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func consumeProtoKSUID(b []byte, v *ksuid.KSUID, err *error) int {
+	value, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n
+	}
+
+	*v, *err = ksuid.FromBytes(value)
+
+	return n
+}
+
+func consumeProtoString(b []byte, v *string) int {
+	value, n := protowire.ConsumeString(b)
+	if n < 0 {
+		return n
+	}
+
+	*v = value
+
+	return n
+}
+
+func consumeProtoInt64(b []byte, v *int64) int {
+	value, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return n
+	}
+
+	*v = int64(value)
+
+	return n
+}
+
+// UnmarshalProto decodes the event as per event.proto (see codecs.Protobuf); fields it doesn't know of are skipped
+func (e *Event) UnmarshalProto(data []byte) error {
+	var err error
+
+	*e = Event{}
+
+	parseErr := consumeProtoFields(data, func(number protowire.Number, wireType protowire.Type, b []byte) int {
+		if err != nil {
+			return -1
+		}
+
+		varint := number == protoSchemaVersion || number == protoPosition
+		if (varint && wireType != protowire.VarintType) || (!varint && wireType != protowire.BytesType) {
+			return -1
+		}
+
+		switch number {
+		case protoEventID:
+			return consumeProtoKSUID(b, &e.EventID, &err)
+		case protoTenantID:
+			return consumeProtoString(b, &e.TenantID)
+		case protoCorrelationID:
+			return consumeProtoKSUID(b, &e.CorrelationID, &err)
+		case protoCausationID:
+			return consumeProtoKSUID(b, &e.CausationID, &err)
+		case protoMetadata:
+			entry, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+
+			var key, value string
+
+			err = consumeProtoFields(entry, func(number protowire.Number, wireType protowire.Type, b []byte) int {
+				if wireType != protowire.BytesType {
+					return -1
+				}
+
+				switch number {
+				case protoMapKey:
+					return consumeProtoString(b, &key)
+				case protoMapValue:
+					return consumeProtoString(b, &value)
+				}
+
+				return -1
+			})
+
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]string)
+			}
+
+			e.Metadata[key] = value
+
+			return n
+		case protoIdempotencyKey:
+			return consumeProtoString(b, &e.IdempotencyKey)
+		case protoTimestamp:
+			timestamp, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+
+			var seconds, nanos int64
+
+			err = consumeProtoFields(timestamp, func(number protowire.Number, wireType protowire.Type, b []byte) int {
+				if wireType != protowire.VarintType {
+					return -1
+				}
+
+				switch number {
+				case protoTimestampSeconds:
+					return consumeProtoInt64(b, &seconds)
+				case protoTimestampNanos:
+					return consumeProtoInt64(b, &nanos)
+				}
+
+				return -1
+			})
+
+			e.Timestamp = time.Unix(seconds, nanos).UTC()
+
+			return n
+		case protoSourceName:
+			return consumeProtoString(b, &e.SourceName)
+		case protoSourceID:
+			return consumeProtoKSUID(b, &e.SourceID, &err)
+		case protoTypeName:
+			return consumeProtoString(b, &e.TypeName)
+		case protoSchemaVersion:
+			return consumeProtoInt64(b, &e.SchemaVersion)
+		case protoPosition:
+			return consumeProtoInt64(b, &e.Position)
+		case protoData:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+
+			e.Data = append(json.RawMessage{}, value...)
+
+			return n
+		}
+
+		return -1
+	})
+	if parseErr != nil {
+		return parseErr
+	}
+
+	return err
+}
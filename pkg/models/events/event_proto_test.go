@@ -0,0 +1,200 @@
+package events_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/segmentio/ksuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// getEventDescriptor returns the Event message as declared in event.proto
+func getEventDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	bytesType := descriptorpb.FieldDescriptorProto_TYPE_BYTES.Enum()
+	stringType := descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+	int64Type := descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()
+	messageType := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+
+	field := func(name string, number int32, label *descriptorpb.FieldDescriptorProto_Label, fieldType *descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: label, Type: fieldType, JsonName: proto.String(name)}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+
+		return f
+	}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("event.proto"),
+		Package:    proto.String("uneventful.events"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("event_id", 1, optional, bytesType, ""),
+					field("tenant_id", 2, optional, stringType, ""),
+					field("correlation_id", 3, optional, bytesType, ""),
+					field("causation_id", 4, optional, bytesType, ""),
+					field("metadata", 5, repeated, messageType, ".uneventful.events.Event.MetadataEntry"),
+					field("idempotency_key", 6, optional, stringType, ""),
+					field("timestamp", 7, optional, messageType, ".google.protobuf.Timestamp"),
+					field("source_name", 8, optional, stringType, ""),
+					field("source_uuid", 9, optional, bytesType, ""),
+					field("type_name", 10, optional, stringType, ""),
+					field("schema_version", 11, optional, int64Type, ""),
+					field("position", 12, optional, int64Type, ""),
+					field("data", 13, optional, bytesType, ""),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("MetadataEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("key", 1, optional, stringType, ""),
+							field("value", 2, optional, stringType, ""),
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}
+
+	// so that the timestamp.proto dependency is registered
+	_ = timestamppb.Now()
+
+	fileDescriptor, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fileDescriptor.Messages().ByName("Event")
+}
+
+func TestEventProtoMatchesSchema(t *testing.T) {
+	descriptor := getEventDescriptor(t)
+	fields := descriptor.Fields()
+
+	event := events.Event{
+		EventID:        ksuid.New(),
+		TenantID:       "acme",
+		CorrelationID:  ksuid.New(),
+		CausationID:    ksuid.New(),
+		Metadata:       map[string]string{"a": "1", "b": "2"},
+		IdempotencyKey: "some-key",
+		Timestamp:      time.Date(2024, 2, 29, 13, 14, 15, 123456789, time.UTC),
+		SourceName:     "caller_wallet",
+		SourceID:       ksuid.New(),
+		TypeName:       "wallet.2bRY5JCmNZ0FUHbN1k7N7u6wYQe.credit",
+		SchemaVersion:  2,
+		Position:       -1,
+		Data:           json.RawMessage(`{"amount":1.5}`),
+	}
+
+	// what we encode is what protobuf makes of it
+	data, err := event.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := dynamicpb.NewMessage(descriptor)
+
+	err = proto.Unmarshal(data, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(name string) protoreflect.Value {
+		return message.Get(fields.ByName(protoreflect.Name(name)))
+	}
+
+	if string(get("event_id").Bytes()) != string(event.EventID.Bytes()) {
+		t.Errorf("event_id: expected %v, got %x", event.EventID, get("event_id").Bytes())
+	}
+
+	if get("tenant_id").String() != "acme" || get("type_name").String() != event.TypeName || get("idempotency_key").String() != "some-key" {
+		t.Errorf("strings: got tenant_id=%v type_name=%v idempotency_key=%v", get("tenant_id"), get("type_name"), get("idempotency_key"))
+	}
+
+	if get("schema_version").Int() != 2 || get("position").Int() != -1 {
+		t.Errorf("ints: got schema_version=%v position=%v", get("schema_version"), get("position"))
+	}
+
+	if get("metadata").Map().Len() != 2 || get("metadata").Map().Get(protoreflect.ValueOfString("b").MapKey()).String() != "2" {
+		t.Errorf("metadata: got %v", get("metadata"))
+	}
+
+	timestamp := get("timestamp").Message()
+	seconds := timestamp.Get(timestamp.Descriptor().Fields().ByName("seconds")).Int()
+	nanos := timestamp.Get(timestamp.Descriptor().Fields().ByName("nanos")).Int()
+
+	if !time.Unix(seconds, nanos).Equal(event.Timestamp) {
+		t.Errorf("timestamp: expected %v, got %v", event.Timestamp, time.Unix(seconds, nanos).UTC())
+	}
+
+	if string(get("data").Bytes()) != string(event.Data) {
+		t.Errorf("data: expected %s, got %s", event.Data, get("data").Bytes())
+	}
+
+	// and what protobuf encodes is what we decode
+	data, err = proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := events.Event{}
+
+	err = decoded.UnmarshalProto(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.String() != event.String() || decoded.CausationID != event.CausationID || decoded.SourceID != event.SourceID ||
+		!decoded.Timestamp.Equal(event.Timestamp) || decoded.Metadata["a"] != "1" || decoded.Position != -1 {
+		t.Errorf("expected %#+v, got %#+v", event, decoded)
+	}
+}
+
+func TestEventProtoSkipsUnknownFields(t *testing.T) {
+	descriptor := getEventDescriptor(t)
+
+	message := dynamicpb.NewMessage(descriptor)
+	message.Set(descriptor.Fields().ByName("type_name"), protoreflect.ValueOfString("thing.happened"))
+
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// field 99 (from some later version of event.proto)
+	data = append(data, 0x9a, 0x06, 0x03, 'n', 'e', 'w')
+
+	decoded := events.Event{}
+
+	err = decoded.UnmarshalProto(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.TypeName != "thing.happened" {
+		t.Errorf("expected type_name=thing.happened, got %#+v", decoded)
+	}
+
+	err = decoded.UnmarshalProto([]byte{0x0a, 0x05, 'x'})
+	if err == nil {
+		t.Errorf("expected an error for a truncated message")
+	}
+}
@@ -0,0 +1,255 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type EventStore interface {
+	GetVersion(streamID string) (int64, error)
+	GetVersionAt(streamID string, timestamp time.Time) (int64, error)
+	Append(streamID string, expectedVersion int64, databaseEvents ...*DatabaseEvent) (int64, error)
+	GetOriginal(streamID string, databaseEvent *DatabaseEvent) (*DatabaseEvent, error)
+	GetStoreID() (string, error)
+	GetPosition() (int64, error)
+	Update(databaseEvent *DatabaseEvent) error
+}
+
+type EventStoreImplementation struct {
+	db          *gorm.DB
+	encryptData bool
+	hashKey     []byte
+}
+
+// NewEventStoreWithOverrides returns an event store that (if encryptData is set) encrypts the data of the events it
+// appends with a data key per stream and (if there's a hashKey) HMAC-signs the hash chain over each stream
+func NewEventStoreWithOverrides(db *gorm.DB, encryptData bool, hashKey []byte) *EventStoreImplementation {
+	s := EventStoreImplementation{
+		db:          db,
+		encryptData: encryptData,
+		hashKey:     hashKey,
+	}
+
+	return &s
+}
+
+func NewEventStore(db *gorm.DB) *EventStoreImplementation {
+	return NewEventStoreWithOverrides(db, false, nil)
+}
+
+func (s *EventStoreImplementation) GetVersion(streamID string) (int64, error) {
+	return getVersion(s.db, streamID)
+}
+
+// GetVersionAt returns the version the stream was at as of the given time (NoStream if it had yet to be appended to)
+func (s *EventStoreImplementation) GetVersionAt(streamID string, timestamp time.Time) (int64, error) {
+	return getVersionAt(s.db, streamID, timestamp)
+}
+
+func (s *EventStoreImplementation) append(streamID string, expectedVersion int64, databaseEvents []*DatabaseEvent) (int64, error) {
+	var version int64
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+
+		duplicate, err := findDuplicate(tx, streamID, databaseEvents)
+		if err != nil {
+			return err
+		}
+
+		if duplicate != nil {
+			return fmt.Errorf("%w; stream=%#+v already has event_id=%v at sequence=%v", ErrDuplicateEvent, duplicate.StreamID, duplicate.EventID, duplicate.Sequence)
+		}
+
+		version, err = getVersion(tx, streamID)
+		if err != nil {
+			return err
+		}
+
+		var key *DatabaseEventKey
+
+		if s.encryptData {
+			key, err = getOrCreateKey(tx, streamID)
+			if err != nil {
+				return err
+			}
+		}
+
+		if expectedVersion != AnyVersion && version != expectedVersion {
+			return fmt.Errorf("%w; stream=%#+v expected version=%v but found version=%v", ErrVersionConflict, streamID, expectedVersion, version)
+		}
+
+		previousHash, err := getHash(tx, streamID, version)
+		if err != nil {
+			return err
+		}
+
+		for _, databaseEvent := range databaseEvents {
+			version++
+
+			databaseEvent.StreamID = streamID
+			databaseEvent.Sequence = version
+
+			// only the stored row is encrypted; the caller keeps the plaintext to handle / publish
+			row := *databaseEvent
+
+			if key != nil {
+				row.Data, err = encryptData(key.Key, row.EventID, row.Data)
+				if err != nil {
+					return err
+				}
+
+				row.KeyID = key.KeyID
+			}
+
+			row.DataHash, err = hashData(row.KeyID, row.Data)
+			if err != nil {
+				return err
+			}
+
+			row.PreviousHash = previousHash
+
+			row.Hash, err = hashEvent(s.hashKey, &row)
+			if err != nil {
+				return err
+			}
+
+			databaseEventSequence := DatabaseEventSequence{StreamID: streamID, Sequence: version, EventID: databaseEvent.EventID, IdempotencyKey: databaseEvent.IdempotencyKey, Hash: row.Hash}
+
+			// the unique indexes are what actually protect us from a concurrent append (either of the next
+			// sequence or of the same event); a retry will tell the two apart via findDuplicate
+			_, err = databaseEventSequence.Create(tx)
+			if err != nil {
+				if errors.Is(err, gorm.ErrDuplicatedKey) {
+					return fmt.Errorf("%w; stream=%#+v sequence=%v or event_id=%v was appended concurrently", ErrVersionConflict, streamID, version, databaseEvent.EventID)
+				}
+
+				return err
+			}
+
+			row.Position, err = nextPosition(tx)
+			if err != nil {
+				return err
+			}
+
+			_, err = row.Create(tx)
+			if err != nil {
+				return err
+			}
+
+			databaseEvent.CreatedAt = row.CreatedAt
+			databaseEvent.UpdatedAt = row.UpdatedAt
+			databaseEvent.Position = row.Position
+			databaseEvent.DataHash = row.DataHash
+			databaseEvent.PreviousHash = row.PreviousHash
+			databaseEvent.Hash = row.Hash
+
+			previousHash = row.Hash
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (s *EventStoreImplementation) Append(streamID string, expectedVersion int64, databaseEvents ...*DatabaseEvent) (int64, error) {
+	var version int64
+	var err error
+
+	for attempt := 0; attempt < maxAnyVersionAttempts; attempt++ {
+		version, err = s.append(streamID, expectedVersion, databaseEvents)
+		if err == nil {
+			return version, nil
+		}
+
+		if expectedVersion != AnyVersion || !errors.Is(err, ErrVersionConflict) {
+			break
+		}
+	}
+
+	// the failed attempt may have assigned a stream / sequence / position / hashes that never made it to the database
+	for _, databaseEvent := range databaseEvents {
+		databaseEvent.StreamID = ""
+		databaseEvent.Sequence = 0
+		databaseEvent.Position = 0
+		databaseEvent.DataHash = ""
+		databaseEvent.PreviousHash = ""
+		databaseEvent.Hash = ""
+	}
+
+	return 0, err
+}
+
+// GetOriginal returns the previously appended event (including rejected ones) that the given event duplicates by
+// event ID or idempotency key, or nil if it's not a duplicate
+func (s *EventStoreImplementation) GetOriginal(streamID string, databaseEvent *DatabaseEvent) (*DatabaseEvent, error) {
+	duplicate, err := findDuplicate(s.db, streamID, []*DatabaseEvent{databaseEvent})
+	if err != nil {
+		return nil, err
+	}
+
+	if duplicate == nil {
+		return nil, nil
+	}
+
+	rows := make([]*DatabaseEvent, 0)
+
+	returnedDB := s.db.Unscoped().Where("stream_id = ? AND event_id = ?", duplicate.StreamID, duplicate.EventID).Limit(1).Find(&rows)
+	if returnedDB.Error != nil {
+		return nil, returnedDB.Error
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("event_id=%v has a sequence but no event", duplicate.EventID)
+	}
+
+	return rows[0], nil
+}
+
+// GetStoreID returns the ID of this event store; positions are only comparable between events from the same store
+func (s *EventStoreImplementation) GetStoreID() (string, error) {
+	row, err := getPositionRow(s.db)
+	if err != nil {
+		return "", err
+	}
+
+	return row.StoreID, nil
+}
+
+// GetPosition returns the last position handed out by an append that has committed
+func (s *EventStoreImplementation) GetPosition() (int64, error) {
+	row, err := getPositionRow(s.db)
+	if err != nil {
+		return 0, err
+	}
+
+	return row.Position, nil
+}
+
+// Update records the outcome of handling an appended event (which its hash covers, so it's re-hashed); the event must
+// still be the last one in its stream
+func (s *EventStoreImplementation) Update(databaseEvent *DatabaseEvent) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+
+		databaseEvent.Hash, err = hashEvent(s.hashKey, databaseEvent)
+		if err != nil {
+			return err
+		}
+
+		_, err = databaseEvent.Update(tx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&DatabaseEventSequence{}).Where("stream_id = ? AND sequence = ?", databaseEvent.StreamID, databaseEvent.Sequence).Update("hash", databaseEvent.Hash).Error
+	})
+}
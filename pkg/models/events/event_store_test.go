@@ -0,0 +1,194 @@
+package events_test
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+)
+
+func newDatabaseEvent(t *testing.T, data string) *events.DatabaseEvent {
+	t.Helper()
+
+	databaseEvent, err := events.NewWithoutCorrelation("thing.happened", json.RawMessage(data)).ToDatabaseEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return databaseEvent
+}
+
+func TestAppendOptimisticConcurrency(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	version, err := store.Append("thing.1", events.NoStream, newDatabaseEvent(t, `{"n": 1}`), newDatabaseEvent(t, `{"n": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 2 {
+		t.Errorf("expected version=2, got %v", version)
+	}
+
+	cases := []struct {
+		name            string
+		expectedVersion int64
+		err             error
+		version         int64
+	}{
+		{name: "stale", expectedVersion: 1, err: events.ErrVersionConflict},
+		{name: "no stream", expectedVersion: events.NoStream, err: events.ErrVersionConflict},
+		{name: "ahead", expectedVersion: 3, err: events.ErrVersionConflict},
+		{name: "current", expectedVersion: 2, version: 3},
+		{name: "any", expectedVersion: events.AnyVersion, version: 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			databaseEvent := newDatabaseEvent(t, `{"n": 3}`)
+
+			version, err := store.Append("thing.1", c.expectedVersion, databaseEvent)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected err=%v, got %v", c.err, err)
+			}
+
+			if version != c.version {
+				t.Errorf("expected version=%v, got %v", c.version, version)
+			}
+
+			// a failed append mustn't leave the event looking like it was appended
+			if err != nil && (databaseEvent.Sequence != 0 || databaseEvent.Position != 0 || databaseEvent.Hash != "") {
+				t.Errorf("expected a failed append to leave the event as it was, got %#+v", databaseEvent)
+			}
+		})
+	}
+
+	version, err = store.GetVersion("thing.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 4 {
+		t.Errorf("expected version=4, got %v", version)
+	}
+}
+
+func TestAppendConcurrently(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	_, err := store.Append("thing.1", events.NoStream, newDatabaseEvent(t, `{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		databaseEvent := newDatabaseEvent(t, `{}`)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := store.Append("thing.1", 1, databaseEvent)
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	appended := 0
+
+	for err := range errs {
+		switch {
+		case err == nil:
+			appended++
+		case !errors.Is(err, events.ErrVersionConflict):
+			t.Errorf("expected a version conflict, got %v", err)
+		}
+	}
+
+	if appended != 1 {
+		t.Errorf("expected exactly one writer to append at version=1, got %v", appended)
+	}
+}
+
+func TestAppendDuplicates(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	original := newDatabaseEvent(t, `{}`)
+	original.IdempotencyKey = "some-key"
+
+	_, err := store.Append("thing.1", events.NoStream, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sameEventID := newDatabaseEvent(t, `{}`)
+	sameEventID.EventID = original.EventID
+
+	sameIdempotencyKey := newDatabaseEvent(t, `{}`)
+	sameIdempotencyKey.IdempotencyKey = original.IdempotencyKey
+
+	for _, databaseEvent := range []*events.DatabaseEvent{sameEventID, sameIdempotencyKey} {
+		_, err = store.Append("thing.1", events.AnyVersion, databaseEvent)
+		if !errors.Is(err, events.ErrDuplicateEvent) {
+			t.Errorf("expected a duplicate event, got %v", err)
+		}
+
+		duplicated, err := store.GetOriginal("thing.1", databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if duplicated == nil || duplicated.EventID != original.EventID {
+			t.Errorf("expected the original event, got %#+v", duplicated)
+		}
+	}
+
+	// idempotency keys are per stream
+	_, err = store.Append("thing.2", events.NoStream, sameIdempotencyKey)
+	if err != nil {
+		t.Errorf("expected the same idempotency key to be fine for another stream, got %v", err)
+	}
+}
+
+func TestAppendPositions(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	databaseEvents := []*events.DatabaseEvent{newDatabaseEvent(t, `{}`), newDatabaseEvent(t, `{}`), newDatabaseEvent(t, `{}`)}
+
+	for i, databaseEvent := range databaseEvents {
+		_, err := store.Append([]string{"thing.1", "thing.2"}[i%2], events.AnyVersion, databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if databaseEvent.Position != int64(i+1) {
+			t.Errorf("expected position=%v (across streams), got %v", i+1, databaseEvent.Position)
+		}
+	}
+
+	position, err := store.GetPosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if position != 3 {
+		t.Errorf("expected the head at position=3, got %v", position)
+	}
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+)
+
+// canonicalJSON re-encodes JSON in a form that doesn't depend on how the database stored it (jsonb doesn't keep
+// key order or whitespace)
+func canonicalJSON(data pgtype.JSONB) ([]byte, error) {
+	if data.Status != pgtype.Present || len(data.Bytes) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data.Bytes))
+	decoder.UseNumber()
+
+	var value interface{}
+
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.Buffer{}
+
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// hashData returns the hash of the data as it's stored (i.e. encrypted, if it is); it's kept alongside the event so
+// that the event's hash can be recomputed without it (e.g. from the in-memory event, which keeps the plaintext)
+func hashData(keyID string, data pgtype.JSONB) (string, error) {
+	canonicalData, err := canonicalJSON(data)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	writeField(h, []byte(keyID))
+	writeField(h, canonicalData)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeField writes a length-prefixed field so that no two different sets of fields hash the same
+func writeField(h hash.Hash, field []byte) {
+	_ = binary.Write(h, binary.BigEndian, uint64(len(field)))
+	_, _ = h.Write(field)
+}
+
+// hashEvent returns the hash of everything about an event that mustn't change once it's recorded (including the hash
+// of the event before it in the stream and the outcome of handling it), HMAC-signed if there's a key
+func hashEvent(hashKey []byte, d *DatabaseEvent) (string, error) {
+	canonicalMetadata, err := canonicalJSON(d.Metadata)
+	if err != nil {
+		return "", err
+	}
+
+	algorithm := hashAlgorithmSHA256
+	h := sha256.New()
+
+	if len(hashKey) > 0 {
+		algorithm = hashAlgorithmHMACSHA256
+		h = hmac.New(sha256.New, hashKey)
+	}
+
+	for _, field := range []string{
+		d.PreviousHash,
+		d.StreamID,
+		strconv.FormatInt(d.Sequence, 10),
+		d.EventID,
+		d.CorrelationID,
+		d.CausationID,
+		d.IdempotencyKey,
+		// databases differ in how much of a timestamp they keep
+		d.Timestamp.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		d.SourceName,
+		d.SourceID,
+		d.TypeName,
+		strconv.FormatInt(d.SchemaVersion, 10),
+		d.DataHash,
+		string(canonicalMetadata),
+		strconv.FormatBool(d.IsHandled),
+		strconv.FormatBool(d.IsRejected),
+		d.RejectionReason,
+		d.HandledByName,
+		d.HandledByID,
+	} {
+		writeField(h, []byte(field))
+	}
+
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func getHashAlgorithm(eventHash string) string {
+	algorithm, _, _ := strings.Cut(eventHash, ":")
+
+	return algorithm
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+)
+
+// GetEncryptData returns whether newly appended event data should be encrypted (per ENCRYPT_EVENT_DATA)
+func GetEncryptData() (bool, error) {
+	rawEncryptData, err := helpers.GetEnvironmentVariable("ENCRYPT_EVENT_DATA", false, defaultEncryptData)
+	if err != nil {
+		return false, err
+	}
+
+	encryptData, err := strconv.ParseBool(rawEncryptData)
+	if err != nil {
+		return false, fmt.Errorf("ENCRYPT_EVENT_DATA: %v", err)
+	}
+
+	return encryptData, nil
+}
+
+// GetStreamID derives the stream an event belongs to from its type name (e.g. "wallet.[entity ksuid].credit" belongs
+// to "wallet.[entity ksuid]")
+func GetStreamID(typeName string) string {
+	index := strings.LastIndex(typeName, ".")
+	if index < 0 {
+		return typeName
+	}
+
+	return typeName[:index]
+}
+
+// GetHashKey returns the key to HMAC-sign event hashes with (per EVENT_HMAC_KEY), or nil if they're not to be signed
+func GetHashKey() ([]byte, error) {
+	hashKey, err := helpers.GetEnvironmentVariable("EVENT_HMAC_KEY", false, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if hashKey == "" {
+		return nil, nil
+	}
+
+	return []byte(hashKey), nil
+}
+
+// MatchTypeName matches a type name against a pattern in the style of a NATS subject (i.e. "*" matches exactly one
+// segment and a trailing ">" matches one or more)
+func MatchTypeName(pattern string, typeName string) bool {
+	patternParts := strings.Split(pattern, ".")
+	typeNameParts := strings.Split(typeName, ".")
+
+	for i, patternPart := range patternParts {
+		if patternPart == ">" && i == len(patternParts)-1 {
+			return len(typeNameParts) > i
+		}
+
+		if i >= len(typeNameParts) {
+			return false
+		}
+
+		if patternPart != "*" && patternPart != typeNameParts[i] {
+			return false
+		}
+	}
+
+	return len(patternParts) == len(typeNameParts)
+}
+
+// getTypeNamePrefix returns the part of a type name pattern before its first wildcard (i.e. the part that can be
+// matched exactly)
+func getTypeNamePrefix(pattern string) string {
+	prefixParts := make([]string, 0)
+
+	for _, patternPart := range strings.Split(pattern, ".") {
+		if patternPart == "*" || patternPart == ">" {
+			break
+		}
+
+		prefixParts = append(prefixParts, patternPart)
+	}
+
+	return strings.Join(prefixParts, ".")
+}
+
+// GetStoredSubject is the NATS subject that an event is published on once it has been stored (with its position) in
+// the given event store
+func GetStoredSubject(storeID string, typeName string) string {
+	return fmt.Sprintf("stored.%v.%v", storeID, typeName)
+}
@@ -0,0 +1,206 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"gorm.io/gorm"
+)
+
+// Filter narrows down the events that Export writes (and that Query returns); zero values match everything (but a zero
+// TenantID is the default tenant)
+type Filter struct {
+	Domain          string    // e.g. "wallet"
+	EntityID        string    // requires Domain
+	TypeName        string    // a pattern for MatchTypeName (e.g. "wallet.*.credit")
+	Since           time.Time // inclusive, against the event timestamp
+	Until           time.Time // exclusive, against the event timestamp
+	IncludeRejected bool
+	TenantID        string // tenants.AnyTenantID for every tenant
+	CorrelationID   string
+	CausationID     string
+	SourceName      string
+	SourceID        string
+}
+
+func (f *Filter) apply(db *gorm.DB) (*gorm.DB, error) {
+	query := db.Model(&DatabaseEvent{})
+
+	if f.TenantID != tenants.AnyTenantID {
+		query = query.Where("tenant_id = ?", f.TenantID)
+	}
+
+	if f.EntityID != "" {
+		if f.Domain == "" {
+			return nil, fmt.Errorf("filtering by entity requires a domain")
+		}
+
+		if f.TenantID == tenants.AnyTenantID {
+			return nil, fmt.Errorf("filtering by entity requires a tenant")
+		}
+
+		query = query.Where("stream_id = ?", tenants.GetName(f.TenantID, fmt.Sprintf("%v.%v", f.Domain, f.EntityID)))
+	} else if f.Domain != "" {
+		query = query.Where("type_name LIKE ?", fmt.Sprintf("%v.%%", f.Domain))
+	}
+
+	// the pattern is matched properly as the rows are read, but everything before the first wildcard can be done here
+	if f.TypeName != "" {
+		prefix := getTypeNamePrefix(f.TypeName)
+
+		if prefix == f.TypeName {
+			query = query.Where("type_name = ?", f.TypeName)
+		} else if prefix != "" {
+			query = query.Where("type_name LIKE ?", fmt.Sprintf("%v.%%", prefix))
+		}
+	}
+
+	// the event that started a correlation may not be correlated to itself (e.g. if it was from before callers did that)
+	if f.CorrelationID != "" {
+		query = query.Where("(correlation_id = ? OR event_id = ?)", f.CorrelationID, f.CorrelationID)
+	}
+
+	if f.CausationID != "" {
+		query = query.Where("causation_id = ?", f.CausationID)
+	}
+
+	if f.SourceName != "" {
+		query = query.Where("source_name = ?", f.SourceName)
+	}
+
+	if f.SourceID != "" {
+		query = query.Where("source_id = ?", f.SourceID)
+	}
+
+	// event timestamps are in UTC and SQLite compares times as text, so we have to ask in UTC too
+	if !f.Since.IsZero() {
+		query = query.Where("timestamp >= ?", f.Since.UTC())
+	}
+
+	if !f.Until.IsZero() {
+		query = query.Where("timestamp < ?", f.Until.UTC())
+	}
+
+	if !f.IncludeRejected {
+		query = query.Where("is_rejected = ?", false)
+	}
+
+	return query, nil
+}
+
+// Export writes the events that match the filter to w as JSONL in the wire format (decrypted), stream by stream in
+// sequence order; events whose data has been shredded are left out
+//
+// It reads a page at a time and decrypts each page once it has been read, so that it never holds a connection open for
+// rows while it looks up keys on another (there's only the one connection to an in-memory database)
+func Export(db *gorm.DB, filter Filter, w io.Writer) (int64, error) {
+	encoder := json.NewEncoder(w)
+
+	decrypter := NewDecrypter(db)
+
+	count := int64(0)
+
+	afterStreamID := ""
+	afterSequence := int64(0)
+
+	for {
+		query, err := filter.apply(db)
+		if err != nil {
+			return count, err
+		}
+
+		if afterStreamID != "" {
+			query = query.Where("stream_id > ? OR (stream_id = ? AND sequence > ?)", afterStreamID, afterStreamID, afterSequence)
+		}
+
+		databaseEvents := make([]*DatabaseEvent, 0, exportPageSize)
+
+		err = query.Order("stream_id ASC").Order("sequence ASC").Limit(exportPageSize).Find(&databaseEvents).Error
+		if err != nil {
+			return count, err
+		}
+
+		for _, databaseEvent := range databaseEvents {
+			if filter.TypeName != "" && !MatchTypeName(filter.TypeName, databaseEvent.TypeName) {
+				continue
+			}
+
+			// there's nothing left of a shredded event worth exporting
+			err = decrypter.Decrypt(databaseEvent)
+			if err != nil {
+				if errors.Is(err, ErrShredded) {
+					continue
+				}
+
+				return count, err
+			}
+
+			event, err := databaseEvent.ToEvent()
+			if err != nil {
+				return count, fmt.Errorf("event_id=%v: %v", databaseEvent.EventID, err)
+			}
+
+			err = encoder.Encode(event)
+			if err != nil {
+				return count, err
+			}
+
+			count++
+		}
+
+		if len(databaseEvents) < exportPageSize {
+			return count, nil
+		}
+
+		afterStreamID = databaseEvents[len(databaseEvents)-1].StreamID
+		afterSequence = databaseEvents[len(databaseEvents)-1].Sequence
+	}
+}
+
+// Import appends the JSONL events read from r to the streams they belong to (in the order they're read), skipping
+// any that are already present (by event ID or idempotency key); if handledByName is set they're recorded as handled
+// by it (so that writers replay them), otherwise they're recorded as unhandled
+func Import(eventStore EventStore, r io.Reader, handledByName string, handledByID string) (imported int64, skipped int64, err error) {
+
+	decoder := json.NewDecoder(r)
+
+	for {
+		event := Event{}
+
+		err = decoder.Decode(&event)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return imported, skipped, nil
+			}
+
+			return imported, skipped, err
+		}
+
+		databaseEvent, err := event.ToDatabaseEvent()
+		if err != nil {
+			return imported, skipped, fmt.Errorf("event_id=%v: %v", event.EventID, err)
+		}
+
+		if handledByName != "" {
+			databaseEvent.IsHandled = true
+			databaseEvent.HandledByName = handledByName
+			databaseEvent.HandledByID = handledByID
+		}
+
+		_, err = eventStore.Append(tenants.GetName(event.TenantID, GetStreamID(event.TypeName)), AnyVersion, databaseEvent)
+		if err != nil {
+			if errors.Is(err, ErrDuplicateEvent) {
+				skipped++
+				continue
+			}
+
+			return imported, skipped, fmt.Errorf("event_id=%v: %v", event.EventID, err)
+		}
+
+		imported++
+	}
+}
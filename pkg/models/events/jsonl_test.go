@@ -0,0 +1,146 @@
+package events_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/segmentio/ksuid"
+	"gorm.io/gorm"
+)
+
+func getStoredEvents(t *testing.T, db *gorm.DB) []*events.DatabaseEvent {
+	t.Helper()
+
+	databaseEvents := make([]*events.DatabaseEvent, 0)
+
+	err := db.Order("position ASC").Find(&databaseEvents).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return databaseEvents
+}
+
+func export(t *testing.T, db *gorm.DB) []byte {
+	t.Helper()
+
+	buffer := bytes.Buffer{}
+
+	_, err := events.Export(db, events.Filter{TenantID: tenants.AnyTenantID}, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	handledByName := "writer_thing"
+	handledByID := ksuid.New().String()
+
+	happened := events.NewWithoutCorrelation("thing.1.happened", json.RawMessage(`{"n": 1}`))
+	happened.SetMetadata(events.MetadataClientIP, "127.0.0.1")
+
+	changed := events.NewCausedBy(happened, "thing.1.changed", json.RawMessage(`{"n": 2}`))
+	changed.IdempotencyKey = "change-1"
+
+	forTenant := events.NewWithoutCorrelation("thing.2.happened", json.RawMessage(`{"n": 3}`))
+	forTenant.TenantID = "acme"
+
+	// a stream at a time (in stream ID order), so that the order of the export is the order they were appended in
+	for _, event := range []*events.Event{forTenant, happened, changed} {
+		databaseEvent, err := event.ToDatabaseEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		databaseEvent.IsHandled = true
+		databaseEvent.HandledByName = handledByName
+		databaseEvent.HandledByID = handledByID
+
+		_, err = store.Append(tenants.GetName(event.TenantID, events.GetStreamID(event.TypeName)), events.AnyVersion, databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exported := export(t, db)
+
+	otherDB := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	otherStore := events.NewEventStore(otherDB)
+
+	imported, skipped, err := events.Import(otherStore, bytes.NewReader(exported), handledByName, handledByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if imported != 3 || skipped != 0 {
+		t.Fatalf("expected 3 imported and none skipped, got %v and %v", imported, skipped)
+	}
+
+	originals := getStoredEvents(t, db)
+	copies := getStoredEvents(t, otherDB)
+
+	if len(copies) != len(originals) {
+		t.Fatalf("expected %v events, got %v", len(originals), len(copies))
+	}
+
+	// recorded as handled by the same writer, each event lands where it was (so its hash is the same too)
+	for i, original := range originals {
+		c := copies[i]
+
+		if c.EventID != original.EventID || c.StreamID != original.StreamID || c.Sequence != original.Sequence || c.Position != original.Position {
+			t.Errorf("expected event_id=%v at %v/%v (position %v), got event_id=%v at %v/%v (position %v)", original.EventID, original.StreamID, original.Sequence, original.Position, c.EventID, c.StreamID, c.Sequence, c.Position)
+		}
+
+		if c.PreviousHash != original.PreviousHash || c.Hash != original.Hash {
+			t.Errorf("expected event_id=%v to hash the same, got %v (after %v) rather than %v (after %v)", original.EventID, c.Hash, c.PreviousHash, original.Hash, original.PreviousHash)
+		}
+	}
+
+	verification, err := events.Verify(otherDB, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verification.Break != nil || verification.Streams != 2 || verification.Verified != 3 {
+		t.Errorf("expected 3 verified in 2 streams, got %#+v (break %v)", verification, verification.Break)
+	}
+
+	if reexported := export(t, otherDB); !bytes.Equal(reexported, exported) {
+		t.Errorf("expected the same export from both stores, got %s and %s", reexported, exported)
+	}
+
+	// importing the same events again (into either store) changes nothing
+	for _, importDB := range []*gorm.DB{otherDB, db} {
+		imported, skipped, err = events.Import(events.NewEventStore(importDB), bytes.NewReader(exported), handledByName, handledByID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if imported != 0 || skipped != 3 {
+			t.Errorf("expected none imported and 3 skipped, got %v and %v", imported, skipped)
+		}
+	}
+
+	if stored := getStoredEvents(t, otherDB); len(stored) != 3 {
+		t.Errorf("expected 3 events, got %v", len(stored))
+	}
+
+	position, err := otherStore.GetPosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if position != 3 {
+		t.Errorf("expected position 3, got %v", position)
+	}
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"gorm.io/gorm"
+)
+
+// PositionCursor pages through every stream (of a tenant, or of every tenant) in global position order (keyset
+// pagination on position), leaving out rejected events
+type PositionCursor struct {
+	db            *gorm.DB
+	tenantID      string
+	afterPosition int64
+	untilPosition int64
+	pageSize      int
+	page          []*DatabaseEvent
+	index         int
+	exhausted     bool
+	err           error
+}
+
+func NewPositionCursor(db *gorm.DB, tenantID string, afterPosition int64, untilPosition int64, pageSize int) *PositionCursor {
+	c := PositionCursor{
+		db:            db,
+		tenantID:      tenantID,
+		afterPosition: afterPosition,
+		untilPosition: untilPosition,
+		pageSize:      pageSize,
+		index:         -1,
+	}
+
+	return &c
+}
+
+func (c *PositionCursor) fetch() error {
+	rows := make([]*DatabaseEvent, 0, c.pageSize)
+
+	query := c.db.Where("position > ? AND position <= ? AND is_rejected = ?", c.afterPosition, c.untilPosition, false)
+
+	if c.tenantID != tenants.AnyTenantID {
+		query = query.Where("tenant_id = ?", c.tenantID)
+	}
+
+	returnedDB := query.
+		Order("position ASC").
+		Limit(c.pageSize).
+		Find(&rows)
+	if returnedDB.Error != nil {
+		return returnedDB.Error
+	}
+
+	c.page = rows
+	c.index = -1
+
+	if len(rows) < c.pageSize {
+		c.exhausted = true
+	}
+
+	if len(rows) > 0 {
+		c.afterPosition = rows[len(rows)-1].Position
+	}
+
+	return nil
+}
+
+func (c *PositionCursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	c.index++
+
+	if c.index < len(c.page) {
+		return true
+	}
+
+	if c.exhausted {
+		return false
+	}
+
+	c.err = c.fetch()
+	if c.err != nil {
+		return false
+	}
+
+	c.index++
+
+	return c.index < len(c.page)
+}
+
+func (c *PositionCursor) Event() *DatabaseEvent {
+	if c.index < 0 || c.index >= len(c.page) {
+		return nil
+	}
+
+	return c.page[c.index]
+}
+
+func (c *PositionCursor) Err() error {
+	return c.err
+}
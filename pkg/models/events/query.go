@@ -0,0 +1,133 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// StoredEvent is an event as Query returns it; the wire format plus what the store knows about it
+type StoredEvent struct {
+	*Event
+	StreamID        string `json:"stream_id"`
+	Sequence        int64  `json:"sequence"`
+	IsHandled       bool   `json:"is_handled"`
+	IsRejected      bool   `json:"is_rejected"`
+	RejectionReason string `json:"rejection_reason,omitempty"`
+	HandledByName   string `json:"handled_by_name,omitempty"`
+}
+
+// Page is a page of events from Query in position order; Cursor is where the next page starts (empty if there are no
+// more events), and a page can be short (even empty) and still have one if Query gave up looking for matches
+type Page struct {
+	Events []*StoredEvent `json:"events"`
+	Cursor string         `json:"cursor,omitempty"`
+}
+
+func parseCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	position, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || position < 0 {
+		return 0, fmt.Errorf("invalid cursor=%#+v", cursor)
+	}
+
+	return position, nil
+}
+
+// Query returns a page of (at most limit, decrypted) events that match the filter, starting after the cursor (empty
+// for the first page); events whose data has been shredded are left out, and it gives up (returning what it has and
+// where it got to) after scanning maxQueryScan events, so that a rare type name can't have it scan the whole table
+func Query(db *gorm.DB, filter Filter, cursor string, limit int) (*Page, error) {
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	page := Page{Events: make([]*StoredEvent, 0)}
+
+	decrypter := NewDecrypter(db)
+
+	// events that don't match the type name are only skipped once they're here, so look through plenty at a time
+	batchSize := limit
+	if filter.TypeName != "" {
+		batchSize = maxQueryLimit
+	}
+
+	scanned := 0
+
+	for {
+		query, err := filter.apply(db)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := make([]*DatabaseEvent, 0)
+
+		err = query.Where("position > ?", after).Order("position ASC").Limit(batchSize).Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, databaseEvent := range rows {
+			after = databaseEvent.Position
+
+			if filter.TypeName != "" && !MatchTypeName(filter.TypeName, databaseEvent.TypeName) {
+				continue
+			}
+
+			err = decrypter.Decrypt(databaseEvent)
+			if err != nil {
+				if errors.Is(err, ErrShredded) {
+					continue
+				}
+
+				return nil, err
+			}
+
+			event, err := databaseEvent.ToEvent()
+			if err != nil {
+				return nil, fmt.Errorf("event_id=%v: %v", databaseEvent.EventID, err)
+			}
+
+			page.Events = append(page.Events, &StoredEvent{
+				Event:           event,
+				StreamID:        databaseEvent.StreamID,
+				Sequence:        databaseEvent.Sequence,
+				IsHandled:       databaseEvent.IsHandled,
+				IsRejected:      databaseEvent.IsRejected,
+				RejectionReason: databaseEvent.RejectionReason,
+				HandledByName:   databaseEvent.HandledByName,
+			})
+
+			if len(page.Events) == limit {
+				page.Cursor = strconv.FormatInt(after, 10)
+				return &page, nil
+			}
+		}
+
+		// anything we skipped (e.g. for not matching the type name) leaves room for more
+		if len(rows) < batchSize {
+			return &page, nil
+		}
+
+		scanned += len(rows)
+
+		if scanned >= maxQueryScan {
+			page.Cursor = strconv.FormatInt(after, 10)
+			return &page, nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package events_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/segmentio/ksuid"
+	"gorm.io/gorm"
+)
+
+// queryTestEvents is what's in the store for the query tests, by name
+type queryTestEvents map[string]*events.Event
+
+// setupQueryTest stores (in this order) a credit to one wallet (that started a correlation) and a debit it caused, a
+// rejected debit to another wallet, a thing that happened and a credit for another tenant (each an hour after the last)
+func setupQueryTest(t *testing.T) (*gorm.DB, queryTestEvents, time.Time) {
+	t.Helper()
+
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	start := time.Date(2024, 2, 29, 13, 0, 0, 0, time.UTC)
+
+	walletID := ksuid.New()
+	otherWalletID := ksuid.New()
+	sourceID := ksuid.New()
+
+	newEvent := func(tenantID string, typeName string, sourceName string) *events.Event {
+		event := events.NewWithoutCorrelation(typeName, json.RawMessage(`{}`))
+		event.TenantID = tenantID
+		event.SetSource(sourceName, sourceID)
+
+		return event
+	}
+
+	credit := newEvent(tenants.DefaultTenantID, fmt.Sprintf("wallet.%v.credit", walletID), "caller_wallet")
+
+	debit := events.NewCausedBy(credit, fmt.Sprintf("wallet.%v.debit", walletID), json.RawMessage(`{}`))
+	debit.SetSource("writer_wallet", walletID)
+
+	rejected := newEvent(tenants.DefaultTenantID, fmt.Sprintf("wallet.%v.debit", otherWalletID), "caller_wallet")
+	happened := newEvent(tenants.DefaultTenantID, "thing.1.happened", "caller_thing")
+	otherTenant := newEvent("acme", fmt.Sprintf("wallet.%v.credit", walletID), "caller_wallet")
+
+	ordered := []*events.Event{credit, debit, rejected, happened, otherTenant}
+
+	for i, event := range ordered {
+		event.Timestamp = start.Add(time.Hour * time.Duration(i))
+
+		databaseEvent, err := event.ToDatabaseEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		databaseEvent.IsRejected = event == rejected
+
+		_, err = store.Append(tenants.GetName(event.TenantID, events.GetStreamID(event.TypeName)), events.AnyVersion, databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db, queryTestEvents{"credit": credit, "debit": debit, "rejected": rejected, "happened": happened, "other_tenant": otherTenant}, start
+}
+
+func getNames(page *events.Page, stored queryTestEvents) []string {
+	names := make([]string, 0)
+
+	for _, storedEvent := range page.Events {
+		for name, event := range stored {
+			if event.EventID == storedEvent.EventID {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+func TestQuery(t *testing.T) {
+	db, stored, start := setupQueryTest(t)
+
+	walletID := events.GetStreamID(stored["credit"].TypeName)[len("wallet."):]
+
+	cases := []struct {
+		name   string
+		filter events.Filter
+		names  []string
+	}{
+		{name: "everything for the tenant", filter: events.Filter{}, names: []string{"credit", "debit", "happened"}},
+		{name: "another tenant", filter: events.Filter{TenantID: "acme"}, names: []string{"other_tenant"}},
+		{name: "every tenant", filter: events.Filter{TenantID: tenants.AnyTenantID}, names: []string{"credit", "debit", "happened", "other_tenant"}},
+		{name: "rejected too", filter: events.Filter{IncludeRejected: true}, names: []string{"credit", "debit", "rejected", "happened"}},
+		{name: "correlation (including where it started)", filter: events.Filter{CorrelationID: stored["credit"].EventID.String()}, names: []string{"credit", "debit"}},
+		{name: "causation", filter: events.Filter{CausationID: stored["credit"].EventID.String()}, names: []string{"debit"}},
+		{name: "type pattern", filter: events.Filter{TypeName: "wallet.*.debit", IncludeRejected: true}, names: []string{"debit", "rejected"}},
+		{name: "type", filter: events.Filter{TypeName: "thing.1.happened"}, names: []string{"happened"}},
+		{name: "domain", filter: events.Filter{Domain: "wallet"}, names: []string{"credit", "debit"}},
+		{name: "entity", filter: events.Filter{Domain: "wallet", EntityID: walletID}, names: []string{"credit", "debit"}},
+		{name: "source name", filter: events.Filter{SourceName: "writer_wallet"}, names: []string{"debit"}},
+		{name: "source ID", filter: events.Filter{SourceID: stored["debit"].SourceID.String()}, names: []string{"debit"}},
+		{name: "since (inclusive)", filter: events.Filter{Since: start.Add(time.Hour)}, names: []string{"debit", "happened"}},
+		{name: "until (exclusive)", filter: events.Filter{Until: start.Add(time.Hour)}, names: []string{"credit"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			page, err := events.Query(db, c.filter, "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if names := getNames(page, stored); fmt.Sprint(names) != fmt.Sprint(c.names) {
+				t.Errorf("expected %v, got %v", c.names, names)
+			}
+
+			if page.Cursor != "" {
+				t.Errorf("expected no cursor for the only page, got %#+v", page.Cursor)
+			}
+		})
+	}
+
+	_, err := events.Query(db, events.Filter{EntityID: walletID}, "", 0)
+	if err == nil {
+		t.Errorf("expected an error for an entity without a domain")
+	}
+
+	_, err = events.Query(db, events.Filter{}, "nope", 0)
+	if err == nil {
+		t.Errorf("expected an error for a bad cursor")
+	}
+}
+
+func TestQueryPages(t *testing.T) {
+	db, stored, _ := setupQueryTest(t)
+
+	filter := events.Filter{TenantID: tenants.AnyTenantID, IncludeRejected: true}
+
+	names := make([]string, 0)
+	cursor := ""
+
+	for pages := 1; ; pages++ {
+		page, err := events.Query(db, filter, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page.Events) > 2 {
+			t.Fatalf("expected at most 2 events a page, got %v", len(page.Events))
+		}
+
+		names = append(names, getNames(page, stored)...)
+
+		// the last page (of 1) has no cursor
+		if page.Cursor == "" {
+			if pages != 3 {
+				t.Errorf("expected 3 pages, got %v", pages)
+			}
+
+			break
+		}
+
+		cursor = page.Cursor
+	}
+
+	// in the order they were stored
+	expected := []string{"credit", "debit", "rejected", "happened", "other_tenant"}
+
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,99 @@
+package events
+
+import (
+	"gorm.io/gorm"
+)
+
+// StreamCursor pages through a single stream in sequence order (keyset pagination on sequence) so that
+// replaying a large stream only ever holds a page of events in memory
+type StreamCursor struct {
+	db            *gorm.DB
+	streamID      string
+	afterSequence int64
+	untilSequence int64
+	pageSize      int
+	handledOnly   bool
+	page          []*DatabaseEvent
+	index         int
+	exhausted     bool
+	err           error
+}
+
+func NewStreamCursor(db *gorm.DB, streamID string, afterSequence int64, untilSequence int64, pageSize int, handledOnly bool) *StreamCursor {
+	c := StreamCursor{
+		db:            db,
+		streamID:      streamID,
+		afterSequence: afterSequence,
+		untilSequence: untilSequence,
+		pageSize:      pageSize,
+		handledOnly:   handledOnly,
+		index:         -1,
+	}
+
+	return &c
+}
+
+func (c *StreamCursor) fetch() error {
+	rows := make([]*DatabaseEvent, 0, c.pageSize)
+
+	query := c.db.Where("stream_id = ? AND sequence > ? AND sequence <= ?", c.streamID, c.afterSequence, c.untilSequence)
+
+	if c.handledOnly {
+		query = query.Where("is_handled = ? AND is_rejected = ?", true, false)
+	}
+
+	returnedDB := query.Order("sequence ASC").Limit(c.pageSize).Find(&rows)
+	if returnedDB.Error != nil {
+		return returnedDB.Error
+	}
+
+	c.page = rows
+	c.index = -1
+
+	if len(rows) < c.pageSize {
+		c.exhausted = true
+	}
+
+	if len(rows) > 0 {
+		c.afterSequence = rows[len(rows)-1].Sequence
+	}
+
+	return nil
+}
+
+func (c *StreamCursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	c.index++
+
+	if c.index < len(c.page) {
+		return true
+	}
+
+	if c.exhausted {
+		return false
+	}
+
+	c.err = c.fetch()
+	if c.err != nil {
+		return false
+	}
+
+	c.index++
+
+	return c.index < len(c.page)
+}
+
+func (c *StreamCursor) Event() *DatabaseEvent {
+	if c.index < 0 || c.index >= len(c.page) {
+		return nil
+	}
+
+	return c.page[c.index]
+}
+
+func (c *StreamCursor) Err() error {
+	return c.err
+}
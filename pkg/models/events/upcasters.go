@@ -0,0 +1,118 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Upcaster transforms the data of an event from one schema version to the next
+type Upcaster func(json.RawMessage) (json.RawMessage, error)
+
+type Upcasters interface {
+	AddUpcaster(typeNamePattern string, fromSchemaVersion int64, upcaster Upcaster) error
+	GetSchemaVersion(typeName string) int64
+	UpcastData(typeName string, schemaVersion int64, data json.RawMessage) (json.RawMessage, error)
+	Upcast(event *Event) error
+}
+
+type UpcastersImplementation struct {
+	mu        sync.Mutex
+	patterns  []string
+	upcasters map[string]map[int64]Upcaster
+}
+
+func NewUpcasters() *UpcastersImplementation {
+	u := UpcastersImplementation{patterns: make([]string, 0), upcasters: make(map[string]map[int64]Upcaster)}
+
+	return &u
+}
+
+func (u *UpcastersImplementation) getUpcasters(typeName string) map[int64]Upcaster {
+	for _, pattern := range u.patterns {
+		if MatchTypeName(pattern, typeName) {
+			return u.upcasters[pattern]
+		}
+	}
+
+	return nil
+}
+
+// AddUpcaster registers an upcaster from the given schema version to the one after it; the current schema version
+// for a type name is the one after the highest registered
+func (u *UpcastersImplementation) AddUpcaster(typeNamePattern string, fromSchemaVersion int64, upcaster Upcaster) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	upcasters, ok := u.upcasters[typeNamePattern]
+	if !ok {
+		upcasters = make(map[int64]Upcaster)
+		u.upcasters[typeNamePattern] = upcasters
+		u.patterns = append(u.patterns, typeNamePattern)
+	}
+
+	_, ok = upcasters[fromSchemaVersion]
+	if ok {
+		return fmt.Errorf("upcaster for typeNamePattern=%#+v from schemaVersion=%v already exists", typeNamePattern, fromSchemaVersion)
+	}
+
+	upcasters[fromSchemaVersion] = upcaster
+
+	return nil
+}
+
+func (u *UpcastersImplementation) GetSchemaVersion(typeName string) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	schemaVersion := int64(0)
+
+	for fromSchemaVersion := range u.getUpcasters(typeName) {
+		if fromSchemaVersion+1 > schemaVersion {
+			schemaVersion = fromSchemaVersion + 1
+		}
+	}
+
+	return schemaVersion
+}
+
+// UpcastData brings data of the given schema version up to the current schema version for the type name
+func (u *UpcastersImplementation) UpcastData(typeName string, schemaVersion int64, data json.RawMessage) (json.RawMessage, error) {
+	currentSchemaVersion := u.GetSchemaVersion(typeName)
+
+	if schemaVersion > currentSchemaVersion {
+		return nil, fmt.Errorf("typeName=%#+v has schemaVersion=%v which is newer than we know about (%v)", typeName, schemaVersion, currentSchemaVersion)
+	}
+
+	u.mu.Lock()
+	upcasters := u.getUpcasters(typeName)
+	u.mu.Unlock()
+
+	var err error
+
+	for ; schemaVersion < currentSchemaVersion; schemaVersion++ {
+		upcaster, ok := upcasters[schemaVersion]
+		if !ok {
+			return nil, fmt.Errorf("typeName=%#+v has no upcaster from schemaVersion=%v", typeName, schemaVersion)
+		}
+
+		data, err = upcaster(data)
+		if err != nil {
+			return nil, fmt.Errorf("typeName=%#+v failed to upcast from schemaVersion=%v: %v", typeName, schemaVersion, err)
+		}
+	}
+
+	return data, nil
+}
+
+func (u *UpcastersImplementation) Upcast(event *Event) error {
+	data, err := u.UpcastData(event.TypeName, event.SchemaVersion, event.Data)
+	if err != nil {
+		return err
+	}
+
+	event.SchemaVersion = u.GetSchemaVersion(event.TypeName)
+	event.Data = data
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package events_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+)
+
+// renameField returns an upcaster that renames a field of the data
+func renameField(from string, to string) events.Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		fields := make(map[string]interface{})
+
+		err := json.Unmarshal(data, &fields)
+		if err != nil {
+			return nil, err
+		}
+
+		fields[to] = fields[from]
+		delete(fields, from)
+
+		return json.Marshal(fields)
+	}
+}
+
+func TestUpcastData(t *testing.T) {
+	cases := []struct {
+		name          string
+		from          []int64 // the schema versions there are upcasters from (each renaming "v[n]" to "v[n+1]")
+		typeName      string
+		schemaVersion int64
+		data          string
+		expected      string
+		err           string
+	}{
+		{name: "one version", from: []int64{1}, typeName: "thing.1.happened", schemaVersion: 1, data: `{"v1": 1}`, expected: `{"v2":1}`},
+		{name: "chained", from: []int64{0, 1}, typeName: "thing.1.happened", schemaVersion: 0, data: `{"v0": 1}`, expected: `{"v2":1}`},
+		{name: "part of a chain", from: []int64{0, 1}, typeName: "thing.1.happened", schemaVersion: 1, data: `{"v1": 1}`, expected: `{"v2":1}`},
+		{name: "current", from: []int64{0, 1}, typeName: "thing.1.happened", schemaVersion: 2, data: `{"v2": 1}`, expected: `{"v2": 1}`},
+		{name: "another type", from: []int64{0, 1}, typeName: "thing.1.changed", schemaVersion: 0, data: `{"v0": 1}`, expected: `{"v0": 1}`},
+		{name: "newer than known", from: []int64{0, 1}, typeName: "thing.1.happened", schemaVersion: 3, data: `{"v3": 1}`, err: "newer than we know about"},
+		{name: "no upcaster", from: []int64{1}, typeName: "thing.1.happened", schemaVersion: 0, data: `{"v0": 1}`, err: "no upcaster from schemaVersion=0"},
+		{name: "failed upcast", from: []int64{1}, typeName: "thing.1.happened", schemaVersion: 1, data: `[]`, err: "failed to upcast from schemaVersion=1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			upcasters := events.NewUpcasters()
+
+			for _, from := range c.from {
+				err := upcasters.AddUpcaster("thing.*.happened", from, renameField(fmt.Sprintf("v%v", from), fmt.Sprintf("v%v", from+1)))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := upcasters.UpcastData(c.typeName, c.schemaVersion, json.RawMessage(c.data))
+
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("expected an error containing %#+v, got %v", c.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != c.expected {
+				t.Errorf("expected %v, got %s", c.expected, data)
+			}
+		})
+	}
+}
+
+func TestUpcast(t *testing.T) {
+	upcasters := events.NewUpcasters()
+
+	_ = upcasters.AddUpcaster("thing.*.happened", 0, renameField("v0", "v1"))
+	_ = upcasters.AddUpcaster("thing.*.happened", 1, renameField("v1", "v2"))
+
+	err := upcasters.AddUpcaster("thing.*.happened", 1, renameField("v1", "v2"))
+	if err == nil {
+		t.Errorf("expected an error for a second upcaster from the same schema version")
+	}
+
+	event := events.NewWithoutCorrelation("thing.1.happened", json.RawMessage(`{"v0": 1}`))
+
+	err = upcasters.Upcast(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.SchemaVersion != 2 || string(event.Data) != `{"v2":1}` {
+		t.Errorf("expected schema version 2 with {\"v2\":1}, got %v with %s", event.SchemaVersion, event.Data)
+	}
+
+	if schemaVersion := upcasters.GetSchemaVersion("thing.1.changed"); schemaVersion != 0 {
+		t.Errorf("expected schema version 0 for a type without upcasters, got %v", schemaVersion)
+	}
+}
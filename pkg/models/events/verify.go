@@ -0,0 +1,230 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"gorm.io/gorm"
+)
+
+// ChainBreak is the first place a stream's hash chain doesn't hold (i.e. where an event was edited or deleted
+// other than through the event store)
+type ChainBreak struct {
+	StreamID string
+	Sequence int64
+	EventID  string
+	Reason   string
+}
+
+func (b *ChainBreak) Error() string {
+	return fmt.Sprintf("hash chain broken at stream=%#+v sequence=%v event_id=%v: %v", b.StreamID, b.Sequence, b.EventID, b.Reason)
+}
+
+// Verification is the outcome of verifying one or more streams
+type Verification struct {
+	Streams  int64
+	Verified int64       // events whose hashes held
+	Unhashed int64       // events from before there were hashes (only ever at the start of a stream)
+	Dropped  int64       // events that are gone from the start of a stream by retention (see DatabaseEventWatermark)
+	Break    *ChainBreak // nil if every stream held
+}
+
+type chainVerifier struct {
+	db            *gorm.DB
+	hashKey       []byte
+	requireSigned bool
+	verification  *Verification
+}
+
+// getEvents returns the (including soft-deleted) events of a stream for a range of sequences, by sequence
+func (v *chainVerifier) getEvents(streamID string, afterSequence int64, untilSequence int64) (map[int64]*DatabaseEvent, error) {
+	rows := make([]*DatabaseEvent, 0)
+
+	returnedDB := v.db.Unscoped().Where("stream_id = ? AND sequence > ? AND sequence <= ?", streamID, afterSequence, untilSequence).Find(&rows)
+	if returnedDB.Error != nil {
+		return nil, returnedDB.Error
+	}
+
+	databaseEvents := make(map[int64]*DatabaseEvent, len(rows))
+
+	for _, row := range rows {
+		databaseEvents[row.Sequence] = row
+	}
+
+	return databaseEvents, nil
+}
+
+func (v *chainVerifier) check(databaseEventSequence *DatabaseEventSequence, databaseEvent *DatabaseEvent, previousHash string) string {
+	if databaseEvent.DeletedAt.Valid {
+		return "event was (soft) deleted"
+	}
+
+	tenantID, _ := tenants.FromName(databaseEvent.StreamID)
+	if databaseEvent.TenantID != tenantID {
+		return fmt.Sprintf("tenant_id=%#+v doesn't match the stream's tenant_id=%#+v", databaseEvent.TenantID, tenantID)
+	}
+
+	if databaseEvent.EventID != databaseEventSequence.EventID {
+		return fmt.Sprintf("event_id doesn't match the event_id=%v recorded for this sequence", databaseEventSequence.EventID)
+	}
+
+	if databaseEvent.Hash != databaseEventSequence.Hash {
+		return "hash doesn't match the hash recorded for this sequence"
+	}
+
+	if databaseEvent.PreviousHash != previousHash {
+		return "previous hash doesn't match the hash of the previous event"
+	}
+
+	dataHash, err := hashData(databaseEvent.KeyID, databaseEvent.Data)
+	if err != nil {
+		return fmt.Sprintf("failed to hash data: %v", err)
+	}
+
+	if databaseEvent.DataHash != dataHash {
+		return "data was edited"
+	}
+
+	algorithm := getHashAlgorithm(databaseEvent.Hash)
+
+	switch algorithm {
+	case hashAlgorithmHMACSHA256:
+		if len(v.hashKey) == 0 {
+			return "event is signed but there's no key to verify it with"
+		}
+	case hashAlgorithmSHA256:
+		if v.requireSigned {
+			return "event isn't signed"
+		}
+	default:
+		return fmt.Sprintf("unknown hash algorithm=%#+v", algorithm)
+	}
+
+	hashKey := v.hashKey
+	if algorithm == hashAlgorithmSHA256 {
+		hashKey = nil
+	}
+
+	eventHash, err := hashEvent(hashKey, databaseEvent)
+	if err != nil {
+		return fmt.Sprintf("failed to hash event: %v", err)
+	}
+
+	if databaseEvent.Hash != eventHash && algorithm == hashAlgorithmHMACSHA256 {
+		return "event was edited (or signed with a different key)"
+	}
+
+	if databaseEvent.Hash != eventHash {
+		return "event was edited"
+	}
+
+	return ""
+}
+
+// verifyStream walks the stream's sequences (which outlive its events) page by page, checking each event against the
+// hash recorded for its sequence and for the sequence before it
+func (v *chainVerifier) verifyStream(streamID string) error {
+	v.verification.Streams++
+
+	afterSequence := int64(0)
+	previousHash := ""
+	started := false // i.e. we've seen a hashed event, after which there's no excuse for a missing or unhashed one
+
+	// retention is the only excuse for a missing event, and only for those it says it dropped
+	watermark, err := getWatermark(v.db, streamID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		databaseEventSequences := make([]*DatabaseEventSequence, 0, verifyPageSize)
+
+		returnedDB := v.db.Where("stream_id = ? AND sequence > ?", streamID, afterSequence).Order("sequence ASC").Limit(verifyPageSize).Find(&databaseEventSequences)
+		if returnedDB.Error != nil {
+			return returnedDB.Error
+		}
+
+		if len(databaseEventSequences) == 0 {
+			return nil
+		}
+
+		untilSequence := databaseEventSequences[len(databaseEventSequences)-1].Sequence
+
+		databaseEvents, err := v.getEvents(streamID, afterSequence, untilSequence)
+		if err != nil {
+			return err
+		}
+
+		for _, databaseEventSequence := range databaseEventSequences {
+			chainBreak := ChainBreak{StreamID: streamID, Sequence: databaseEventSequence.Sequence, EventID: databaseEventSequence.EventID}
+
+			if databaseEventSequence.Sequence != afterSequence+1 {
+				chainBreak.Reason = fmt.Sprintf("sequences %v to %v are missing", afterSequence+1, databaseEventSequence.Sequence-1)
+				v.verification.Break = &chainBreak
+				return nil
+			}
+
+			afterSequence = databaseEventSequence.Sequence
+
+			databaseEvent := databaseEvents[databaseEventSequence.Sequence]
+
+			switch {
+			case databaseEvent == nil && !started && databaseEventSequence.Sequence <= watermark:
+				v.verification.Dropped++
+			case databaseEvent == nil:
+				chainBreak.Reason = "event was deleted"
+			case databaseEvent.Hash == "" && databaseEventSequence.Hash == "" && !started:
+				v.verification.Unhashed++
+			default:
+				started = true
+
+				chainBreak.Reason = v.check(databaseEventSequence, databaseEvent, previousHash)
+				if chainBreak.Reason == "" {
+					v.verification.Verified++
+				}
+			}
+
+			if chainBreak.Reason != "" {
+				v.verification.Break = &chainBreak
+				return nil
+			}
+
+			previousHash = databaseEventSequence.Hash
+		}
+	}
+}
+
+// Verify checks the hash chain of the given stream (or of every stream, if streamID is empty), stopping at the first
+// break; hashKey is needed to verify signed events and requireSigned treats any unsigned (hashed) event as a break
+func Verify(db *gorm.DB, streamID string, hashKey []byte, requireSigned bool) (*Verification, error) {
+	v := chainVerifier{
+		db:            db,
+		hashKey:       hashKey,
+		requireSigned: requireSigned,
+		verification:  &Verification{},
+	}
+
+	streamIDs := []string{streamID}
+
+	if streamID == "" {
+		streamIDs = make([]string, 0)
+
+		returnedDB := db.Model(&DatabaseEventSequence{}).Distinct("stream_id").Order("stream_id ASC").Pluck("stream_id", &streamIDs)
+		if returnedDB.Error != nil {
+			return nil, returnedDB.Error
+		}
+	}
+
+	for _, streamID := range streamIDs {
+		err := v.verifyStream(streamID)
+		if err != nil {
+			return nil, err
+		}
+
+		if v.verification.Break != nil {
+			break
+		}
+	}
+
+	return v.verification, nil
+}
@@ -0,0 +1,181 @@
+package events_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"gorm.io/gorm"
+)
+
+func TestVerify(t *testing.T) {
+	hashKey := []byte("some hash key")
+
+	cases := []struct {
+		name          string
+		hashKey       []byte // to append with
+		verifyKey     []byte
+		requireSigned bool
+		tamper        func(db *gorm.DB) error
+		sequence      int64 // of the break (0 for none)
+		reason        string
+	}{
+		{
+			name:    "untouched",
+			hashKey: hashKey, verifyKey: hashKey, requireSigned: true,
+		},
+		{
+			name:    "unsigned",
+			hashKey: nil, verifyKey: nil,
+		},
+		{
+			name:    "unsigned but signing required",
+			hashKey: nil, verifyKey: hashKey, requireSigned: true,
+			sequence: 1, reason: "isn't signed",
+		},
+		{
+			name:    "wrong key",
+			hashKey: hashKey, verifyKey: []byte("some other key"),
+			sequence: 1, reason: "edited",
+		},
+		{
+			name:    "edited data",
+			hashKey: hashKey, verifyKey: hashKey,
+			tamper: func(db *gorm.DB) error {
+				return db.Exec(`UPDATE event SET data = '{"n": 200}' WHERE sequence = 2`).Error
+			},
+			sequence: 2, reason: "data was edited",
+		},
+		{
+			name:    "edited type",
+			hashKey: hashKey, verifyKey: hashKey,
+			tamper: func(db *gorm.DB) error {
+				return db.Exec(`UPDATE event SET type_name = 'thing.unhappened' WHERE sequence = 3`).Error
+			},
+			sequence: 3, reason: "edited",
+		},
+		{
+			name:    "deleted",
+			hashKey: hashKey, verifyKey: hashKey,
+			tamper: func(db *gorm.DB) error {
+				return db.Exec(`DELETE FROM event WHERE sequence = 2`).Error
+			},
+			sequence: 2, reason: "deleted",
+		},
+		{
+			name:    "soft deleted",
+			hashKey: hashKey, verifyKey: hashKey,
+			tamper: func(db *gorm.DB) error {
+				return db.Where("sequence = 2").Delete(&events.DatabaseEvent{}).Error
+			},
+			sequence: 2, reason: "deleted",
+		},
+		{
+			name:    "deleted from the start without retention",
+			hashKey: hashKey, verifyKey: hashKey,
+			tamper: func(db *gorm.DB) error {
+				return db.Exec(`DELETE FROM event WHERE sequence = 1`).Error
+			},
+			sequence: 1, reason: "deleted",
+		},
+		{
+			name:    "deleted sequence",
+			hashKey: hashKey, verifyKey: hashKey,
+			tamper: func(db *gorm.DB) error {
+				return db.Exec(`DELETE FROM event_sequence WHERE sequence = 2`).Error
+			},
+			sequence: 3, reason: "missing",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+			store := events.NewEventStoreWithOverrides(db, false, c.hashKey)
+
+			for _, data := range []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`} {
+				_, err := store.Append("thing.1", events.AnyVersion, newDatabaseEvent(t, data))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if c.tamper != nil {
+				err := c.tamper(db)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			verification, err := events.Verify(db, "", c.verifyKey, c.requireSigned)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if verification.Streams != 1 {
+				t.Errorf("expected 1 stream, got %v", verification.Streams)
+			}
+
+			if c.sequence == 0 {
+				if verification.Break != nil {
+					t.Fatalf("expected no break, got %v", verification.Break)
+				}
+
+				if verification.Verified != 3 {
+					t.Errorf("expected 3 verified, got %v", verification.Verified)
+				}
+
+				return
+			}
+
+			if verification.Break == nil {
+				t.Fatalf("expected a break at sequence=%v, got none", c.sequence)
+			}
+
+			if verification.Break.Sequence != c.sequence || !strings.Contains(verification.Break.Reason, c.reason) {
+				t.Errorf("expected a break at sequence=%v about %#+v, got %v", c.sequence, c.reason, verification.Break)
+			}
+		})
+	}
+}
+
+func TestVerifyRecordedDrops(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t, migrations.Migrate)
+	store := events.NewEventStore(db)
+
+	databaseEvents := []*events.DatabaseEvent{newDatabaseEvent(t, `{"n": 1}`), newDatabaseEvent(t, `{"n": 2}`), newDatabaseEvent(t, `{"n": 3}`)}
+
+	for _, databaseEvent := range databaseEvents {
+		_, err := store.Append("thing.1", events.AnyVersion, databaseEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// as retention does it, for a window holding the first two events
+	err := db.Transaction(func(tx *gorm.DB) error {
+		end := databaseEvents[2].CreatedAt
+
+		err := events.RecordWatermarks(tx, time.Time{}, end)
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Where("created_at < ?", end).Delete(&events.DatabaseEvent{}).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verification, err := events.Verify(db, "thing.1", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verification.Break != nil || verification.Dropped != 2 || verification.Verified != 1 {
+		t.Errorf("expected 2 dropped and 1 verified, got %#+v (break %v)", verification, verification.Break)
+	}
+}
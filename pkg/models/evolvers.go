@@ -0,0 +1,102 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+)
+
+// DomainEvent is something that happened to an entity, as decided by a handler of an event sourced writer (see
+// Writer.SetEvolvers); the type name is relative to the entity (e.g. "credited" for wallet.[entity ksuid].credited)
+type DomainEvent struct {
+	TypeName string
+	Data     interface{}
+}
+
+// Evolver applies the data of a domain event to an aggregate; the event has already happened, so it shouldn't second
+// guess it (that's the handler's job) and it should only fail on data it can't make sense of
+type Evolver func(json.RawMessage) error
+
+type Evolvers interface {
+	GetEvolver(string) (Evolver, error)
+	AddEvolver(string, Evolver) error
+}
+
+type EvolversImplementation struct {
+	mu       sync.Mutex
+	evolvers map[string]Evolver
+}
+
+func NewEvolvers() *EvolversImplementation {
+	e := EvolversImplementation{evolvers: make(map[string]Evolver)}
+
+	return &e
+}
+
+func (e *EvolversImplementation) getEvolver(typeName string) (Evolver, error) {
+	evolver, ok := e.evolvers[typeName]
+	if !ok {
+		return nil, fmt.Errorf("evolver for typeName=%#+v does not exist", typeName)
+	}
+
+	return evolver, nil
+}
+
+func (e *EvolversImplementation) GetEvolver(typeName string) (Evolver, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.getEvolver(typeName)
+}
+
+func (e *EvolversImplementation) AddEvolver(typeName string, evolver Evolver) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err := e.getEvolver(typeName)
+	if err == nil {
+		return fmt.Errorf("evolver for typeName=%#+v already exists", typeName)
+	}
+
+	e.evolvers[typeName] = evolver
+
+	return nil
+}
+
+// AddTypedEvolver adds an evolver that's given the data of its domain event as an E
+func AddTypedEvolver[E any](evolvers Evolvers, typeName string, evolver func(E) error) error {
+	return evolvers.AddEvolver(typeName, func(data json.RawMessage) error {
+		var eventData E
+
+		err := json.Unmarshal(data, &eventData)
+		if err != nil {
+			return err
+		}
+
+		return evolver(eventData)
+	})
+}
+
+// Decision is what a decider returns; its domain events, or an Outcome with its domain events as the result (if it has
+// outgoing events as well)
+type Decision interface {
+	[]DomainEvent | Outcome
+}
+
+// AddDecider adds a handler for an event sourced writer; it's given its request body as a Req (as for AddTypedHandler)
+// and decides which domain events (if any) come of it, without changing anything itself
+func AddDecider[Req any, D Decision](handlers Handlers, endpoint string, decider func(HandlerContext, string, ksuid.KSUID, Req) (D, error)) error {
+	return AddTypedHandler(handlers, endpoint, decider)
+}
+
+// evolve hands the data of a domain event (given its type name relative to the entity) to its evolver
+func evolve(evolvers Evolvers, typeName string, data json.RawMessage) error {
+	evolver, err := evolvers.GetEvolver(typeName)
+	if err != nil {
+		return err
+	}
+
+	return evolver(data)
+}
@@ -1,32 +1,99 @@
 package models
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/models/validation"
 	"github.com/segmentio/ksuid"
 )
 
+// HandlerContext is what a handler knows of a request besides its body; for a writer that's the event that carried it,
+// so that a handler that needs the time (or anything else about the request) gets the same answer on replay as it did
+// the first time around
+//
+// It's also a context.Context, carrying the cancellation and deadline of whatever the request came from (e.g. an HTTP
+// request) along with the tenant, metadata and correlation of the request, so that a handler can hand it to
+// Caller.CallWithContext (and the like) as-is
+type HandlerContext struct {
+	context.Context
+	EventID       ksuid.KSUID
+	TenantID      string
+	CorrelationID ksuid.KSUID
+	CausationID   ksuid.KSUID
+	Metadata      map[string]string
+	Timestamp     time.Time // when the request was made (or, outside of a writer, now)
+	SourceName    string
+	SourceID      ksuid.KSUID
+	Sequence      int64 // of the request in the writer's stream (for an event sourced writer, of its first domain event)
+	IsReplay      bool
+}
+
+// NewHandlerContext returns the context for a request that didn't come in an event (e.g. a read)
+func NewHandlerContext(ctx context.Context, tenantID string) HandlerContext {
+	return HandlerContext{
+		Context:   WithTenantID(ctx, tenantID),
+		TenantID:  tenantID,
+		Metadata:  GetMetadata(ctx),
+		Timestamp: helpers.GetNow(),
+	}
+}
+
+// newEventHandlerContext returns the context for a request carried by the given event
+func newEventHandlerContext(ctx context.Context, event *events.Event, sequence int64, isReplay bool) HandlerContext {
+	return HandlerContext{
+		Context:       WithCause(ctx, event),
+		EventID:       event.EventID,
+		TenantID:      event.TenantID,
+		CorrelationID: event.CorrelationID,
+		CausationID:   event.CausationID,
+		Metadata:      event.Metadata,
+		Timestamp:     event.Timestamp,
+		SourceName:    event.SourceName,
+		SourceID:      event.SourceID,
+		Sequence:      sequence,
+		IsReplay:      isReplay,
+	}
+}
+
+// Handler is given the entity the request is from and the request body
 type Handler func(ksuid.KSUID, interface{}) (interface{}, error)
 
+// HandlerWithContext is as per Handler, but is also given the context of the request and the tenant it's from
+type HandlerWithContext func(HandlerContext, string, ksuid.KSUID, interface{}) (interface{}, error)
+
+// Decoder turns the data of a request into the request body its handler expects
+type Decoder func(json.RawMessage) (interface{}, error)
+
 type Handlers interface {
 	GetHandler(string) (Handler, error)
+	GetHandlerWithContext(string) (HandlerWithContext, error)
 	AddHandler(string, Handler) error
+	AddHandlerWithContext(string, HandlerWithContext) error
+	AddDecodingHandler(string, Decoder, HandlerWithContext) error
 	RemoveHandler(string) error
+	Decode(string, json.RawMessage) (interface{}, error)
 }
 
 type HandlersImplementation struct {
 	mu       sync.Mutex
-	handlers map[string]Handler
+	handlers map[string]HandlerWithContext
+	decoders map[string]Decoder
 }
 
 func NewHandlers() *HandlersImplementation {
-	h := HandlersImplementation{handlers: make(map[string]Handler)}
+	h := HandlersImplementation{handlers: make(map[string]HandlerWithContext), decoders: make(map[string]Decoder)}
 
 	return &h
 }
 
-func (h *HandlersImplementation) getHandler(endpoint string) (Handler, error) {
+func (h *HandlersImplementation) getHandler(endpoint string) (HandlerWithContext, error) {
 	handler, ok := h.handlers[endpoint]
 	if !ok {
 		return nil, fmt.Errorf("handler for endpoint=%#+v does not exist", endpoint)
@@ -35,7 +102,20 @@ func (h *HandlersImplementation) getHandler(endpoint string) (Handler, error) {
 	return handler, nil
 }
 
+// GetHandler returns the handler for the given endpoint as a Handler, which handles requests for the default tenant as
+// of now
 func (h *HandlersImplementation) GetHandler(endpoint string) (Handler, error) {
+	handler, err := h.GetHandlerWithContext(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
+		return handler(NewHandlerContext(context.Background(), tenants.DefaultTenantID), tenants.DefaultTenantID, entityID, requestBody)
+	}, nil
+}
+
+func (h *HandlersImplementation) GetHandlerWithContext(endpoint string) (HandlerWithContext, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -43,6 +123,18 @@ func (h *HandlersImplementation) GetHandler(endpoint string) (Handler, error) {
 }
 
 func (h *HandlersImplementation) AddHandler(endpoint string, handler Handler) error {
+	return h.AddHandlerWithContext(endpoint, func(_ HandlerContext, _ string, entityID ksuid.KSUID, requestBody interface{}) (interface{}, error) {
+		return handler(entityID, requestBody)
+	})
+}
+
+func (h *HandlersImplementation) AddHandlerWithContext(endpoint string, handler HandlerWithContext) error {
+	return h.AddDecodingHandler(endpoint, nil, handler)
+}
+
+// AddDecodingHandler adds a handler whose request bodies are decoded by the given decoder (rather than into whatever
+// encoding/json makes of them)
+func (h *HandlersImplementation) AddDecodingHandler(endpoint string, decoder Decoder, handler HandlerWithContext) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -53,6 +145,10 @@ func (h *HandlersImplementation) AddHandler(endpoint string, handler Handler) er
 
 	h.handlers[endpoint] = handler
 
+	if decoder != nil {
+		h.decoders[endpoint] = decoder
+	}
+
 	return nil
 }
 
@@ -66,6 +162,80 @@ func (h *HandlersImplementation) RemoveHandler(endpoint string) error {
 	}
 
 	delete(h.handlers, endpoint)
+	delete(h.decoders, endpoint)
 
 	return nil
 }
+
+// Decode turns the given data into the request body for the handler of the given endpoint; a typed handler gets its
+// own type and anything else gets whatever encoding/json makes of it
+func (h *HandlersImplementation) Decode(endpoint string, data json.RawMessage) (interface{}, error) {
+	h.mu.Lock()
+	decoder, ok := h.decoders[endpoint]
+	h.mu.Unlock()
+
+	if ok {
+		return decoder(data)
+	}
+
+	var requestBody interface{}
+
+	err := json.Unmarshal(data, &requestBody)
+	if err != nil {
+		return nil, validation.FromDecodeError(err)
+	}
+
+	return requestBody, nil
+}
+
+// DecodeAndValidate decodes the given data for the handler of the given endpoint (see Handlers.Decode) and checks it
+// against the validation rules of its type, returning validation.Errors if it's not up to scratch
+func DecodeAndValidate(handlers Handlers, endpoint string, data json.RawMessage) (interface{}, error) {
+	requestBody, err := handlers.Decode(endpoint, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validation.Validate(requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return requestBody, nil
+}
+
+// AddTypedHandler adds a handler that's given its request body as a Req (decoded straight from the request data and
+// checked against the validate tags on Req by DecodeAndValidate) and that returns a Resp
+func AddTypedHandler[Req any, Resp any](handlers Handlers, endpoint string, handler func(HandlerContext, string, ksuid.KSUID, Req) (Resp, error)) error {
+	decoder := func(data json.RawMessage) (interface{}, error) {
+		var requestBody Req
+
+		err := json.Unmarshal(data, &requestBody)
+		if err != nil {
+			return nil, validation.FromDecodeError(err)
+		}
+
+		return requestBody, nil
+	}
+
+	return handlers.AddDecodingHandler(endpoint, decoder, func(ctx HandlerContext, tenantID string, entityID ksuid.KSUID, rawRequestBody interface{}) (interface{}, error) {
+		requestBody, ok := rawRequestBody.(Req)
+
+		// something that didn't come through our decoder (e.g. a map); JSON is the common ground
+		if !ok {
+			data, err := json.Marshal(rawRequestBody)
+			if err != nil {
+				return nil, err
+			}
+
+			decodedRequestBody, err := decoder(data)
+			if err != nil {
+				return nil, err
+			}
+
+			requestBody = decodedRequestBody.(Req)
+		}
+
+		return handler(ctx, tenantID, entityID, requestBody)
+	})
+}
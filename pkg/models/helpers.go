@@ -0,0 +1,120 @@
+package models
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/segmentio/ksuid"
+)
+
+func getSnapshotIntervals() (int64, time.Duration, error) {
+	rawSnapshotEvents, err := helpers.GetEnvironmentVariable("SNAPSHOT_EVENTS", false, defaultSnapshotEvents)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	snapshotEvents, err := strconv.ParseInt(rawSnapshotEvents, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rawSnapshotInterval, err := helpers.GetEnvironmentVariable("SNAPSHOT_INTERVAL", false, defaultSnapshotInterval)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	snapshotInterval, err := time.ParseDuration(rawSnapshotInterval)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return snapshotEvents, snapshotInterval, nil
+}
+
+func getWriterHostLimits() (time.Duration, int, error) {
+	rawIdleTimeout, err := helpers.GetEnvironmentVariable("WRITER_IDLE_TIMEOUT", false, defaultIdleTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	idleTimeout, err := time.ParseDuration(rawIdleTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rawMaxEntities, err := helpers.GetEnvironmentVariable("WRITER_MAX_ENTITIES", false, defaultMaxEntities)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	maxEntities, err := strconv.Atoi(rawMaxEntities)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return idleTimeout, maxEntities, nil
+}
+
+// getStateSubject is where a writer serves its state as of a point in its stream (e.g. state.wallet.[ksuid])
+func getStateSubject(name string) string {
+	return fmt.Sprintf("state.%v", name)
+}
+
+// getEvictSubject is where writer hosts are told to take down an entity's writer (e.g. evict.wallet.[ksuid])
+func getEvictSubject(name string) string {
+	return fmt.Sprintf("evict.%v", name)
+}
+
+// getDomainEventID derives the ID of the index'th domain event decided on for a request from the ID of that request, so
+// that a redelivered request turns up as a duplicate rather than being decided on all over again
+func getDomainEventID(requestEventID ksuid.KSUID, index int) (ksuid.KSUID, error) {
+	payload := sha256.Sum256([]byte(fmt.Sprintf("%v.%v", requestEventID.String(), index)))
+
+	return ksuid.FromParts(requestEventID.Time(), payload[:len(ksuid.Nil.Payload())])
+}
+
+// getRelativeTypeName returns the type name of an event relative to its entity (e.g. "credited" for
+// wallet.[entity ksuid].credited)
+func getRelativeTypeName(typeName string) string {
+	return typeName[strings.LastIndex(typeName, ".")+1:]
+}
+
+// GetAsOf returns the point in history asked for by the as_of (RFC3339) and / or as_of_sequence parameters of a read's
+// request body, or nil if it didn't ask for one (i.e. it wants the current state)
+func GetAsOf(requestBody interface{}) (*calls.AsOf, error) {
+	values, _ := requestBody.(map[string]interface{})
+
+	rawTimestamp, _ := values[asOfParameter].(string)
+	rawSequence, _ := values[asOfSequenceParameter].(string)
+
+	if rawTimestamp == "" && rawSequence == "" {
+		return nil, nil
+	}
+
+	asOf := calls.AsOf{}
+
+	if rawTimestamp != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, rawTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("%v %#+v could not be parsed: %v", asOfParameter, rawTimestamp, err)
+		}
+
+		asOf.Timestamp = timestamp
+	}
+
+	if rawSequence != "" {
+		sequence, err := strconv.ParseInt(rawSequence, 10, 64)
+		if err != nil || sequence <= 0 {
+			return nil, fmt.Errorf("%v %#+v must be a sequence greater than 0", asOfSequenceParameter, rawSequence)
+		}
+
+		asOf.Sequence = sequence
+	}
+
+	return &asOf, nil
+}
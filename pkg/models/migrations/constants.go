@@ -0,0 +1,18 @@
+package migrations
+
+const (
+	SQLite   Backend = "sqlite"
+	Postgres Backend = "postgres" // i.e. TimescaleDB
+)
+
+const (
+	tableName      = "schema_migrations"
+	advisoryLockID = 7203816455 // arbitrary, but it has to be the same for everything that migrates the same database
+)
+
+const (
+	createTableSQLiteSQL   = "CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at datetime NOT NULL);"
+	createTablePostgresSQL = "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL);"
+	lockSQLiteSQL          = "UPDATE schema_migrations SET version = version WHERE 0 = 1;"
+	lockPostgresSQL        = "SELECT pg_advisory_xact_lock(?);"
+)
@@ -0,0 +1,175 @@
+package migrations
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"gorm.io/gorm"
+)
+
+func getMigration(version int64) *Migration {
+	for i := range all {
+		if all[i].Version == version {
+			return &all[i]
+		}
+	}
+
+	return nil
+}
+
+// GetLatestVersion returns the version of the last migration this build knows about
+func GetLatestVersion() int64 {
+	return all[len(all)-1].Version
+}
+
+// lock stops anything else migrating the same database until the transaction finishes
+func lock(tx *gorm.DB, backend Backend) error {
+	if backend == SQLite {
+		// a write that changes nothing, so that we hold the write lock before we read anything
+		return tx.Exec(lockSQLiteSQL).Error
+	}
+
+	err := tx.Exec(lockPostgresSQL, advisoryLockID).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Exec(createTablePostgresSQL).Error
+}
+
+func getApplied(tx *gorm.DB) (map[int64]*DatabaseMigration, error) {
+	rows := make([]*DatabaseMigration, 0)
+
+	err := tx.Order("version ASC").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]*DatabaseMigration)
+
+	for _, row := range rows {
+		if getMigration(row.Version) == nil {
+			return nil, fmt.Errorf("database has migration version=%v (%v) applied, but this build doesn't know about it (is the database newer?)", row.Version, row.Name)
+		}
+
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+func run(tx *gorm.DB, backend Backend, migration *Migration, up bool) error {
+	steps, direction := migration.Up, "up"
+	if !up {
+		steps, direction = migration.Down, "down"
+	}
+
+	step, ok := steps[backend]
+	if !ok {
+		return fmt.Errorf("migration version=%v (%v) has no %v step for %v", migration.Version, migration.Name, direction, backend)
+	}
+
+	log.Printf("migrations - running version=%v (%v) %v", migration.Version, migration.Name, direction)
+
+	err := step(tx)
+	if err != nil {
+		return fmt.Errorf("migration version=%v (%v) failed to run %v: %v", migration.Version, migration.Name, direction, err)
+	}
+
+	if !up {
+		return tx.Delete(&DatabaseMigration{}, migration.Version).Error
+	}
+
+	return tx.Create(&DatabaseMigration{Version: migration.Version, Name: migration.Name, AppliedAt: helpers.GetNow()}).Error
+}
+
+// MigrateTo applies (or reverts) migrations until the database is at the given version (0 reverts all of them); it
+// all happens in one transaction holding a lock, so concurrent callers wait for each other and a failure leaves the
+// database as it was
+func MigrateTo(db *gorm.DB, version int64) error {
+	if version != 0 && getMigration(version) == nil {
+		return fmt.Errorf("no migration with version=%v", version)
+	}
+
+	backend := getBackend(db)
+
+	// for SQLite the table has to exist before the transaction starts (as creating it there would be a read before
+	// we have the write lock), but creating it is atomic anyway
+	if backend == SQLite {
+		err := db.Exec(createTableSQLiteSQL).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := lock(tx, backend)
+		if err != nil {
+			return err
+		}
+
+		applied, err := getApplied(tx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(all) - 1; i >= 0; i-- {
+			if all[i].Version <= version || applied[all[i].Version] == nil {
+				continue
+			}
+
+			err = run(tx, backend, &all[i], false)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range all {
+			if all[i].Version > version || applied[all[i].Version] != nil {
+				continue
+			}
+
+			err = run(tx, backend, &all[i], true)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Migrate applies every migration that hasn't been applied yet
+func Migrate(db *gorm.DB) error {
+	return MigrateTo(db, GetLatestVersion())
+}
+
+// GetStatus returns every migration this build knows about and when (if at all) it was applied
+func GetStatus(db *gorm.DB) ([]*Status, error) {
+	applied := make(map[int64]*DatabaseMigration)
+
+	if db.Migrator().HasTable(tableName) {
+		var err error
+
+		applied, err = getApplied(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]*Status, 0)
+
+	for _, migration := range all {
+		status := Status{Version: migration.Version, Name: migration.Name}
+
+		row := applied[migration.Version]
+		if row != nil {
+			status.AppliedAt = &row.AppliedAt
+		}
+
+		statuses = append(statuses, &status)
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,119 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"gorm.io/gorm"
+)
+
+func getAppliedVersions(t *testing.T, db *gorm.DB) []int64 {
+	t.Helper()
+
+	statuses, err := GetStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make([]int64, 0)
+
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			versions = append(versions, status.Version)
+		}
+	}
+
+	return versions
+}
+
+func TestMigrations(t *testing.T) {
+	for i, migration := range all {
+		if migration.Version != int64(i+1) {
+			t.Errorf("expected version=%v, got version=%v (%v)", i+1, migration.Version, migration.Name)
+		}
+
+		for _, backend := range []Backend{SQLite, Postgres} {
+			if migration.Up[backend] == nil || migration.Down[backend] == nil {
+				t.Errorf("version=%v (%v) is missing a step for backend=%v", migration.Version, migration.Name, backend)
+			}
+		}
+	}
+
+	if GetLatestVersion() != int64(len(all)) {
+		t.Errorf("expected latest version=%v, got %v", len(all), GetLatestVersion())
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := in_memory.Setup(t).GetTestDB(t)
+
+	versions := getAppliedVersions(t, db)
+	if len(versions) != 0 {
+		t.Fatalf("expected nothing applied to a new database, got %v", versions)
+	}
+
+	err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions = getAppliedVersions(t, db)
+	if len(versions) != len(all) {
+		t.Fatalf("expected all %v migrations applied, got %v", len(all), versions)
+	}
+
+	for _, table := range []string{"event", "event_sequence", "event_position", "state", "checkpoint", "outbox", "event_watermark"} {
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("expected table=%v after migrating", table)
+		}
+	}
+
+	// nothing left to do
+	err = Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MigrateTo(db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions = getAppliedVersions(t, db)
+	if len(versions) != 3 || versions[2] != 3 {
+		t.Fatalf("expected versions 1 to 3 applied, got %v", versions)
+	}
+
+	if db.Migrator().HasTable("outbox") || !db.Migrator().HasTable("state") {
+		t.Errorf("expected the outbox table to have been dropped and the state table to be kept")
+	}
+
+	err = MigrateTo(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions = getAppliedVersions(t, db)
+	if len(versions) != 0 {
+		t.Fatalf("expected nothing applied after reverting everything, got %v", versions)
+	}
+
+	if db.Migrator().HasTable("event") {
+		t.Errorf("expected the event table to have been dropped")
+	}
+
+	err = Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions = getAppliedVersions(t, db)
+	if len(versions) != len(all) {
+		t.Fatalf("expected all %v migrations applied again, got %v", len(all), versions)
+	}
+
+	err = MigrateTo(db, GetLatestVersion()+1)
+	if err == nil {
+		t.Errorf("expected an error migrating to an unknown version")
+	}
+}
@@ -0,0 +1,103 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"gorm.io/gorm"
+)
+
+type Backend string
+
+// Step is one direction of a migration on one backend; it's run inside the migrating transaction
+type Step func(tx *gorm.DB) error
+
+// Migration is a numbered change to the schema with an up and a down step for every backend; a migration that's been
+// released must never change (make a new one instead)
+type Migration struct {
+	Version int64
+	Name    string
+	Up      map[Backend]Step
+	Down    map[Backend]Step
+}
+
+// Status is a known migration and when it was applied (nil if it hasn't been)
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// DatabaseMigration is a migration that has been applied
+type DatabaseMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (d *DatabaseMigration) TableName() string {
+	return tableName
+}
+
+func getBackend(db *gorm.DB) Backend {
+	if helpers.IsSQLite(db) {
+		return SQLite
+	}
+
+	return Postgres
+}
+
+// execSQL returns a step that runs the given statements in order, stopping at the first one that fails
+func execSQL(statements ...string) Step {
+	return func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			err := tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// addColumns returns a step that adds any of the given columns (e.g. "hash text") that the table doesn't have, which is
+// the case for tables created by AutoMigrate before those columns existed
+func addColumns(table string, columns ...string) Step {
+	return func(tx *gorm.DB) error {
+		for _, column := range columns {
+			name := strings.SplitN(column, " ", 2)[0]
+
+			if tx.Migrator().HasColumn(table, name) {
+				continue
+			}
+
+			err := tx.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v;", table, column)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// steps returns a step that runs the given steps in order, stopping at the first one that fails
+func steps(steps ...Step) Step {
+	return func(tx *gorm.DB) error {
+		for _, step := range steps {
+			err := step(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func noop(tx *gorm.DB) error {
+	return nil
+}
@@ -0,0 +1,179 @@
+package migrations
+
+import (
+	"github.com/initialed85/uneventful/pkg/models/events"
+)
+
+// all is every migration in version order; the first few create the schema as AutoMigrate used to (hence IF NOT
+// EXISTS everywhere, and adding any columns a table created by an older version is missing), so that databases created
+// before there were migrations are adopted
+var all = []Migration{
+	{
+		Version: 1,
+		Name:    "create_event_tables",
+		Up: map[Backend]Step{
+			SQLite: steps(
+				execSQL(`CREATE TABLE IF NOT EXISTS event (created_at datetime, updated_at datetime, deleted_at datetime, event_id text, tenant_id text NOT NULL DEFAULT '', stream_id text, sequence integer, position integer, correlation_id text, causation_id text, idempotency_key text, timestamp datetime, source_name text, source_id text, type_name text, schema_version integer, data jsonb, key_id text, metadata jsonb, is_handled numeric, is_rejected numeric, rejection_reason text, handled_by_name text, handled_by_id text, data_hash text, previous_hash text, hash text);`),
+				addColumns("event", "tenant_id text NOT NULL DEFAULT ''", "stream_id text", "sequence integer", "position integer", "causation_id text", "idempotency_key text", "schema_version integer", "key_id text", "metadata jsonb", "is_rejected numeric", "rejection_reason text", "data_hash text", "previous_hash text", "hash text"),
+				execSQL(
+					`CREATE INDEX IF NOT EXISTS idx_event_deleted_at ON event (deleted_at);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_tenant_id ON event (tenant_id);`,
+					`CREATE INDEX IF NOT EXISTS event_stream_id_sequence ON event (stream_id, sequence);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_position ON event (position);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_correlation_id ON event (correlation_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_causation_id ON event (causation_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_idempotency_key ON event (idempotency_key);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_timestamp ON event (timestamp);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_source_name ON event (source_name);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_source_id ON event (source_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_type_name ON event (type_name);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_is_handled ON event (is_handled);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_is_rejected ON event (is_rejected);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_handled_by_name ON event (handled_by_name);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_handled_by_id ON event (handled_by_id);`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS event_id_created_at ON event (event_id, created_at DESC);`,
+					`CREATE TABLE IF NOT EXISTS event_sequence (created_at datetime, stream_id text, sequence integer, event_id text, idempotency_key text, hash text, PRIMARY KEY (stream_id, sequence));`,
+				),
+				addColumns("event_sequence", "idempotency_key text", "hash text"),
+				execSQL(
+					`CREATE UNIQUE INDEX IF NOT EXISTS event_sequence_stream_id_event_id ON event_sequence (stream_id, event_id);`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS event_sequence_stream_id_idempotency_key ON event_sequence (stream_id, idempotency_key) WHERE idempotency_key <> '';`,
+					`CREATE TABLE IF NOT EXISTS event_position (id integer, store_id text, position integer, PRIMARY KEY (id));`,
+					`CREATE TABLE IF NOT EXISTS event_key (created_at datetime, key_id text, stream_id text, key blob, PRIMARY KEY (key_id));`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS idx_event_key_stream_id ON event_key (stream_id);`,
+				),
+			),
+			Postgres: steps(
+				execSQL(`CREATE TABLE IF NOT EXISTS event (created_at timestamptz, updated_at timestamptz, deleted_at timestamptz, event_id text, tenant_id text NOT NULL DEFAULT '', stream_id text, sequence bigint, position bigint, correlation_id text, causation_id text, idempotency_key text, timestamp timestamptz, source_name text, source_id text, type_name text, schema_version bigint, data jsonb, key_id text, metadata jsonb, is_handled boolean, is_rejected boolean, rejection_reason text, handled_by_name text, handled_by_id text, data_hash text, previous_hash text, hash text);`),
+				addColumns("event", "tenant_id text NOT NULL DEFAULT ''", "stream_id text", "sequence bigint", "position bigint", "causation_id text", "idempotency_key text", "schema_version bigint", "key_id text", "metadata jsonb", "is_rejected boolean", "rejection_reason text", "data_hash text", "previous_hash text", "hash text"),
+				execSQL(
+					`CREATE INDEX IF NOT EXISTS idx_event_deleted_at ON event (deleted_at);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_tenant_id ON event (tenant_id);`,
+					`CREATE INDEX IF NOT EXISTS event_stream_id_sequence ON event (stream_id, sequence);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_position ON event (position);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_correlation_id ON event (correlation_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_causation_id ON event (causation_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_idempotency_key ON event (idempotency_key);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_timestamp ON event (timestamp);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_source_name ON event (source_name);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_source_id ON event (source_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_type_name ON event (type_name);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_is_handled ON event (is_handled);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_is_rejected ON event (is_rejected);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_handled_by_name ON event (handled_by_name);`,
+					`CREATE INDEX IF NOT EXISTS idx_event_handled_by_id ON event (handled_by_id);`,
+					// TimescaleDB only permits unique indexes that include the partition columns
+					`CREATE UNIQUE INDEX IF NOT EXISTS event_id_created_at ON event (event_id, created_at DESC);`,
+					`SELECT create_hypertable('event', 'created_at', 'event_id', 1, chunk_time_interval => INTERVAL '1 day', if_not_exists => true);`,
+					`CREATE TABLE IF NOT EXISTS event_sequence (created_at timestamptz, stream_id text, sequence bigint, event_id text, idempotency_key text, hash text, PRIMARY KEY (stream_id, sequence));`,
+				),
+				addColumns("event_sequence", "idempotency_key text", "hash text"),
+				execSQL(
+					`CREATE UNIQUE INDEX IF NOT EXISTS event_sequence_stream_id_event_id ON event_sequence (stream_id, event_id);`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS event_sequence_stream_id_idempotency_key ON event_sequence (stream_id, idempotency_key) WHERE idempotency_key <> '';`,
+					`CREATE TABLE IF NOT EXISTS event_position (id bigint, store_id text, position bigint, PRIMARY KEY (id));`,
+					`CREATE TABLE IF NOT EXISTS event_key (created_at timestamptz, key_id text, stream_id text, key bytea, PRIMARY KEY (key_id));`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS idx_event_key_stream_id ON event_key (stream_id);`,
+				),
+			),
+		},
+		Down: map[Backend]Step{
+			SQLite:   execSQL(`DROP TABLE IF EXISTS event_key;`, `DROP TABLE IF EXISTS event_position;`, `DROP TABLE IF EXISTS event_sequence;`, `DROP TABLE IF EXISTS event;`),
+			Postgres: execSQL(`DROP TABLE IF EXISTS event_key;`, `DROP TABLE IF EXISTS event_position;`, `DROP TABLE IF EXISTS event_sequence;`, `DROP TABLE IF EXISTS event;`),
+		},
+	},
+	{
+		Version: 2,
+		Name:    "backfill_event_positions",
+		Up: map[Backend]Step{
+			SQLite:   events.BackfillPositions,
+			Postgres: events.BackfillPositions,
+		},
+		// the positions (and the store ID) have already been handed out to consumers, so they stay
+		Down: map[Backend]Step{
+			SQLite:   noop,
+			Postgres: noop,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create_state_table",
+		Up: map[Backend]Step{
+			SQLite: steps(
+				execSQL(`CREATE TABLE IF NOT EXISTS state (created_at datetime, updated_at datetime, deleted_at datetime, version_id integer PRIMARY KEY AUTOINCREMENT, sequence integer, timestamp datetime, name text, tenant_id text NOT NULL DEFAULT '', entity_id text, data jsonb);`),
+				addColumns("state", "sequence integer", "tenant_id text NOT NULL DEFAULT ''"),
+				execSQL(
+					`CREATE INDEX IF NOT EXISTS idx_state_deleted_at ON state (deleted_at);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_sequence ON state (sequence);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_timestamp ON state (timestamp);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_name ON state (name);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_tenant_id ON state (tenant_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_entity_id ON state (entity_id);`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS version_id_created_at ON state (version_id, created_at DESC);`,
+				),
+			),
+			Postgres: steps(
+				execSQL(`CREATE TABLE IF NOT EXISTS state (created_at timestamptz, updated_at timestamptz, deleted_at timestamptz, version_id bigserial, sequence bigint, timestamp timestamptz, name text, tenant_id text NOT NULL DEFAULT '', entity_id text, data jsonb);`),
+				addColumns("state", "sequence bigint", "tenant_id text NOT NULL DEFAULT ''"),
+				execSQL(
+					`CREATE INDEX IF NOT EXISTS idx_state_deleted_at ON state (deleted_at);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_sequence ON state (sequence);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_timestamp ON state (timestamp);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_name ON state (name);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_tenant_id ON state (tenant_id);`,
+					`CREATE INDEX IF NOT EXISTS idx_state_entity_id ON state (entity_id);`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS version_id_created_at ON state (version_id, created_at DESC);`,
+					`SELECT create_hypertable('state', 'created_at', 'version_id', 1, chunk_time_interval => INTERVAL '1 day', if_not_exists => true);`,
+				),
+			),
+		},
+		Down: map[Backend]Step{
+			SQLite:   execSQL(`DROP TABLE IF EXISTS state;`),
+			Postgres: execSQL(`DROP TABLE IF EXISTS state;`),
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create_checkpoint_table",
+		Up: map[Backend]Step{
+			SQLite:   execSQL(`CREATE TABLE IF NOT EXISTS checkpoint (created_at datetime, updated_at datetime, name text, store_id text, position integer, PRIMARY KEY (name));`),
+			Postgres: execSQL(`CREATE TABLE IF NOT EXISTS checkpoint (created_at timestamptz, updated_at timestamptz, name text, store_id text, position bigint, PRIMARY KEY (name));`),
+		},
+		Down: map[Backend]Step{
+			SQLite:   execSQL(`DROP TABLE IF EXISTS checkpoint;`),
+			Postgres: execSQL(`DROP TABLE IF EXISTS checkpoint;`),
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create_outbox_table",
+		Up: map[Backend]Step{
+			SQLite: steps(
+				execSQL(`CREATE TABLE IF NOT EXISTS outbox (created_at datetime, id integer PRIMARY KEY AUTOINCREMENT, name text, kind text, destination text, content_type text, data blob);`),
+				addColumns("outbox", "content_type text"),
+				execSQL(`CREATE INDEX IF NOT EXISTS idx_outbox_name ON outbox (name);`),
+			),
+			Postgres: steps(
+				execSQL(`CREATE TABLE IF NOT EXISTS outbox (created_at timestamptz, id bigserial, name text, kind text, destination text, content_type text, data bytea, PRIMARY KEY (id));`),
+				addColumns("outbox", "content_type text"),
+				execSQL(`CREATE INDEX IF NOT EXISTS idx_outbox_name ON outbox (name);`),
+			),
+		},
+		Down: map[Backend]Step{
+			SQLite:   execSQL(`DROP TABLE IF EXISTS outbox;`),
+			Postgres: execSQL(`DROP TABLE IF EXISTS outbox;`),
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create_event_watermark_table",
+		Up: map[Backend]Step{
+			SQLite:   execSQL(`CREATE TABLE IF NOT EXISTS event_watermark (created_at datetime, updated_at datetime, stream_id text, sequence integer, PRIMARY KEY (stream_id));`),
+			Postgres: execSQL(`CREATE TABLE IF NOT EXISTS event_watermark (created_at timestamptz, updated_at timestamptz, stream_id text, sequence bigint, PRIMARY KEY (stream_id));`),
+		},
+		Down: map[Backend]Step{
+			SQLite:   execSQL(`DROP TABLE IF EXISTS event_watermark;`),
+			Postgres: execSQL(`DROP TABLE IF EXISTS event_watermark;`),
+		},
+	},
+}
@@ -0,0 +1,11 @@
+package outbox
+
+import "time"
+
+const (
+	tableName          = "outbox"
+	KindRedisSet       = "redis_set"
+	KindNatsPublish    = "nats_publish"
+	relayBatchSize     = 100
+	defaultRelayPeriod = time.Second * 5
+)
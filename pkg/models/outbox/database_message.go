@@ -0,0 +1,89 @@
+package outbox
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// likeEscaper turns a pattern (see GetPendingNames) into a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`)
+
+// DatabaseMessage is a side effect (Redis / NATS) that was decided on inside a database transaction and is relayed
+// once that transaction has committed
+type DatabaseMessage struct {
+	CreatedAt   time.Time
+	ID          uint64 `gorm:"primaryKey;autoIncrement"`
+	Name        string `gorm:"index"`
+	Kind        string
+	Destination string
+	ContentType string // for NATS publishes (goes out as a header)
+	Data        []byte
+}
+
+func (d *DatabaseMessage) TableName() string {
+	return tableName
+}
+
+func NewRedisSet(name string, key string, data []byte) *DatabaseMessage {
+	d := DatabaseMessage{Name: name, Kind: KindRedisSet, Destination: key, Data: data}
+
+	return &d
+}
+
+func NewNatsPublish(name string, subject string, contentType string, data []byte) *DatabaseMessage {
+	d := DatabaseMessage{Name: name, Kind: KindNatsPublish, Destination: subject, ContentType: contentType, Data: data}
+
+	return &d
+}
+
+func (d *DatabaseMessage) Create(givenDB *gorm.DB) (*gorm.DB, error) {
+	returnedDB := givenDB.Create(d)
+
+	return returnedDB, returnedDB.Error
+}
+
+func (d *DatabaseMessage) Delete(givenDB *gorm.DB) (*gorm.DB, error) {
+	returnedDB := givenDB.Where("id = ?", d.ID).Delete(d)
+
+	return returnedDB, returnedDB.Error
+}
+
+func GetPending(db *gorm.DB, name string, limit int) ([]*DatabaseMessage, error) {
+	rows := make([]*DatabaseMessage, 0)
+
+	returnedDB := db.Where("name = ?", name).Order("id ASC").Limit(limit).Find(&rows)
+
+	return rows, returnedDB.Error
+}
+
+// Discard deletes everything pending for the name without relaying it (e.g. because it holds data that has since been
+// shredded)
+func Discard(db *gorm.DB, name string) (int64, error) {
+	returnedDB := db.Where("name = ?", name).Delete(&DatabaseMessage{})
+
+	return returnedDB.RowsAffected, returnedDB.Error
+}
+
+// GetPendingNames returns the names that have something pending and match any of the given patterns (in which "*"
+// matches anything)
+func GetPendingNames(db *gorm.DB, patterns []string) ([]string, error) {
+	names := make([]string, 0)
+
+	if len(patterns) == 0 {
+		return names, nil
+	}
+
+	conditions := make([]string, 0, len(patterns))
+	values := make([]interface{}, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		conditions = append(conditions, "name LIKE ? ESCAPE '\\'")
+		values = append(values, likeEscaper.Replace(pattern))
+	}
+
+	returnedDB := db.Model(&DatabaseMessage{}).Where(strings.Join(conditions, " OR "), values...).Distinct("name").Order("name").Pluck("name", &names)
+
+	return names, returnedDB.Error
+}
@@ -0,0 +1,179 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
+	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Relay drains the outbox for a given name in order (or, for a relay from NewPatternRelay, for every name that matches
+// any of its patterns, each in order); it's at-least-once, so anything on the other end needs to tolerate seeing the same
+// message twice
+type Relay struct {
+	lifecycles.Worker
+	mu             sync.Mutex
+	dbMu           sync.Locker
+	name           string
+	patterns       []string
+	databaseWorker database_worker.Worker
+	redisWorker    redis_worker.Worker
+	natsWorker     nats_worker.Worker
+}
+
+func NewRelay(
+	name string,
+	databaseWorker database_worker.Worker,
+	redisWorker redis_worker.Worker,
+	natsWorker nats_worker.Worker,
+	dbMu sync.Locker,
+) *Relay {
+	r := Relay{
+		dbMu:           dbMu,
+		name:           name,
+		databaseWorker: databaseWorker,
+		redisWorker:    redisWorker,
+		natsWorker:     natsWorker,
+	}
+
+	r.Worker = lifecycles.NewScheduledWorker(fmt.Sprintf("relay_%v", name), nil, r.Flush, nil, nil, defaultRelayPeriod)
+
+	return &r
+}
+
+// NewPatternRelay returns a relay for every name that matches any of the given patterns (in which "*" matches anything,
+// e.g. "wallet.*" for the streams of all of a writer host's entities), so that one relay can stand in for many
+func NewPatternRelay(
+	name string,
+	patterns []string,
+	databaseWorker database_worker.Worker,
+	redisWorker redis_worker.Worker,
+	natsWorker nats_worker.Worker,
+	dbMu sync.Locker,
+) *Relay {
+	r := NewRelay(name, databaseWorker, redisWorker, natsWorker, dbMu)
+
+	r.patterns = patterns
+
+	return r
+}
+
+func (r *Relay) relay(databaseMessage *DatabaseMessage) error {
+	switch databaseMessage.Kind {
+	case KindRedisSet:
+		redisClient, err := r.redisWorker.GetRedisClient()
+		if err != nil {
+			return err
+		}
+
+		return redisClient.Set(context.Background(), databaseMessage.Destination, databaseMessage.Data, time.Duration(0)).Err()
+	case KindNatsPublish:
+		natsConn, err := r.natsWorker.GetNatsConn()
+		if err != nil {
+			return err
+		}
+
+		msg := nats.NewMsg(databaseMessage.Destination)
+		msg.Data = databaseMessage.Data
+
+		if databaseMessage.ContentType != "" {
+			msg.Header.Set(codecs.ContentTypeHeader, databaseMessage.ContentType)
+		}
+
+		return natsConn.PublishMsg(msg)
+	}
+
+	return fmt.Errorf("unknown kind=%#+v for outbox message id=%v", databaseMessage.Kind, databaseMessage.ID)
+}
+
+// Flush relays everything pending for the name (or the patterns); it's called on a schedule and also by whoever just
+// committed something to the outbox (so that they needn't wait for the schedule)
+func (r *Relay) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	db, err := r.databaseWorker.GetDB()
+	if err != nil {
+		return err
+	}
+
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+
+	if r.patterns == nil {
+		return r.flush(db, r.name)
+	}
+
+	names, err := GetPendingNames(db, r.patterns)
+	if err != nil {
+		return err
+	}
+
+	// a failure for one name mustn't hold up the others
+	var flushErr error
+
+	for _, name := range names {
+		err = r.flush(db, name)
+		if err != nil {
+			flushErr = err
+		}
+	}
+
+	return flushErr
+}
+
+func (r *Relay) flush(db *gorm.DB, name string) error {
+	for {
+		relayed := 0
+
+		var relayErr error
+
+		// the row locks stop other relays for the same name (e.g. writer replicas) from relaying out of order
+		err := db.Transaction(func(tx *gorm.DB) error {
+			databaseMessages, err := GetPending(tx.Clauses(clause.Locking{Strength: "UPDATE"}), name, relayBatchSize)
+			if err != nil {
+				return err
+			}
+
+			for _, databaseMessage := range databaseMessages {
+				// stop at the first failure to preserve ordering, but keep what we've already relayed
+				relayErr = r.relay(databaseMessage)
+				if relayErr != nil {
+					log.Printf("%v - warning: failed to relay outbox message id=%v: %v", name, databaseMessage.ID, relayErr)
+					break
+				}
+
+				_, err = databaseMessage.Delete(tx)
+				if err != nil {
+					return err
+				}
+
+				relayed++
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if relayErr != nil {
+			return relayErr
+		}
+
+		if relayed < relayBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package outbox
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
+	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+type testWorkers struct {
+	databaseWorker database_worker.Worker
+	redisWorker    redis_worker.Worker
+	natsWorker     nats_worker.Worker
+	db             *gorm.DB
+}
+
+func getTestWorkers(t *testing.T) *testWorkers {
+	t.Helper()
+
+	d := in_memory.Setup(t)
+
+	w := testWorkers{
+		databaseWorker: d.NewDatabaseWorker("test"),
+		redisWorker:    d.NewRedisWorker("test"),
+		natsWorker:     d.NewNatsWorker("test"),
+		db:             d.GetTestDB(t, migrations.Migrate),
+	}
+
+	in_memory.Start(t, w.databaseWorker, w.redisWorker, w.natsWorker)
+
+	return &w
+}
+
+func create(t *testing.T, db *gorm.DB, databaseMessages ...*DatabaseMessage) {
+	t.Helper()
+
+	for _, databaseMessage := range databaseMessages {
+		_, err := databaseMessage.Create(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func getPendingCount(t *testing.T, db *gorm.DB, name string) int {
+	t.Helper()
+
+	databaseMessages, err := GetPending(db, name, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(databaseMessages)
+}
+
+func TestRelay(t *testing.T) {
+	w := getTestWorkers(t)
+
+	natsConn, err := w.natsWorker.GetNatsConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *nats.Msg, 1000)
+
+	_, err = natsConn.ChanSubscribe("outbox_test.>", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = natsConn.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more than a batch, to be relayed in order
+	for i := 0; i < relayBatchSize+10; i++ {
+		create(t, w.db, NewNatsPublish("a", "outbox_test.a", codecs.ContentTypeJSON, []byte{byte(i)}))
+	}
+
+	create(
+		t,
+		w.db,
+		NewRedisSet("a", "outbox_test_key", []byte("some state")),
+		NewNatsPublish("b", "outbox_test.b", "", []byte("not for this relay")),
+	)
+
+	relay := NewRelay("a", w.databaseWorker, w.redisWorker, w.natsWorker, &sync.Mutex{})
+
+	err = relay.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < relayBatchSize+10; i++ {
+		select {
+		case msg := <-received:
+			if msg.Subject != "outbox_test.a" || msg.Data[0] != byte(i) {
+				t.Fatalf("expected message %v on outbox_test.a, got %v on %v", i, msg.Data, msg.Subject)
+			}
+
+			if msg.Header.Get(codecs.ContentTypeHeader) != codecs.ContentTypeJSON {
+				t.Errorf("expected the content type header, got %#+v", msg.Header)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %v", i)
+		}
+	}
+
+	redisClient, err := w.redisWorker.GetRedisClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := redisClient.Get(context.Background(), "outbox_test_key").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "some state" {
+		t.Errorf("expected the Redis set to have been relayed, got %#+v", value)
+	}
+
+	if getPendingCount(t, w.db, "a") != 0 {
+		t.Errorf("expected nothing pending for a once relayed")
+	}
+
+	if getPendingCount(t, w.db, "b") != 1 {
+		t.Errorf("expected b to have been left alone")
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("expected nothing else relayed, got %v on %v", msg.Data, msg.Subject)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPatternRelay(t *testing.T) {
+	w := getTestWorkers(t)
+
+	natsConn, err := w.natsWorker.GetNatsConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *nats.Msg, 10)
+
+	_, err = natsConn.ChanSubscribe("outbox_test.>", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = natsConn.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create(
+		t,
+		w.db,
+		NewNatsPublish("wallet.1", "outbox_test.wallet_1", "", nil),
+		NewNatsPublish("tenant.acme.wallet.2", "outbox_test.wallet_2", "", nil),
+		NewNatsPublish("walletx1", "outbox_test.walletx1", "", nil),
+	)
+
+	relay := NewPatternRelay("test", []string{"wallet.*", "tenant.*.wallet.*"}, w.databaseWorker, w.redisWorker, w.natsWorker, &sync.Mutex{})
+
+	err = relay.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subjects := make(map[string]bool)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			subjects[msg.Subject] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %v", i)
+		}
+	}
+
+	if !reflect.DeepEqual(subjects, map[string]bool{"outbox_test.wallet_1": true, "outbox_test.wallet_2": true}) {
+		t.Errorf("expected the messages for both wallets, got %v", subjects)
+	}
+
+	if getPendingCount(t, w.db, "walletx1") != 1 {
+		t.Errorf("expected walletx1 to have been left alone")
+	}
+}
+
+func TestGetPendingNames(t *testing.T) {
+	w := getTestWorkers(t)
+
+	create(
+		t,
+		w.db,
+		NewNatsPublish("wallet.1", "a", "", nil),
+		NewNatsPublish("wallet.1", "a", "", nil),
+		NewNatsPublish("wallet.2", "a", "", nil),
+		NewNatsPublish("wallet_x", "a", "", nil),
+		NewNatsPublish("walletxx", "a", "", nil),
+		NewNatsPublish("100%", "a", "", nil),
+		NewNatsPublish("1000", "a", "", nil),
+	)
+
+	cases := []struct {
+		name     string
+		patterns []string
+		names    []string
+	}{
+		{name: "none", patterns: nil, names: []string{}},
+		{name: "exact", patterns: []string{"wallet.2"}, names: []string{"wallet.2"}},
+		{name: "wildcard", patterns: []string{"wallet.*"}, names: []string{"wallet.1", "wallet.2"}},
+		{name: "underscore is literal", patterns: []string{"wallet_*"}, names: []string{"wallet_x"}},
+		{name: "percent is literal", patterns: []string{"100%"}, names: []string{"100%"}},
+		{name: "several", patterns: []string{"wallet.1", "wallet_x"}, names: []string{"wallet.1", "wallet_x"}},
+		{name: "no match", patterns: []string{"thing.*"}, names: []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			names, err := GetPendingNames(w.db, c.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(names, c.names) {
+				t.Errorf("expected %v, got %v", c.names, names)
+			}
+		})
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	w := getTestWorkers(t)
+
+	create(
+		t,
+		w.db,
+		NewNatsPublish("a", "a", "", nil),
+		NewRedisSet("a", "a", nil),
+		NewNatsPublish("b", "b", "", nil),
+	)
+
+	discarded, err := Discard(w.db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if discarded != 2 || getPendingCount(t, w.db, "a") != 0 || getPendingCount(t, w.db, "b") != 1 {
+		t.Errorf("expected just the 2 messages for a to have been discarded (discarded %v)", discarded)
+	}
+}
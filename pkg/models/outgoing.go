@@ -0,0 +1,36 @@
+package models
+
+import "github.com/segmentio/ksuid"
+
+// OutgoingEvent is a request for another domain (e.g. notifications) that a writer's handler decided on; the writer
+// publishes it (as a call would, but without waiting on a response) once the request that led to it has been committed
+type OutgoingEvent struct {
+	Name     string // of the other domain
+	EntityID ksuid.KSUID
+	Endpoint string
+	Data     interface{} // the request body (as JSON)
+}
+
+// Outcome is what a writer's handler returns when it has outgoing events as well as its usual result (its state or, for
+// an event sourced writer, its domain events)
+//
+// Outgoing events are only published for a request that was handled; a rejected request has none and a replayed one
+// has had its published already
+type Outcome struct {
+	Result   interface{}
+	Outgoing []OutgoingEvent
+}
+
+// getOutcome returns the result of a handler and its outgoing events (if it returned an Outcome)
+func getOutcome(result interface{}) (interface{}, []OutgoingEvent) {
+	switch outcome := result.(type) {
+	case Outcome:
+		return outcome.Result, outcome.Outgoing
+	case *Outcome:
+		if outcome != nil {
+			return outcome.Result, outcome.Outgoing
+		}
+	}
+
+	return result, nil
+}
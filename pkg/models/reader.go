@@ -2,10 +2,17 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/initialed85/uneventful/pkg/models/events"
 	"github.com/initialed85/uneventful/pkg/models/states"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
 	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
 	"github.com/segmentio/ksuid"
 )
@@ -14,18 +21,30 @@ type Reader interface {
 	lifecycles.Worker
 	Handlers
 	GetState(name string, entityID ksuid.KSUID) (*states.State, error)
+	GetStateForTenant(tenantID string, name string, entityID ksuid.KSUID) (*states.State, error)
+	GetStateAsOf(tenantID string, name string, entityID ksuid.KSUID, asOf calls.AsOf) (*states.State, error)
+	GetStateWithContext(ctx context.Context, tenantID string, name string, entityID ksuid.KSUID) (*states.State, error)
+	GetStateAsOfWithContext(ctx context.Context, tenantID string, name string, entityID ksuid.KSUID, asOf calls.AsOf) (*states.State, error)
 }
 
 type ReaderImplementation struct {
 	lifecycles.Worker
 	Handlers
-	redisWorker *redis_worker.Worker
+	redisWorker redis_worker.Worker
+	natsWorker  nats_worker.Worker
+	codec       codecs.Codec
+	name        string
 }
 
 func NewReader(name string) *ReaderImplementation {
 	name = fmt.Sprintf("reader_%v", name)
 
-	r := ReaderImplementation{Handlers: NewHandlers(), redisWorker: redis_worker.New(name)}
+	r := ReaderImplementation{
+		Handlers:    NewHandlers(),
+		redisWorker: dependencies.Get().NewRedisWorker(name),
+		natsWorker:  dependencies.Get().NewNatsWorker(name),
+		name:        name,
+	}
 
 	r.Worker = lifecycles.NewLazyWorker(name, r.setup, r.teardown)
 
@@ -33,22 +52,41 @@ func NewReader(name string) *ReaderImplementation {
 }
 
 func (r *ReaderImplementation) setup() (err error) {
-	return lifecycles.Setup(r.redisWorker)
+	r.codec, err = codecs.GetDefault()
+	if err != nil {
+		return err
+	}
+
+	return lifecycles.Setup(r.redisWorker, r.natsWorker)
 }
 
 func (r *ReaderImplementation) teardown() (err error) {
-	return lifecycles.Teardown(r.redisWorker)
+	return lifecycles.Teardown(r.natsWorker, r.redisWorker)
 }
 
+// GetState is as per GetStateForTenant, for the default tenant
 func (r *ReaderImplementation) GetState(name string, entityID ksuid.KSUID) (*states.State, error) {
+	return r.GetStateForTenant(tenants.DefaultTenantID, name, entityID)
+}
+
+func (r *ReaderImplementation) GetStateForTenant(tenantID string, name string, entityID ksuid.KSUID) (*states.State, error) {
+	return r.GetStateWithContext(context.Background(), tenantID, name, entityID)
+}
+
+func (r *ReaderImplementation) GetStateWithContext(ctx context.Context, tenantID string, name string, entityID ksuid.KSUID) (*states.State, error) {
+	err := tenants.Validate(tenantID, false)
+	if err != nil {
+		return nil, err
+	}
+
 	redisClient, err := r.redisWorker.GetRedisClient()
 	if err != nil {
 		return nil, err
 	}
 
-	key := fmt.Sprintf("%v.%v", name, entityID.String())
+	key := tenants.GetName(tenantID, fmt.Sprintf("%v.%v", name, entityID.String()))
 
-	stringData, err := redisClient.Get(context.Background(), key).Result()
+	stringData, err := redisClient.Get(ctx, key).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -58,5 +96,81 @@ func (r *ReaderImplementation) GetState(name string, entityID ksuid.KSUID) (*sta
 		return nil, err
 	}
 
+	if state.TenantID != tenantID {
+		return nil, fmt.Errorf("state for tenant_id=%#+v at key=%#+v for tenant_id=%#+v", state.TenantID, key, tenantID)
+	}
+
 	return state, nil
 }
+
+// GetStateAsOf asks the writer for the entity to rebuild its state as of the given point in its stream (the current
+// state, as per GetState, is left alone)
+func (r *ReaderImplementation) GetStateAsOf(tenantID string, name string, entityID ksuid.KSUID, asOf calls.AsOf) (*states.State, error) {
+	return r.GetStateAsOfWithContext(context.Background(), tenantID, name, entityID, asOf)
+}
+
+// GetStateAsOfWithContext is as per GetStateAsOf, but gives up (as does the writer) when the context is cancelled or
+// reaches its deadline
+func (r *ReaderImplementation) GetStateAsOfWithContext(ctx context.Context, tenantID string, name string, entityID ksuid.KSUID, asOf calls.AsOf) (*states.State, error) {
+	err := tenants.Validate(tenantID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	natsConn, err := r.natsWorker.GetNatsConn()
+	if err != nil {
+		return nil, err
+	}
+
+	asOfJSON, err := asOf.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	address := fmt.Sprintf("%v.%v", name, entityID.String())
+
+	event := events.NewWithoutCorrelation(fmt.Sprintf("%v.state", address), asOfJSON)
+	event.SetSource(r.name, ksuid.Nil)
+	event.TenantID = tenantID
+
+	requestMsg, err := newMsg(tenants.GetName(tenantID, getStateSubject(address)), event, r.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx, stateRequestTimeout)
+	defer cancel()
+
+	setTimeoutHeader(requestMsg, ctx)
+
+	msg, err := natsConn.RequestMsgWithContext(ctx, requestMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// as for CallWithContext
+	err = getContextErr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	responseEvent, _, err := decodeMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if responseEvent.TenantID != tenantID {
+		return nil, fmt.Errorf("response for tenant_id=%#+v to a state request for tenant_id=%#+v", responseEvent.TenantID, tenantID)
+	}
+
+	response, err := calls.ResponseFromJSON(responseEvent.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	return states.FromJSON(response.Data)
+}
@@ -0,0 +1,76 @@
+package states
+
+import (
+	"time"
+
+	"github.com/jackc/pgtype"
+	"gorm.io/gorm"
+)
+
+// ArchivedState is a flat (and lossless) copy of a DatabaseState that can be written out as JSONL or Parquet
+type ArchivedState struct {
+	CreatedAt time.Time  `json:"created_at" parquet:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" parquet:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at" parquet:"deleted_at,optional"`
+	VersionID uint64     `json:"version_id" parquet:"version_id"`
+	Sequence  int64      `json:"sequence" parquet:"sequence"`
+	Timestamp time.Time  `json:"timestamp" parquet:"timestamp"`
+	Name      string     `json:"name" parquet:"name"`
+	TenantID  string     `json:"tenant_id" parquet:"tenant_id"`
+	EntityID  string     `json:"entity_id" parquet:"entity_id"`
+	Data      string     `json:"data" parquet:"data"`
+}
+
+func (d *DatabaseState) ToArchivedState() ArchivedState {
+	var deletedAt *time.Time
+	if d.DeletedAt.Valid {
+		deletedAt = &d.DeletedAt.Time
+	}
+
+	data := ""
+	if d.Data.Status == pgtype.Present {
+		data = string(d.Data.Bytes)
+	}
+
+	return ArchivedState{
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+		DeletedAt: deletedAt,
+		VersionID: d.VersionID,
+		Sequence:  d.Sequence,
+		Timestamp: d.Timestamp,
+		Name:      d.Name,
+		TenantID:  d.TenantID,
+		EntityID:  d.EntityID,
+		Data:      data,
+	}
+}
+
+func (a *ArchivedState) ToDatabaseState() (*DatabaseState, error) {
+	data := pgtype.JSONB{Status: pgtype.Null}
+
+	if a.Data != "" {
+		err := data.Scan([]byte(a.Data))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deletedAt := gorm.DeletedAt{}
+	if a.DeletedAt != nil {
+		deletedAt = gorm.DeletedAt{Time: *a.DeletedAt, Valid: true}
+	}
+
+	return &DatabaseState{
+		CreatedAt: a.CreatedAt,
+		UpdatedAt: a.UpdatedAt,
+		DeletedAt: deletedAt,
+		VersionID: a.VersionID,
+		Sequence:  a.Sequence,
+		Timestamp: a.Timestamp,
+		Name:      a.Name,
+		TenantID:  a.TenantID,
+		EntityID:  a.EntityID,
+		Data:      data,
+	}, nil
+}
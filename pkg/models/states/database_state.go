@@ -1,11 +1,11 @@
 package states
 
 import (
-	"fmt"
+	"errors"
 	"time"
 
-	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/jackc/pgtype"
+	"github.com/segmentio/ksuid"
 	"gorm.io/gorm"
 )
 
@@ -14,8 +14,10 @@ type DatabaseState struct {
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 	VersionID uint64         `gorm:"autoIncrement"` // unique
+	Sequence  int64          `gorm:"index"`         // the last event sequence this state covers
 	Timestamp time.Time      `gorm:"index"`
 	Name      string         `gorm:"index"`
+	TenantID  string         `gorm:"index;not null;default:''"`
 	EntityID  string         `gorm:"index"`
 	Data      pgtype.JSONB   `gorm:"type:jsonb"`
 }
@@ -42,34 +44,53 @@ func (d *DatabaseState) Delete(givenDB *gorm.DB) (*gorm.DB, error) {
 	return returnedDB, returnedDB.Error
 }
 
-func Migrate(db *gorm.DB) error {
-	var err error
-
-	err = db.AutoMigrate(&DatabaseState{})
+func (d *DatabaseState) ToState() (*State, error) {
+	entityID, err := ksuid.Parse(d.EntityID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	db.Exec(fmt.Sprintf(createUniqueIndexSQL, tableName))
+	return &State{VersionID: d.VersionID, Sequence: d.Sequence, Timestamp: d.Timestamp, Name: d.Name, TenantID: d.TenantID, EntityID: entityID, Data: d.Data.Bytes}, nil
+}
 
-	db.Exec(fmt.Sprintf(createUniqueIndexSQL, tableName))
+func GetAll(db *gorm.DB) ([]*DatabaseState, error) {
+	rows := make([]*DatabaseState, 0)
 
-	useSQLite, err := helpers.GetEnvironmentVariable("USE_SQLITE", false, "0")
-	if err != nil {
-		return err
-	}
+	returnedDB := db.Find(&rows)
+
+	return rows, returnedDB.Error
+}
 
-	if useSQLite != "1" {
-		db.Exec(fmt.Sprintf(createdHypertableSQL, tableName))
+func getLatest(query *gorm.DB) (*DatabaseState, error) {
+	row := DatabaseState{}
+
+	returnedDB := query.Order("sequence DESC").Order("created_at DESC").Take(&row)
+	if returnedDB.Error != nil {
+		if errors.Is(returnedDB.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, returnedDB.Error
 	}
 
-	return nil
+	return &row, nil
 }
 
-func GetAll(db *gorm.DB) ([]*DatabaseState, error) {
-	rows := make([]*DatabaseState, 0)
+// GetLatest returns the most recent snapshot for the given name (or nil if there isn't one yet)
+func GetLatest(db *gorm.DB, name string) (*DatabaseState, error) {
+	return getLatest(db.Where("name = ?", name))
+}
 
-	returnedDB := db.Find(&rows)
+// GetLatestAt returns the most recent snapshot for the given name that covers no more than the given sequence (or nil
+// if there isn't one)
+func GetLatestAt(db *gorm.DB, name string, sequence int64) (*DatabaseState, error) {
+	return getLatest(db.Where("name = ? AND sequence <= ?", name, sequence))
+}
 
-	return rows, returnedDB.Error
+// Purge permanently deletes every snapshot for the given name (e.g. because the events they were built from have been
+// shredded)
+func Purge(db *gorm.DB, name string) (int64, error) {
+	returnedDB := db.Unscoped().Where("name = ?", name).Delete(&DatabaseState{})
+
+	return returnedDB.RowsAffected, returnedDB.Error
 }
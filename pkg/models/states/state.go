@@ -6,14 +6,17 @@ import (
 	"time"
 
 	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/jackc/pgtype"
 	"github.com/segmentio/ksuid"
 )
 
 type State struct {
 	VersionID uint64          `json:"version_id"`
+	Sequence  int64           `json:"sequence"`
 	Timestamp time.Time       `json:"timestamp"`
 	Name      string          `json:"name"`
+	TenantID  string          `json:"tenant_id,omitempty"`
 	EntityID  ksuid.KSUID     `json:"entity_id"`
 	Data      json.RawMessage `json:"data"`
 }
@@ -26,14 +29,19 @@ func FromJSON(data []byte) (*State, error) {
 	return &s, err
 }
 
+// New is as per NewForTenant, for the default tenant
 func New(name string, entityID ksuid.KSUID, data json.RawMessage) *State {
-	s := State{Timestamp: helpers.GetNow(), Name: name, EntityID: entityID, Data: data}
+	return NewForTenant(name, tenants.DefaultTenantID, entityID, data)
+}
+
+func NewForTenant(name string, tenantID string, entityID ksuid.KSUID, data json.RawMessage) *State {
+	s := State{Timestamp: helpers.GetNow(), Name: name, TenantID: tenantID, EntityID: entityID, Data: data}
 
 	return &s
 }
 
 func (s *State) String() string {
-	return fmt.Sprintf("State{version=%v, size=%vB}", s.VersionID, len(s.Data))
+	return fmt.Sprintf("State{version=%v, sequence=%v, size=%vB}", s.VersionID, s.Sequence, len(s.Data))
 }
 
 func (s *State) ToJSON() ([]byte, error) {
@@ -47,8 +55,10 @@ func (s *State) FromJSON(data []byte) error {
 	}
 
 	s.VersionID = state.VersionID
+	s.Sequence = state.Sequence
 	s.Timestamp = state.Timestamp
 	s.Name = state.Name
+	s.TenantID = state.TenantID
 	s.EntityID = state.EntityID
 	s.Data = state.Data
 
@@ -68,5 +78,5 @@ func (s *State) ToDatabaseState() (*DatabaseState, error) {
 		return nil, err
 	}
 
-	return &DatabaseState{VersionID: s.VersionID, Timestamp: s.Timestamp, Name: s.Name, EntityID: s.EntityID.String(), Data: jsonbData}, nil
+	return &DatabaseState{VersionID: s.VersionID, Sequence: s.Sequence, Timestamp: s.Timestamp, Name: s.Name, TenantID: s.TenantID, EntityID: s.EntityID.String(), Data: jsonbData}, nil
 }
@@ -0,0 +1,407 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/checkpoints"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+type SubscriptionHandler func(event *events.Event) error
+
+type Subscriber interface {
+	lifecycles.Worker
+	GetPosition() int64
+}
+
+// SubscriberImplementation delivers every (non-rejected) event in an event store whose type name matches a pattern
+// to a handler as it was stored, in position order and at least once; it starts from its checkpoint (reading history
+// from the store), then switches to the events that writers publish once they've stored them, holding on to anything
+// published out of order and only going back to the store for what it's missing if the gap doesn't fill in by itself
+type SubscriberImplementation struct {
+	lifecycles.Worker
+	name           string
+	tenantID       string
+	pattern        string
+	handler        SubscriptionHandler
+	databaseWorker database_worker.Worker
+	natsWorker     nats_worker.Worker
+	storeID        string
+	mu             sync.Mutex
+	position       int64
+	subscriptions  []*nats.Subscription
+	live           chan *nats.Msg
+	pending        map[int64]*events.Event // published past a gap; only touched by run (once it's started)
+	gapSince       time.Time
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+func NewSubscriber(name string, tenantID string, pattern string, handler SubscriptionHandler) *SubscriberImplementation {
+	workerName := fmt.Sprintf("subscriber_%v", name)
+
+	s := SubscriberImplementation{
+		name:           tenants.GetName(tenantID, name),
+		tenantID:       tenantID,
+		pattern:        pattern,
+		handler:        handler,
+		databaseWorker: dependencies.Get().NewDatabaseWorker(workerName),
+		natsWorker:     dependencies.Get().NewNatsWorker(workerName),
+	}
+
+	s.Worker = lifecycles.NewLazyWorker(workerName, s.setup, s.teardown)
+
+	return &s
+}
+
+func (s *SubscriberImplementation) setup() (err error) {
+	err = tenants.Validate(s.tenantID, true)
+	if err != nil {
+		return err
+	}
+
+	err = lifecycles.Setup(s.databaseWorker, s.natsWorker)
+	if err != nil {
+		return err
+	}
+
+	db, err := s.databaseWorker.GetDB()
+	if err != nil {
+		_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+		return err
+	}
+
+	err = migrations.Migrate(db)
+	if err != nil {
+		_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+		return err
+	}
+
+	s.storeID, err = events.NewEventStore(db).GetStoreID()
+	if err != nil {
+		_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+		return err
+	}
+
+	position, err := checkpoints.Get(db, s.name, s.storeID)
+	if err != nil {
+		_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+		return err
+	}
+
+	s.setPosition(position)
+
+	natsConn, err := s.natsWorker.GetNatsConn()
+	if err != nil {
+		_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+		return err
+	}
+
+	// subscribe before catching up so that nothing stored in the meantime is missed (anything seen twice is skipped)
+	s.live = make(chan *nats.Msg, subscriberBufferSize)
+	s.pending = make(map[int64]*events.Event)
+	s.gapSince = time.Time{}
+
+	for _, subject := range tenants.GetSubjects(s.tenantID, events.GetStoredSubject(s.storeID, ">")) {
+		var subscription *nats.Subscription
+
+		subscription, err = natsConn.ChanSubscribe(subject, s.live)
+		if err != nil {
+			s.unsubscribe()
+			_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+			return err
+		}
+
+		s.subscriptions = append(s.subscriptions, subscription)
+	}
+
+	// make sure the server has our subscriptions before we read from the store
+	err = natsConn.Flush()
+	if err != nil {
+		s.unsubscribe()
+		_ = lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+		return err
+	}
+
+	log.Printf("%v - catching up from position=%v", s.name, position)
+
+	// a handler that fails here (or a database that's briefly unavailable) is no reason not to start; we go live
+	// from wherever we got to and try again on the next poll
+	err = s.catchUp(db)
+	if err != nil {
+		log.Printf("%v - warning: failed to catch up (will try again): %v", s.name, err)
+		err = nil
+	}
+
+	log.Printf("%v - caught up to position=%v; now live", s.name, s.GetPosition())
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.run(db)
+
+	return nil
+}
+
+func (s *SubscriberImplementation) teardown() (err error) {
+	close(s.stop)
+	<-s.done
+
+	s.unsubscribe()
+
+	return lifecycles.Teardown(s.natsWorker, s.databaseWorker)
+}
+
+func (s *SubscriberImplementation) unsubscribe() {
+	for _, subscription := range s.subscriptions {
+		_ = subscription.Unsubscribe()
+	}
+
+	s.subscriptions = nil
+}
+
+func (s *SubscriberImplementation) GetPosition() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.position
+}
+
+func (s *SubscriberImplementation) setPosition(position int64) {
+	s.mu.Lock()
+	s.position = position
+	s.mu.Unlock()
+}
+
+func (s *SubscriberImplementation) run(db *gorm.DB) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(subscriberPollPeriod)
+	defer ticker.Stop()
+
+	gapTicker := time.NewTicker(subscriberGapTimeout)
+	defer gapTicker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-s.stop:
+			return
+		case msg := <-s.live:
+			err = s.handleLive(db, msg)
+		case <-gapTicker.C:
+			if len(s.pending) > 0 {
+				err = s.handlePending(db)
+			}
+		case <-ticker.C:
+			// in case whatever was stored wasn't published (or a handler failed)
+			err = s.catchUp(db)
+			if err == nil {
+				err = s.handlePending(db)
+			}
+		}
+
+		if err != nil {
+			log.Printf("%v - warning: %v", s.name, err)
+		}
+	}
+}
+
+// deliver hands the event to the handler (if it matches) and moves past it; if the handler fails we stay put and the
+// event is delivered again the next time we catch up
+func (s *SubscriberImplementation) deliver(event *events.Event) error {
+	if tenants.Matches(s.tenantID, event.TenantID) && events.MatchTypeName(s.pattern, event.TypeName) {
+		err := s.handler(event)
+		if err != nil {
+			return fmt.Errorf("failed to handle position=%v event_id=%v: %v", event.Position, event.EventID, err)
+		}
+	}
+
+	s.setPosition(event.Position)
+
+	return nil
+}
+
+func (s *SubscriberImplementation) checkpoint(db *gorm.DB) error {
+	return checkpoints.Save(db, s.name, s.storeID, s.GetPosition())
+}
+
+// catchUp delivers everything stored since our position from the store itself
+func (s *SubscriberImplementation) catchUp(db *gorm.DB) error {
+	before := s.GetPosition()
+
+	head, err := events.NewEventStore(db).GetPosition()
+	if err != nil {
+		return err
+	}
+
+	err = s.catchUpTo(db, head)
+
+	if s.GetPosition() != before {
+		checkpointErr := s.checkpoint(db)
+		if checkpointErr != nil && err == nil {
+			err = checkpointErr
+		}
+	}
+
+	return err
+}
+
+// catchUpTo delivers everything stored since our position up to the given (settled) position from the store itself
+func (s *SubscriberImplementation) catchUpTo(db *gorm.DB, until int64) error {
+	before := s.GetPosition()
+
+	if until <= before {
+		return nil
+	}
+
+	var err error
+
+	cursor := events.NewPositionCursor(db, s.tenantID, before, until, replayPageSize)
+	decrypter := events.NewDecrypter(db)
+
+	for cursor.Next() {
+		var event *events.Event
+
+		databaseEvent := cursor.Event()
+
+		err = decrypter.Decrypt(databaseEvent)
+		if errors.Is(err, events.ErrShredded) {
+			log.Printf("%v - skipping shredded event_id=%v position=%v", s.name, databaseEvent.EventID, databaseEvent.Position)
+			err = nil
+			continue
+		}
+
+		if err == nil {
+			event, err = databaseEvent.ToEvent()
+		}
+
+		if err == nil {
+			err = s.deliver(event)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = cursor.Err()
+	}
+
+	// every position up to the given one is settled, so anything we didn't see (e.g. rejected events) can be skipped over
+	if err == nil {
+		s.setPosition(until)
+	}
+
+	return err
+}
+
+func (s *SubscriberImplementation) handleLive(db *gorm.DB, msg *nats.Msg) error {
+	event, _, err := decodeMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	// we've already seen it (e.g. while catching up from the store)
+	if event.Position <= s.GetPosition() {
+		return nil
+	}
+
+	s.pending[event.Position] = event
+
+	return s.handlePending(db)
+}
+
+// handlePending delivers whatever we're holding on to that's next in line; if that leaves a gap that's been there for a
+// while (e.g. an event that was rejected, one for another tenant or one published by a slower writer that's yet to
+// arrive) or we're holding on to too much, it goes back to the store for just what's missing
+func (s *SubscriberImplementation) handlePending(db *gorm.DB) error {
+	before := s.GetPosition()
+
+	err := s.deliverPending()
+
+	if err == nil && len(s.pending) > 0 &&
+		(time.Since(s.gapSince) >= subscriberGapTimeout || len(s.pending) >= subscriberBufferSize) {
+		// positions become visible in order, so everything before the earliest event we're holding on to is settled
+		err = s.catchUpTo(db, s.getEarliestPending()-1)
+		if err == nil {
+			err = s.deliverPending()
+		}
+	}
+
+	// it's all in the store, so rather than keep trying we leave it for the next poll
+	if err != nil {
+		s.pending = make(map[int64]*events.Event)
+		s.gapSince = time.Time{}
+	}
+
+	if s.GetPosition() != before {
+		checkpointErr := s.checkpoint(db)
+		if checkpointErr != nil && err == nil {
+			err = checkpointErr
+		}
+	}
+
+	return err
+}
+
+// deliverPending delivers whatever we're holding on to that's next in line and forgets anything we've since seen
+func (s *SubscriberImplementation) deliverPending() error {
+	for {
+		position := s.GetPosition() + 1
+
+		event, ok := s.pending[position]
+		if !ok {
+			break
+		}
+
+		delete(s.pending, position)
+
+		err := s.deliver(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	position := s.GetPosition()
+
+	for pendingPosition := range s.pending {
+		if pendingPosition <= position {
+			delete(s.pending, pendingPosition)
+		}
+	}
+
+	if len(s.pending) == 0 {
+		s.gapSince = time.Time{}
+	} else if s.gapSince.IsZero() {
+		s.gapSince = time.Now()
+	}
+
+	return nil
+}
+
+func (s *SubscriberImplementation) getEarliestPending() int64 {
+	earliest := int64(-1)
+
+	for position := range s.pending {
+		if earliest == -1 || position < earliest {
+			earliest = position
+		}
+	}
+
+	return earliest
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/segmentio/ksuid"
+)
+
+type testSubscription struct {
+	mu        sync.Mutex
+	positions []int64
+	failAt    int64 // fails to handle the event at this position (0 for never)
+}
+
+func (s *testSubscription) handle(event *events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.Position == s.failAt {
+		return errors.New("failed on purpose")
+	}
+
+	s.positions = append(s.positions, event.Position)
+
+	return nil
+}
+
+func (s *testSubscription) setFailAt(position int64) {
+	s.mu.Lock()
+	s.failAt = position
+	s.mu.Unlock()
+}
+
+func (s *testSubscription) getPositions() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int64{}, s.positions...)
+}
+
+// setupSubscriberTest brings up a writer whose "add" endpoint is handled and whose "fail" endpoint is rejected (still
+// taking a position) and a caller for it
+func setupSubscriberTest(t *testing.T) func(endpoint string) {
+	t.Helper()
+
+	_ = in_memory.Setup(t)
+
+	entityID := ksuid.New()
+
+	writer := NewWriter("thing", entityID, func() (interface{}, error) { return nil, nil })
+
+	_ = writer.AddHandler("add", func(ksuid.KSUID, interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	_ = writer.AddHandler("fail", func(ksuid.KSUID, interface{}) (interface{}, error) {
+		return nil, errors.New("rejected on purpose")
+	})
+
+	caller := NewCaller("test", ksuid.New())
+
+	in_memory.Start(t, writer, caller)
+
+	return func(endpoint string) {
+		err := caller.Call("thing", entityID, endpoint, []byte(`{}`))
+		if (err != nil) != (endpoint == "fail") {
+			t.Fatalf("unexpected outcome for endpoint=%v: %v", endpoint, err)
+		}
+	}
+}
+
+func waitForPosition(t *testing.T, subscriber *SubscriberImplementation, position int64, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+
+	for subscriber.GetPosition() < position {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for position=%v (at position=%v)", position, subscriber.GetPosition())
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	call := setupSubscriberTest(t)
+
+	// history: 1 and 2 are handled, 3 is rejected
+	call("add")
+	call("add")
+	call("fail")
+
+	subscription := testSubscription{}
+	subscriber := NewSubscriber("test", tenants.DefaultTenantID, "thing.*.add", subscription.handle)
+
+	err := subscriber.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = subscriber.Stop()
+	})
+
+	if subscriber.GetPosition() != 3 {
+		t.Errorf("expected to have caught up to position=3, got %v", subscriber.GetPosition())
+	}
+
+	// live: 4 is handled, 5 is rejected (so never published) and 6 is handled; the gap at 5 is filled well before the
+	// subscriber would next poll the store
+	call("add")
+	call("fail")
+	call("add")
+
+	waitForPosition(t, subscriber, 6, subscriberPollPeriod/2)
+
+	expected := []int64{1, 2, 4, 6}
+
+	positions := subscription.getPositions()
+	if len(positions) != len(expected) {
+		t.Fatalf("expected positions=%v, got %v", expected, positions)
+	}
+
+	for i := range expected {
+		if positions[i] != expected[i] {
+			t.Fatalf("expected positions=%v, got %v", expected, positions)
+		}
+	}
+
+	// a new subscriber with the same name carries on from the checkpoint
+	err = subscriber.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call("add")
+
+	resumed := testSubscription{}
+	subscriber = NewSubscriber("test", tenants.DefaultTenantID, "thing.*.add", resumed.handle)
+
+	err = subscriber.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions = resumed.getPositions()
+	if len(positions) != 1 || positions[0] != 7 {
+		t.Errorf("expected to resume with just position=7, got %v", positions)
+	}
+}
+
+func TestSubscriberFailingHandler(t *testing.T) {
+	call := setupSubscriberTest(t)
+
+	call("add")
+	call("add")
+
+	subscription := testSubscription{failAt: 2}
+	subscriber := NewSubscriber("test", tenants.DefaultTenantID, ">", subscription.handle)
+
+	// failing while catching up is no reason not to start
+	err := subscriber.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = subscriber.Stop()
+	})
+
+	if subscriber.GetPosition() != 1 {
+		t.Errorf("expected to have stopped short at position=1, got %v", subscriber.GetPosition())
+	}
+
+	// nothing gets past the event that failed
+	call("add")
+
+	time.Sleep(subscriberGapTimeout * 4)
+
+	if subscriber.GetPosition() != 1 {
+		t.Errorf("expected to still be at position=1, got %v", subscriber.GetPosition())
+	}
+
+	// until it's handled on a later attempt
+	subscription.setFailAt(0)
+
+	waitForPosition(t, subscriber, 3, subscriberPollPeriod*2)
+
+	positions := subscription.getPositions()
+	if len(positions) != 3 || positions[1] != 2 || positions[2] != 3 {
+		t.Errorf("expected positions=[1 2 3], got %v", positions)
+	}
+}
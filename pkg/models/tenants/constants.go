@@ -0,0 +1,8 @@
+package tenants
+
+const (
+	DefaultTenantID = ""            // i.e. a single-tenant deployment (nothing is namespaced)
+	AnyTenantID     = "*"           // only for things that span tenants (e.g. the history writer)
+	HTTPHeader      = "X-Tenant-ID" // where the domain servers take the tenant from
+	prefix          = "tenant"
+)
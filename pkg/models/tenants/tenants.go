@@ -0,0 +1,79 @@
+package tenants
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate returns an error if the tenant ID can't be used to namespace subjects, streams and keys (or, unless
+// allowAny is set, if it's the wildcard for any tenant)
+func Validate(tenantID string, allowAny bool) error {
+	if tenantID == DefaultTenantID {
+		return nil
+	}
+
+	if tenantID == AnyTenantID {
+		if !allowAny {
+			return fmt.Errorf("tenant_id=%#+v (any tenant) isn't permitted here", tenantID)
+		}
+
+		return nil
+	}
+
+	if !tenantIDPattern.MatchString(tenantID) {
+		return fmt.Errorf("tenant_id=%#+v must only contain letters, digits, '_' and '-'", tenantID)
+	}
+
+	return nil
+}
+
+// GetTenantID returns the tenant this service is for (per TENANT_ID)
+func GetTenantID() (string, error) {
+	tenantID, err := helpers.GetEnvironmentVariable("TENANT_ID", false, DefaultTenantID)
+	if err != nil {
+		return "", err
+	}
+
+	return tenantID, Validate(tenantID, true)
+}
+
+// GetName namespaces a name (e.g. a NATS subject, a stream ID or a Redis key) to a tenant; names for the default
+// tenant aren't namespaced at all
+func GetName(tenantID string, name string) string {
+	if tenantID == DefaultTenantID {
+		return name
+	}
+
+	return fmt.Sprintf("%v.%v.%v", prefix, tenantID, name)
+}
+
+// GetSubjects returns the NATS subjects to subscribe to for a tenant; any tenant means the default tenant's subject
+// as well as every other tenant's
+func GetSubjects(tenantID string, subject string) []string {
+	if tenantID == AnyTenantID {
+		return []string{subject, GetName(AnyTenantID, subject)}
+	}
+
+	return []string{GetName(tenantID, subject)}
+}
+
+// FromName returns the tenant a name was namespaced to (and the name without the namespace)
+func FromName(name string) (string, string) {
+	parts := strings.SplitN(name, ".", 3)
+
+	if len(parts) < 3 || parts[0] != prefix {
+		return DefaultTenantID, name
+	}
+
+	return parts[1], parts[2]
+}
+
+// Matches returns true if something for the given tenant is permitted to see something for the other tenant
+func Matches(tenantID string, otherTenantID string) bool {
+	return tenantID == AnyTenantID || tenantID == otherTenantID
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/events"
+)
+
+// NewRequestDataUpcaster adapts an upcaster for the data of a request (e.g. the body of a credit) into one for the
+// event that carries that request
+func NewRequestDataUpcaster(upcaster events.Upcaster) events.Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		request, err := calls.RequestFromJSON(data)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Data, err = upcaster(request.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		return request.ToJSON()
+	}
+}
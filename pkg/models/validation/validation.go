@@ -0,0 +1,235 @@
+// Package validation checks request bodies against a small subset of go-playground/validator's tag syntax (same
+// rule names and meanings, so moving over to it means swapping out Validate); rather than pull that in for the handful
+// of rules handlers need, this keeps the errors in our own shape (naming fields as they're named in JSON) so they can
+// go back over NATS and out as HTTP responses as they are
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Error is a field that failed a rule (the field is named as it is in JSON)
+type Error struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Errors is every field that failed a rule
+type Errors []Error
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+
+	for _, err := range e {
+		messages = append(messages, err.Message)
+	}
+
+	return fmt.Sprintf("validation failed: %v", strings.Join(messages, "; "))
+}
+
+func getFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+
+	return name
+}
+
+func isFlattened(field reflect.StructField) bool {
+	if !field.Anonymous || !field.IsExported() || field.Tag.Get("json") != "" {
+		return false
+	}
+
+	fieldType := field.Type
+	if fieldType.Kind() == reflect.Pointer {
+		fieldType = fieldType.Elem()
+	}
+
+	return fieldType.Kind() == reflect.Struct
+}
+
+// getSize is what the ordering rules compare against; the value of a number or the length of anything else
+func getSize(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len()), true
+	}
+
+	return 0, false
+}
+
+func check(name string, value reflect.Value, rule string, param string) (*Error, error) {
+	failed := func(format string, args ...interface{}) (*Error, error) {
+		return &Error{Field: name, Rule: rule, Message: fmt.Sprintf("%v %v", name, fmt.Sprintf(format, args...))}, nil
+	}
+
+	if rule == "required" {
+		if value.IsZero() {
+			return failed("is required")
+		}
+
+		return nil, nil
+	}
+
+	// the rest of the rules are about what a pointer points to; one that points to nothing wasn't given at all (which
+	// is up to required)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil, nil
+		}
+
+		value = value.Elem()
+	}
+
+	switch rule {
+	case "oneof":
+		options := strings.Fields(param)
+
+		for _, option := range options {
+			if fmt.Sprint(value.Interface()) == option {
+				return nil, nil
+			}
+		}
+
+		return failed("must be one of %v", options)
+	case "gt", "gte", "lt", "lte":
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v has an invalid %v=%#+v", name, rule, param)
+		}
+
+		size, ok := getSize(value)
+		if !ok {
+			return nil, fmt.Errorf("%v can't have %v (it's a %v)", name, rule, value.Kind())
+		}
+
+		switch {
+		case rule == "gt" && !(size > limit):
+			return failed("must be greater than %v", param)
+		case rule == "gte" && !(size >= limit):
+			return failed("must be at least %v", param)
+		case rule == "lt" && !(size < limit):
+			return failed("must be less than %v", param)
+		case rule == "lte" && !(size <= limit):
+			return failed("must be at most %v", param)
+		}
+
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("%v has an unknown validation rule=%#+v", name, rule)
+}
+
+func validate(prefix string, value reflect.Value, validationErrors *Errors) error {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil
+		}
+
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+
+		// JSON flattens an embedded struct (unless it's named), so its fields are named as if they were ours
+		if isFlattened(field) {
+			err := validate(prefix, value.Field(i), validationErrors)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+
+		name := prefix + getFieldName(field)
+
+		for _, rawRule := range strings.Split(field.Tag.Get("validate"), ",") {
+			rawRule = strings.TrimSpace(rawRule)
+			if rawRule == "" {
+				continue
+			}
+
+			rule, param, _ := strings.Cut(rawRule, "=")
+
+			validationError, err := check(name, value.Field(i), rule, param)
+			if err != nil {
+				return err
+			}
+
+			// the rest of the rules for a field that's missing would only say the same thing again
+			if validationError != nil {
+				*validationErrors = append(*validationErrors, *validationError)
+				break
+			}
+		}
+
+		err := validate(name+".", value.Field(i), validationErrors)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the rules in the validate tags of the given struct's fields (e.g. `validate:"required,gt=0"`),
+// including those of any nested structs; it returns Errors if any field fails a rule
+//
+// The rules are required (not the zero value), oneof=[space-separated options] and gt, gte, lt and lte=[number]
+// (against the value of a number or the length of a string, slice or map); all but required pass a nil pointer
+func Validate(v interface{}) error {
+	validationErrors := make(Errors, 0)
+
+	err := validate("", reflect.ValueOf(v), &validationErrors)
+	if err != nil {
+		return err
+	}
+
+	if len(validationErrors) > 0 {
+		return validationErrors
+	}
+
+	return nil
+}
+
+// FromDecodeError returns Errors for a JSON decoding error that's down to what was sent (e.g. a string where a number
+// should be) and the error itself for anything else
+func FromDecodeError(err error) error {
+	var unmarshalTypeError *json.UnmarshalTypeError
+	if errors.As(err, &unmarshalTypeError) {
+		return Errors{{
+			Field:   unmarshalTypeError.Field,
+			Rule:    "type",
+			Message: fmt.Sprintf("%v must be a %v (not a %v)", unmarshalTypeError.Field, unmarshalTypeError.Type.Kind(), unmarshalTypeError.Value),
+		}}
+	}
+
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		return Errors{{Rule: "json", Message: fmt.Sprintf("body is not valid JSON: %v", syntaxError)}}
+	}
+
+	return err
+}
@@ -0,0 +1,237 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type Base struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type Inner struct {
+	Count int `json:"count" validate:"gte=1"`
+}
+
+func getFields(t *testing.T, err error) []string {
+	t.Helper()
+
+	if err == nil {
+		return nil
+	}
+
+	var validationErrors Errors
+	if !errors.As(err, &validationErrors) {
+		t.Fatalf("expected Errors, got %#+v", err)
+	}
+
+	fields := make([]string, 0, len(validationErrors))
+
+	for _, validationError := range validationErrors {
+		fields = append(fields, validationError.Field+":"+validationError.Rule)
+	}
+
+	return fields
+}
+
+func TestValidate(t *testing.T) {
+	one := 1.0
+	zero := 0.0
+
+	cases := []struct {
+		name   string
+		value  interface{}
+		fields []string
+	}{
+		{
+			name: "required given",
+			value: struct {
+				Amount float64 `json:"amount" validate:"required"`
+			}{Amount: 1},
+		},
+		{
+			name: "required missing",
+			value: struct {
+				Amount float64 `json:"amount" validate:"required"`
+			}{},
+			fields: []string{"amount:required"},
+		},
+		{
+			name: "field named as per json",
+			value: struct {
+				Amount float64 `json:"the_amount,omitempty" validate:"required"`
+			}{},
+			fields: []string{"the_amount:required"},
+		},
+		{
+			name: "field without a json name",
+			value: struct {
+				Amount float64 `validate:"required"`
+			}{},
+			fields: []string{"Amount:required"},
+		},
+		{
+			name: "only the first failing rule",
+			value: struct {
+				Amount float64 `json:"amount" validate:"required,gt=0"`
+			}{},
+			fields: []string{"amount:required"},
+		},
+		{
+			name: "spaces around rules",
+			value: struct {
+				Amount float64 `json:"amount" validate:" required , gt=1 "`
+			}{Amount: 1},
+			fields: []string{"amount:gt"},
+		},
+		{
+			name: "gt",
+			value: struct {
+				A int     `json:"a" validate:"gt=1"`
+				B int     `json:"b" validate:"gt=1"`
+				C float64 `json:"c" validate:"gt=0.5"`
+			}{A: 1, B: 2, C: 0.5},
+			fields: []string{"a:gt", "c:gt"},
+		},
+		{
+			name: "gte, lt and lte",
+			value: struct {
+				A uint `json:"a" validate:"gte=2"`
+				B int  `json:"b" validate:"lt=2"`
+				C int  `json:"c" validate:"lte=2"`
+				D int  `json:"d" validate:"gte=2,lte=2"`
+			}{A: 1, B: 2, C: 3, D: 2},
+			fields: []string{"a:gte", "b:lt", "c:lte"},
+		},
+		{
+			name: "lengths",
+			value: struct {
+				S string         `json:"s" validate:"lte=3"`
+				L []int          `json:"l" validate:"gte=1"`
+				M map[string]int `json:"m" validate:"lt=1"`
+			}{S: "four", M: map[string]int{"a": 1}},
+			fields: []string{"s:lte", "l:gte", "m:lt"},
+		},
+		{
+			name: "oneof",
+			value: struct {
+				A string `json:"a" validate:"oneof=credit debit"`
+				B string `json:"b" validate:"oneof=credit debit"`
+				C int    `json:"c" validate:"oneof=1 2"`
+			}{A: "debit", B: "refund", C: 2},
+			fields: []string{"b:oneof"},
+		},
+		{
+			name: "pointers",
+			value: struct {
+				A *float64 `json:"a" validate:"required"`
+				B *float64 `json:"b" validate:"gt=0"`
+				C *float64 `json:"c" validate:"gt=0"`
+				D *float64 `json:"d" validate:"required,gt=0"`
+			}{C: &zero, D: &one},
+			fields: []string{"a:required", "c:gt"},
+		},
+		{
+			name: "nested",
+			value: struct {
+				Inner  Inner  `json:"inner"`
+				Nested *Inner `json:"nested"`
+				Absent *Inner `json:"absent"`
+			}{Nested: &Inner{Count: 1}},
+			fields: []string{"inner.count:gte"},
+		},
+		{
+			name: "embedded",
+			value: struct {
+				Base
+				Named Base `json:"named"`
+			}{},
+			fields: []string{"name:required", "named.name:required"},
+		},
+		{
+			name: "skipped",
+			value: struct {
+				Ignored    string `json:"-" validate:"required"`
+				unexported string `validate:"required"`
+			}{},
+		},
+		{
+			name:  "not a struct",
+			value: map[string]interface{}{"amount": 0},
+		},
+		{
+			name:  "nil",
+			value: nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fields := getFields(t, Validate(c.value))
+
+			if !reflect.DeepEqual(fields, c.fields) {
+				t.Errorf("expected %v, got %v", c.fields, fields)
+			}
+		})
+	}
+}
+
+func TestValidateBadTags(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{
+			name: "unknown rule",
+			value: struct {
+				A int `json:"a" validate:"positive"`
+			}{},
+		},
+		{
+			name: "bad limit",
+			value: struct {
+				A int `json:"a" validate:"gt=one"`
+			}{},
+		},
+		{
+			name: "limit on something without a size",
+			value: struct {
+				A bool `json:"a" validate:"gt=0"`
+			}{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := Validate(c.value)
+
+			var validationErrors Errors
+			if err == nil || errors.As(err, &validationErrors) {
+				t.Errorf("expected a (non-validation) error, got %#+v", err)
+			}
+		})
+	}
+}
+
+func TestFromDecodeError(t *testing.T) {
+	var body struct {
+		Amount float64 `json:"amount"`
+	}
+
+	fields := getFields(t, FromDecodeError(json.Unmarshal([]byte(`{"amount": "lots"}`), &body)))
+	if !reflect.DeepEqual(fields, []string{"amount:type"}) {
+		t.Errorf("expected [amount:type], got %v", fields)
+	}
+
+	fields = getFields(t, FromDecodeError(json.Unmarshal([]byte(`{"amount": `), &body)))
+	if !reflect.DeepEqual(fields, []string{":json"}) {
+		t.Errorf("expected [:json], got %v", fields)
+	}
+
+	other := errors.New("something else")
+	if FromDecodeError(other) != other {
+		t.Errorf("expected the error itself")
+	}
+}
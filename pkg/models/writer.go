@@ -3,47 +3,80 @@ package models
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/initialed85/uneventful/internal/helpers"
 	"github.com/initialed85/uneventful/pkg/lifecycles"
 	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/codecs"
 	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/outbox"
 	"github.com/initialed85/uneventful/pkg/models/states"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
 	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
 	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
 	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
 	"github.com/nats-io/nats.go"
 	"github.com/segmentio/ksuid"
+	"gorm.io/gorm"
 )
 
 type Writer interface {
 	lifecycles.Worker
 	Handlers
+	events.Upcasters
 	SetState(data json.RawMessage) (err error)
+	SetStateWithContext(ctx context.Context, data json.RawMessage) (err error)
+	SetAggregateFactory(newAggregate func() *Aggregate)
+	SetEvolvers(evolvers Evolvers)
 }
 
 type WriterImplementation struct {
 	lifecycles.Worker
 	Handlers
-	databaseWorker       *database_worker.Worker
-	redisWorker          *redis_worker.Worker
-	natsWorker           *nats_worker.Worker
+	events.Upcasters
+	databaseWorker       database_worker.Worker
+	redisWorker          redis_worker.Worker
+	natsWorker           nats_worker.Worker
+	eventStore           events.EventStore
+	encryptData          bool
+	hashKey              []byte
+	codec                codecs.Codec
+	storeID              string
+	relay                *outbox.Relay
+	version              int64
 	subject              string
 	queue                string
 	ignoreResponseNeeded bool
 	ignoreEventTypeName  bool
 	handleEvents         bool
-	subscription         *nats.Subscription
-	mu, dbMu             sync.Mutex
+	subscriptions        []*nats.Subscription
+	mu                   sync.Mutex
+	dbMu                 sync.Locker // shared by the writers in a WriterHost on SQLite (which only takes one writer at a time)
+	ownsWorkers          bool        // false for the writers in a WriterHost, which use the host's workers
 	name                 string
+	tenantID             string
+	streamID             string // i.e. the name, namespaced to the tenant
 	entityID             ksuid.KSUID
 	getStateCallback     func() (interface{}, error)
+	restoreStateCallback func(json.RawMessage) error
+	newAggregate         func() *Aggregate // for rebuilding past state; nil if the writer can't
+	evolvers             Evolvers          // nil unless the writer is event sourced (see SetEvolvers)
+	snapshotEvents       int64
+	snapshotInterval     time.Duration
+	eventsSinceSnapshot  int64
+	lastSnapshotAt       time.Time
 }
 
+// NewWriterWithOverrides is as per NewWriterForTenantWithOverrides, for the default tenant and without a callback to
+// restore state from a snapshot (so the writer always replays its whole stream)
 func NewWriterWithOverrides(
 	name string,
 	entityID ksuid.KSUID,
@@ -53,40 +86,129 @@ func NewWriterWithOverrides(
 	ignoreResponseNeeded bool,
 	ignoreEventTypeName bool,
 	handleEvents bool,
+) *WriterImplementation {
+	return NewWriterForTenantWithOverrides(
+		name,
+		tenants.DefaultTenantID,
+		entityID,
+		getStateCallback,
+		nil,
+		subject,
+		queue,
+		ignoreResponseNeeded,
+		ignoreEventTypeName,
+		handleEvents,
+	)
+}
+
+func NewWriterForTenantWithOverrides(
+	name string,
+	tenantID string,
+	entityID ksuid.KSUID,
+	getStateCallback func() (interface{}, error),
+	restoreStateCallback func(json.RawMessage) error,
+	subject string,
+	queue string,
+	ignoreResponseNeeded bool,
+	ignoreEventTypeName bool,
+	handleEvents bool,
+) *WriterImplementation {
+	workerName := fmt.Sprintf("writer_%v", name)
+
+	return newWriter(
+		name,
+		tenantID,
+		entityID,
+		getStateCallback,
+		restoreStateCallback,
+		subject,
+		queue,
+		ignoreResponseNeeded,
+		ignoreEventTypeName,
+		handleEvents,
+		dependencies.Get().NewDatabaseWorker(workerName),
+		dependencies.Get().NewRedisWorker(workerName),
+		dependencies.Get().NewNatsWorker(workerName),
+		&sync.Mutex{},
+		true,
+	)
+}
+
+func newWriter(
+	name string,
+	tenantID string,
+	entityID ksuid.KSUID,
+	getStateCallback func() (interface{}, error),
+	restoreStateCallback func(json.RawMessage) error,
+	subject string,
+	queue string,
+	ignoreResponseNeeded bool,
+	ignoreEventTypeName bool,
+	handleEvents bool,
+	databaseWorker database_worker.Worker,
+	redisWorker redis_worker.Worker,
+	natsWorker nats_worker.Worker,
+	dbMu sync.Locker,
+	ownsWorkers bool,
 ) *WriterImplementation {
 	workerName := fmt.Sprintf("writer_%v", name)
 
 	w := WriterImplementation{
 		Handlers:             NewHandlers(),
-		databaseWorker:       database_worker.New(workerName),
-		redisWorker:          redis_worker.New(workerName),
-		natsWorker:           nats_worker.New(workerName),
+		Upcasters:            events.NewUpcasters(),
+		databaseWorker:       databaseWorker,
+		redisWorker:          redisWorker,
+		natsWorker:           natsWorker,
+		dbMu:                 dbMu,
+		ownsWorkers:          ownsWorkers,
 		subject:              subject,
 		queue:                queue,
 		ignoreResponseNeeded: ignoreResponseNeeded,
 		ignoreEventTypeName:  ignoreEventTypeName,
 		handleEvents:         handleEvents,
 		name:                 name,
+		tenantID:             tenantID,
+		streamID:             tenants.GetName(tenantID, name),
 		entityID:             entityID,
 		getStateCallback:     getStateCallback,
+		restoreStateCallback: restoreStateCallback,
+	}
+
+	if queue != "" && tenantID != tenants.AnyTenantID {
+		w.queue = tenants.GetName(tenantID, queue)
 	}
 
+	w.relay = outbox.NewRelay(w.streamID, w.databaseWorker, w.redisWorker, w.natsWorker, w.dbMu)
+
 	w.Worker = lifecycles.NewLazyWorker(workerName, w.setup, w.teardown)
 
 	return &w
 }
 
+// NewWriter is as per NewWriterForTenant, for the default tenant and without a callback to restore state from a snapshot
 func NewWriter(
 	name string,
 	entityID ksuid.KSUID,
 	getStateCallback func() (interface{}, error),
+) *WriterImplementation {
+	return NewWriterForTenant(name, tenants.DefaultTenantID, entityID, getStateCallback, nil)
+}
+
+func NewWriterForTenant(
+	name string,
+	tenantID string,
+	entityID ksuid.KSUID,
+	getStateCallback func() (interface{}, error),
+	restoreStateCallback func(json.RawMessage) error,
 ) *WriterImplementation {
 	name = fmt.Sprintf("%v.%v", name, entityID.String())
 
-	return NewWriterWithOverrides(
+	return NewWriterForTenantWithOverrides(
 		name,
+		tenantID,
 		entityID,
 		getStateCallback,
+		restoreStateCallback,
 		fmt.Sprintf("event.%v.*", name),
 		name,
 		false,
@@ -96,135 +218,328 @@ func NewWriter(
 }
 
 func (w *WriterImplementation) setup() (err error) {
-	err = lifecycles.Setup(w.databaseWorker, w.redisWorker, w.natsWorker)
+	// only a writer that doesn't handle events (e.g. history) can span tenants
+	err = tenants.Validate(w.tenantID, !w.handleEvents)
 	if err != nil {
 		return err
 	}
 
+	if w.ownsWorkers {
+		err = lifecycles.Setup(w.databaseWorker, w.redisWorker, w.natsWorker)
+		if err != nil {
+			return err
+		}
+	}
+
 	db, err := w.databaseWorker.GetDB()
 	if err != nil {
-		_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+		_ = w.teardownWorkers()
+		return err
+	}
+
+	// a WriterHost migrates once for all of its writers
+	if w.ownsWorkers {
+		err = migrations.Migrate(db)
+		if err != nil {
+			_ = w.teardownWorkers()
+			return err
+		}
+	}
+
+	natsConn, err := w.natsWorker.GetNatsConn()
+	if err != nil {
+		_ = w.teardownWorkers()
 		return err
 	}
 
-	err = events.Migrate(db)
+	w.codec, err = codecs.GetDefault()
 	if err != nil {
-		_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+		_ = w.teardownWorkers()
 		return err
 	}
 
-	err = states.Migrate(db)
+	w.encryptData, err = events.GetEncryptData()
 	if err != nil {
-		_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+		_ = w.teardownWorkers()
 		return err
 	}
 
-	natsConn, err := w.natsWorker.GetNatsConn()
+	w.hashKey, err = events.GetHashKey()
+	if err != nil {
+		_ = w.teardownWorkers()
+		return err
+	}
+
+	w.eventStore = w.newEventStore(db)
+
+	w.storeID, err = w.eventStore.GetStoreID()
 	if err != nil {
-		_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+		_ = w.teardownWorkers()
 		return err
 	}
 
 	if w.handleEvents {
-		databaseEvents, err := events.GetAll(db)
+		w.snapshotEvents, w.snapshotInterval, err = getSnapshotIntervals()
+		if err != nil {
+			_ = w.teardownWorkers()
+			return err
+		}
+
+		w.version, err = w.eventStore.GetVersion(w.streamID)
+		if err != nil {
+			_ = w.teardownWorkers()
+			return err
+		}
+
+		afterSequence, err := w.restoreFromSnapshot(db)
 		if err != nil {
-			_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+			_ = w.teardownWorkers()
 			return err
 		}
 
-		err = w.handleRequestfromDatabasEvents(databaseEvents)
+		w.lastSnapshotAt = helpers.GetNow()
+
+		err = w.handleRequestfromDatabasEvents(db, events.NewStreamCursor(db, w.streamID, afterSequence, w.version, replayPageSize, true))
 		if err != nil {
-			_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+			_ = w.teardownWorkers()
 			return err
 		}
+
+		w.maybeSnapshot(db)
 	}
 
-	log.Printf("%v - subscribing to %#+v", w.name, w.subject)
+	// a hosted writer's outbox is relayed by its host; this just sends anything left over from before a restart
+	if w.subject == "" {
+		err = w.relay.Flush()
+		if err != nil {
+			log.Printf("%v - warning: %v", w.name, err)
+		}
 
-	if w.queue != "" {
-		w.subscription, err = natsConn.QueueSubscribe(w.subject, w.queue, w.handler)
-	} else {
-		w.subscription, err = natsConn.Subscribe(w.subject, w.handler)
+		return nil
 	}
 
+	err = lifecycles.Setup(w.relay)
 	if err != nil {
-		_ = lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
+		_ = w.teardownWorkers()
+		return err
+	}
 
+	err = w.subscribe(natsConn, w.subject, w.handler)
+	if err != nil {
+		_ = w.teardown()
 		return err
 	}
 
+	if w.handleEvents {
+		err = w.subscribe(natsConn, getStateSubject(w.name), w.stateHandler)
+		if err != nil {
+			_ = w.teardown()
+			return err
+		}
+	}
+
 	return
 }
 
+func (w *WriterImplementation) subscribe(natsConn *nats.Conn, subject string, handler nats.MsgHandler) (err error) {
+	for _, subject := range tenants.GetSubjects(w.tenantID, subject) {
+		var subscription *nats.Subscription
+
+		log.Printf("%v - subscribing to %#+v", w.name, subject)
+
+		if w.queue != "" {
+			subscription, err = natsConn.QueueSubscribe(subject, w.queue, handler)
+		} else {
+			subscription, err = natsConn.Subscribe(subject, handler)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		w.subscriptions = append(w.subscriptions, subscription)
+	}
+
+	return nil
+}
+
 func (w *WriterImplementation) teardown() (err error) {
+	for _, subscription := range w.subscriptions {
+		_ = subscription.Unsubscribe()
+	}
+
+	w.subscriptions = nil
+
+	if w.relay.IsStarted() {
+		err = lifecycles.Teardown(w.relay)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.teardownWorkers()
+}
+
+func (w *WriterImplementation) teardownWorkers() error {
+	if !w.ownsWorkers {
+		return nil
+	}
+
 	return lifecycles.Teardown(w.natsWorker, w.redisWorker, w.databaseWorker)
 }
 
-func (w *WriterImplementation) responder(msg *nats.Msg, event *events.Event, err error) {
+// responder replies in the codec the request came in with (whatever codec we publish with ourselves)
+func (w *WriterImplementation) responder(msg *nats.Msg, codec codecs.Codec, event *events.Event, data json.RawMessage, err error) {
 	response := calls.NewResponseFromError(err)
 
+	if err == nil {
+		response.Data = data
+	}
+
 	responseData, err := response.ToJSON()
 	if err != nil {
 		log.Printf("%v - warning: %v", w.name, err)
 		return
 	}
 
-	responseEvent := events.NewWithCorrelation(event.EventID, fmt.Sprintf("%v_response", event.TypeName), responseData)
+	responseEvent := events.NewCausedBy(event, fmt.Sprintf("%v_response", event.TypeName), responseData)
 
 	responseEvent.SetSource(w.name, w.entityID)
 
-	responseEventData, err := responseEvent.ToJSON()
+	responseMsg, err := newMsg(msg.Reply, responseEvent, codec)
 	if err != nil {
 		log.Printf("%v - warning: %v", w.name, err)
 		return
 	}
 
-	err = msg.Respond(responseEventData)
+	err = msg.RespondMsg(responseMsg)
 	if err != nil {
 		log.Printf("%v - warning: %v", w.name, err)
 		return
 	}
 }
 
-func (w *WriterImplementation) handleRequestfromDatabasEvents(databaseEvents []*events.DatabaseEvent) error {
-	if !w.handleEvents {
+// replayEvent sends a domain event to its evolver and a request to its handler (and on to the evolvers, if we're event
+// sourced now but weren't when it was stored)
+func (w *WriterImplementation) replayEvent(handlers Handlers, evolvers Evolvers, databaseEvent *events.DatabaseEvent) error {
+	data, err := w.UpcastData(databaseEvent.TypeName, databaseEvent.SchemaVersion, databaseEvent.Data.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if evolvers != nil {
+		evolver, err := evolvers.GetEvolver(getRelativeTypeName(databaseEvent.TypeName))
+		if err == nil {
+			return evolver(data)
+		}
+	}
+
+	request, err := calls.RequestFromJSON(data)
+	if err != nil {
+		return err
+	}
+
+	// no validation here; this request was handled under the rules of its day and changing them mustn't change history
+	requestData, err := handlers.Decode(request.Endpoint, request.Data)
+	if err != nil {
+		return err
+	}
+
+	handler, err := handlers.GetHandlerWithContext(request.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	event, err := databaseEvent.ToEvent()
+	if err != nil {
+		return err
+	}
+
+	result, err := handler(newEventHandlerContext(context.Background(), event, databaseEvent.Sequence, true), event.TenantID, event.SourceID, requestData)
+	if err != nil {
+		return err
+	}
+
+	if evolvers == nil {
 		return nil
 	}
 
-	log.Printf("%v - replaying %v events to achieve state", w.name, len(databaseEvents))
+	// outgoing events were published the first time around
+	result, _ = getOutcome(result)
 
-	var err error
-	var request *calls.Request
-	var requestData interface{}
-	var handler Handler
-	var state interface{}
-	var stateJSON []byte
+	domainEvents, ok := result.([]DomainEvent)
+	if !ok {
+		return fmt.Errorf("handler for endpoint=%#+v returned %T rather than domain events", request.Endpoint, result)
+	}
 
-	for _, databaseEvent := range databaseEvents {
-		request, err = calls.RequestFromJSON(databaseEvent.Data.Bytes)
+	for _, domainEvent := range domainEvents {
+		domainEventData, err := json.Marshal(domainEvent.Data)
 		if err != nil {
 			return err
 		}
 
-		err = json.Unmarshal(request.Data, &requestData)
+		err = evolve(evolvers, domainEvent.TypeName, domainEventData)
 		if err != nil {
 			return err
 		}
+	}
 
-		handler, err = w.GetHandler(request.Endpoint)
-		if err != nil {
-			return err
+	return nil
+}
+
+func (w *WriterImplementation) replay(db *gorm.DB, handlers Handlers, evolvers Evolvers, cursor *events.StreamCursor) (int64, error) {
+	var err error
+	var replayed, skipped, shredded int64
+
+	decrypter := events.NewDecrypter(db)
+
+	for cursor.Next() {
+		databaseEvent := cursor.Event()
+
+		// a shredded event's data is gone for good, so all we can do is carry on without it
+		err = decrypter.Decrypt(databaseEvent)
+		if errors.Is(err, events.ErrShredded) {
+			shredded++
+			continue
 		}
 
-		sourceEntityID, err := ksuid.Parse(databaseEvent.SourceID)
-		if err != nil {
-			return err
+		// a bad row shouldn't stop us from coming up; it didn't contribute to state the first time around either
+		if err == nil {
+			err = w.replayEvent(handlers, evolvers, databaseEvent)
 		}
 
-		_, err = handler(sourceEntityID, requestData)
 		if err != nil {
-			return err
+			log.Printf("%v - warning: skipping replay of event_id=%v sequence=%v: %v", w.name, databaseEvent.EventID, databaseEvent.Sequence, err)
+			skipped++
+			continue
 		}
+
+		replayed++
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return replayed, err
+	}
+
+	log.Printf("%v - replayed %v events (skipped %v, shredded %v) to achieve state", w.name, replayed, skipped, shredded)
+
+	return replayed, nil
+}
+
+func (w *WriterImplementation) handleRequestfromDatabasEvents(db *gorm.DB, cursor *events.StreamCursor) error {
+	if !w.handleEvents {
+		return nil
+	}
+
+	var err error
+	var state interface{}
+	var stateJSON []byte
+
+	replayed, err := w.replay(db, w.Handlers, w.evolvers, cursor)
+	w.eventsSinceSnapshot += replayed
+	if err != nil {
+		return err
 	}
 
 	state, err = w.getStateCallback()
@@ -245,133 +560,871 @@ func (w *WriterImplementation) handleRequestfromDatabasEvents(databaseEvents []*
 	return nil
 }
 
-func (w *WriterImplementation) handler(msg *nats.Msg) {
-	var err error
-
-	db, err := w.databaseWorker.GetDB()
+func (w *WriterImplementation) catchUp(db *gorm.DB) error {
+	w.dbMu.Lock()
+	version, err := w.eventStore.GetVersion(w.streamID)
+	w.dbMu.Unlock()
 	if err != nil {
-		log.Printf("%v - warning: %v", w.name, err)
-		return
+		return err
 	}
 
-	event, err := events.FromJSON(msg.Data)
-	if err != nil {
-		log.Printf("%v - warning: %v", w.name, err)
-		return
-	}
+	log.Printf("%v - catching up from version=%v to version=%v", w.name, w.version, version)
 
-	databaseEvent, err := event.ToDatabaseEvent()
+	err = w.handleRequestfromDatabasEvents(db, events.NewStreamCursor(db, w.streamID, w.version, version, replayPageSize, true))
 	if err != nil {
-		log.Printf("%v - warning: %v", w.name, err)
-		return
+		return err
 	}
 
-	responseNeeded := msg.Reply != ""
-
-	if !w.ignoreResponseNeeded && responseNeeded {
-		defer func() {
-			w.responder(msg, event, err)
-		}()
-	}
+	w.version = version
 
-	if !w.ignoreEventTypeName && !strings.HasPrefix(event.TypeName, w.name) {
-		err = fmt.Errorf("unknown domain and / or entity ID in typeName=%#+v", event.TypeName)
-		log.Printf("%v - warning: %v", w.name, err)
-		return
-	}
+	w.maybeSnapshot(db)
 
-	var request *calls.Request
+	return nil
+}
 
-	if !w.ignoreResponseNeeded && responseNeeded {
-		request, err = calls.RequestFromJSON(event.Data)
-		if err != nil {
-			log.Printf("%v - warning: %v", w.name, err)
-			return
-		}
+func (w *WriterImplementation) restoreFromSnapshot(db *gorm.DB) (int64, error) {
+	if w.restoreStateCallback == nil {
+		return events.NoStream, nil
 	}
 
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	w.dbMu.Lock()
-	_, err = databaseEvent.Create(db)
-	w.dbMu.Unlock()
+	databaseState, err := states.GetLatest(db, w.streamID)
 	if err != nil {
-		log.Printf("%v - warning: %v", w.name, err)
-		return
+		return events.NoStream, err
 	}
 
-	if !w.handleEvents {
-		return
+	if databaseState == nil {
+		return events.NoStream, nil
 	}
 
-	var requestData interface{}
-	var handler Handler
-	var state interface{}
-	var stateJSON []byte
+	// a snapshot is only ever an optimisation, so if we can't use it we fall back to a full replay
+	err = w.restoreStateCallback(databaseState.Data.Bytes)
+	if err != nil {
+		log.Printf("%v - warning: ignoring snapshot at sequence=%v: %v", w.name, databaseState.Sequence, err)
+		return events.NoStream, nil
+	}
 
-	err = json.Unmarshal(request.Data, &requestData)
+	log.Printf("%v - restored snapshot at sequence=%v", w.name, databaseState.Sequence)
 
-	if err == nil {
-		handler, err = w.GetHandler(request.Endpoint)
-	}
+	return databaseState.Sequence, nil
+}
 
-	if err == nil {
-		state, err = handler(event.SourceID, requestData)
+// getStateAsOf rebuilds the state as of the given point in the stream (from the nearest snapshot at or before it) in a
+// new aggregate, leaving ours alone
+func (w *WriterImplementation) getStateAsOf(db *gorm.DB, asOf *calls.AsOf) (*states.State, error) {
+	if w.newAggregate == nil {
+		return nil, fmt.Errorf("%v has no aggregate to rebuild state with", w.name)
 	}
 
-	// TODO: let's hope this never happens, because we've already handled the event
-	if err == nil {
-		stateJSON, err = json.Marshal(state)
+	if asOf.Timestamp.IsZero() && asOf.Sequence <= 0 {
+		return nil, fmt.Errorf("as of needs a timestamp and / or a sequence greater than 0")
 	}
 
-	if err == nil {
-		err = w.SetState(stateJSON)
+	w.dbMu.Lock()
+	version, err := w.eventStore.GetVersion(w.streamID)
+	w.dbMu.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	if err != nil {
+	if !asOf.Timestamp.IsZero() {
 		w.dbMu.Lock()
-		_, deleteErr := databaseEvent.Delete(db)
+		versionAt, err := w.eventStore.GetVersionAt(w.streamID, asOf.Timestamp)
 		w.dbMu.Unlock()
-		if deleteErr != nil {
-			err = fmt.Errorf("event handler caused %v requiring event deletion which caused %v", err, deleteErr)
-			log.Printf("%v - warning: %v", w.name, err)
-			return
+		if err != nil {
+			return nil, err
 		}
 
-		log.Printf("%v - warning: %v", w.name, err)
-		return
+		if versionAt < version {
+			version = versionAt
+		}
 	}
 
-	databaseEvent.IsHandled = true
-	databaseEvent.HandledByName = w.name
-	databaseEvent.HandledByID = w.entityID.String()
+	if asOf.Sequence > 0 && asOf.Sequence < version {
+		version = asOf.Sequence
+	}
+
+	aggregate := w.newAggregate()
+
+	if w.evolvers != nil && aggregate.Evolvers == nil {
+		return nil, fmt.Errorf("%v is event sourced but its aggregate has no evolvers to rebuild state with", w.name)
+	}
+
+	afterSequence := events.NoStream
 
-	// if this happens we're goosed- we've already handled the event yet for some reason we can't
-	// update that status in the database
 	w.dbMu.Lock()
-	_, err = databaseEvent.Update(db)
+	databaseState, err := states.GetLatestAt(db, w.streamID, version)
 	w.dbMu.Unlock()
 	if err != nil {
-		log.Printf("%v - warning: %v", w.name, err)
-		return
+		return nil, err
 	}
-}
+
+	// as for restoreFromSnapshot, a snapshot we can't use just means a longer replay
+	if databaseState != nil {
+		err = aggregate.RestoreState(databaseState.Data.Bytes)
+		if err != nil {
+			log.Printf("%v - warning: ignoring snapshot at sequence=%v: %v", w.name, databaseState.Sequence, err)
+		} else {
+			afterSequence = databaseState.Sequence
+		}
+	}
+
+	_, err = w.replay(db, aggregate.Handlers, aggregate.Evolvers, events.NewStreamCursor(db, w.streamID, afterSequence, version, replayPageSize, true))
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := aggregate.GetState()
+	if err != nil {
+		return nil, err
+	}
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	asOfState := states.NewForTenant(w.streamID, w.tenantID, w.entityID, stateJSON)
+	asOfState.Sequence = version
+
+	return asOfState, nil
+}
+
+// stateHandler responds to a request for the state as of a point in the stream (see Reader.GetStateAsOf)
+func (w *WriterImplementation) stateHandler(msg *nats.Msg) {
+	var err error
+	var stateJSON []byte
+
+	event, codec, err := decodeMsg(msg)
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	defer func() {
+		w.responder(msg, codec, event, stateJSON, err)
+	}()
+
+	subjectTenantID, _ := tenants.FromName(msg.Subject)
+	if event.TenantID != subjectTenantID || !tenants.Matches(w.tenantID, event.TenantID) {
+		err = fmt.Errorf("refusing state request for tenant_id=%#+v (on a subject for tenant_id=%#+v)", event.TenantID, subjectTenantID)
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	db, err := w.databaseWorker.GetDB()
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	asOf, err := calls.AsOfFromJSON(event.Data)
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	ctx, cancel := getMsgContext(msg, event)
+	defer cancel()
+
+	state, err := w.getStateAsOf(db.WithContext(ctx), asOf)
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	stateJSON, err = state.ToJSON()
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+}
+
+func (w *WriterImplementation) snapshotDue(eventsSinceSnapshot int64) bool {
+	if eventsSinceSnapshot == 0 {
+		return false
+	}
+
+	if w.snapshotEvents > 0 && eventsSinceSnapshot >= w.snapshotEvents {
+		return true
+	}
+
+	if w.snapshotInterval > 0 && helpers.GetNow().Sub(w.lastSnapshotAt) >= w.snapshotInterval {
+		return true
+	}
+
+	return false
+}
+
+func (w *WriterImplementation) snapshot(db *gorm.DB, version int64) error {
+	stateJSON, err := w.getStateJSON()
+	if err != nil {
+		return err
+	}
+
+	snapshot := states.NewForTenant(w.streamID, w.tenantID, w.entityID, stateJSON)
+	snapshot.Sequence = version
+
+	databaseState, err := snapshot.ToDatabaseState()
+	if err != nil {
+		return err
+	}
+
+	_, err = databaseState.Create(db)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *WriterImplementation) maybeSnapshot(db *gorm.DB) {
+	if !w.handleEvents || !w.snapshotDue(w.eventsSinceSnapshot) {
+		return
+	}
+
+	w.dbMu.Lock()
+	err := w.snapshot(db, w.version)
+	w.dbMu.Unlock()
+	if err != nil {
+		log.Printf("%v - warning: failed to snapshot at sequence=%v: %v", w.name, w.version, err)
+		return
+	}
+
+	w.eventsSinceSnapshot = 0
+	w.lastSnapshotAt = helpers.GetNow()
+
+	log.Printf("%v - snapshotted at sequence=%v", w.name, w.version)
+}
+
+func (w *WriterImplementation) newEventStore(db *gorm.DB) events.EventStore {
+	return events.NewEventStoreWithOverrides(db, w.encryptData, w.hashKey)
+}
+
+// publishStoredInTx publishes the stored event once tx has committed
+func (w *WriterImplementation) publishStoredInTx(tx *gorm.DB, databaseEvent *events.DatabaseEvent) error {
+	storedEvent, err := databaseEvent.ToEvent()
+	if err != nil {
+		return err
+	}
+
+	storedEventData, err := storedEvent.Encode(w.codec)
+	if err != nil {
+		return err
+	}
+
+	_, err = outbox.NewNatsPublish(w.streamID, tenants.GetName(storedEvent.TenantID, events.GetStoredSubject(w.storeID, storedEvent.TypeName)), w.codec.ContentType(), storedEventData).Create(tx)
+
+	return err
+}
+
+// append records an event without handling it, for writers (e.g. history) that have no aggregate to keep consistent
+func (w *WriterImplementation) append(db *gorm.DB, streamID string, databaseEvent *events.DatabaseEvent) error {
+	w.dbMu.Lock()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := w.newEventStore(tx).Append(streamID, events.AnyVersion, databaseEvent)
+		if err != nil {
+			return err
+		}
+
+		return w.publishStoredInTx(tx, databaseEvent)
+	})
+	w.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// if this fails the relay will get to it on its own schedule
+	err = w.relay.Flush()
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+	}
+
+	return nil
+}
+
+// getOriginal returns nil if the event isn't a duplicate; for an event sourced writer the original is the first domain
+// event of the request (or the request itself, if it was rejected)
+func (w *WriterImplementation) getOriginal(eventStore events.EventStore, streamID string, databaseEvent *events.DatabaseEvent) (*events.DatabaseEvent, error) {
+	original, err := eventStore.GetOriginal(streamID, databaseEvent)
+	if err != nil || original != nil || w.evolvers == nil {
+		return original, err
+	}
+
+	requestEventID, err := ksuid.Parse(databaseEvent.EventID)
+	if err != nil {
+		return nil, err
+	}
+
+	domainEventID, err := getDomainEventID(requestEventID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return eventStore.GetOriginal(streamID, &events.DatabaseEvent{EventID: domainEventID.String()})
+}
+
+// getOriginalOutcome reproduces the outcome of the original delivery of an event we've been given again
+func (w *WriterImplementation) getOriginalOutcome(streamID string, databaseEvent *events.DatabaseEvent) error {
+	w.dbMu.Lock()
+	original, err := w.getOriginal(w.eventStore, streamID, databaseEvent)
+	w.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if original == nil {
+		return fmt.Errorf("event_id=%v was reported as a duplicate but has no original", databaseEvent.EventID)
+	}
+
+	if original.IsRejected {
+		return errors.New(original.RejectionReason)
+	}
+
+	if original.DeletedAt.Valid {
+		return fmt.Errorf("original event_id=%v was rejected", original.EventID)
+	}
+
+	if !original.IsHandled {
+		return fmt.Errorf("original event_id=%v has not been handled", original.EventID)
+	}
+
+	return nil
+}
+
+// rejectInTx records that the handler rejected the event and defers publishing a rejection event (caused by the
+// rejected one) until the given transaction has committed
+func (w *WriterImplementation) rejectInTx(tx *gorm.DB, event *events.Event, request *calls.Request, databaseEvent *events.DatabaseEvent, handlerErr error) error {
+	databaseEvent.IsRejected = true
+	databaseEvent.RejectionReason = handlerErr.Error()
+	databaseEvent.HandledByName = w.name
+	databaseEvent.HandledByID = w.entityID.String()
+
+	err := w.newEventStore(tx).Update(databaseEvent)
+	if err != nil {
+		return err
+	}
+
+	rejectionData, err := calls.NewRejection(request, handlerErr).ToJSON()
+	if err != nil {
+		return err
+	}
+
+	rejectionEvent := events.NewCausedBy(event, fmt.Sprintf("%v_rejected", event.TypeName), rejectionData)
+
+	rejectionEvent.SetSource(w.name, w.entityID)
+
+	rejectionEventData, err := rejectionEvent.Encode(w.codec)
+	if err != nil {
+		return err
+	}
+
+	_, err = outbox.NewNatsPublish(w.streamID, tenants.GetName(rejectionEvent.TenantID, fmt.Sprintf("event.%v", rejectionEvent.TypeName)), w.codec.ContentType(), rejectionEventData).Create(tx)
+
+	return err
+}
+
+func (w *WriterImplementation) newDomainEvents(event *events.Event, result interface{}) ([]*events.Event, error) {
+	decided, ok := result.([]DomainEvent)
+	if !ok {
+		return nil, fmt.Errorf("handler returned %T rather than domain events", result)
+	}
+
+	domainEvents := make([]*events.Event, 0, len(decided))
+
+	for i, domainEvent := range decided {
+		_, err := w.evolvers.GetEvolver(domainEvent.TypeName)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(domainEvent.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		newEvent := events.NewCausedBy(event, fmt.Sprintf("%v.%v", w.name, domainEvent.TypeName), data)
+
+		newEvent.EventID, err = getDomainEventID(event.EventID, i)
+		if err != nil {
+			return nil, err
+		}
+
+		newEvent.SchemaVersion = w.GetSchemaVersion(newEvent.TypeName)
+
+		newEvent.SetSource(w.name, w.entityID)
+
+		// the first thing to come of a request stands in for it when it comes to idempotency
+		if i == 0 {
+			newEvent.IdempotencyKey = event.IdempotencyKey
+		}
+
+		domainEvents = append(domainEvents, newEvent)
+	}
+
+	return domainEvents, nil
+}
+
+// newOutgoingEvents turns the outgoing events a handler decided on into requests caused by the request it was handling
+// (so they share its correlation and are made on behalf of its tenant)
+func (w *WriterImplementation) newOutgoingEvents(event *events.Event, outgoing []OutgoingEvent) ([]*events.Event, error) {
+	outgoingEvents := make([]*events.Event, 0, len(outgoing))
+
+	for _, outgoingEvent := range outgoing {
+		if outgoingEvent.Name == "" || outgoingEvent.Endpoint == "" {
+			return nil, fmt.Errorf("outgoing event needs a name and an endpoint (got name=%#+v endpoint=%#+v)", outgoingEvent.Name, outgoingEvent.Endpoint)
+		}
+
+		data, err := json.Marshal(outgoingEvent.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		request := &calls.Request{Endpoint: outgoingEvent.Endpoint, Data: data}
+
+		requestJSON, err := request.ToJSON()
+		if err != nil {
+			return nil, err
+		}
+
+		newEvent := events.NewCausedBy(event, fmt.Sprintf("%v.%v.%v", outgoingEvent.Name, outgoingEvent.EntityID, outgoingEvent.Endpoint), requestJSON)
+
+		newEvent.SetSource(w.name, w.entityID)
+
+		outgoingEvents = append(outgoingEvents, newEvent)
+	}
+
+	return outgoingEvents, nil
+}
+
+// publishOutgoingInTx defers publishing the given outgoing events (where a call for them would have gone) until the given
+// transaction has committed
+func (w *WriterImplementation) publishOutgoingInTx(tx *gorm.DB, outgoingEvents []*events.Event) error {
+	for _, outgoingEvent := range outgoingEvents {
+		outgoingEventData, err := outgoingEvent.Encode(w.codec)
+		if err != nil {
+			return err
+		}
+
+		_, err = outbox.NewNatsPublish(w.streamID, tenants.GetName(outgoingEvent.TenantID, fmt.Sprintf("event.%v", outgoingEvent.TypeName)), w.codec.ContentType(), outgoingEventData).Create(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *WriterImplementation) appendDomainEventsInTx(tx *gorm.DB, domainEvents []*events.Event) (int64, error) {
+	if len(domainEvents) == 0 {
+		return w.version, nil
+	}
+
+	databaseEvents := make([]*events.DatabaseEvent, 0, len(domainEvents))
+
+	for _, domainEvent := range domainEvents {
+		databaseEvent, err := domainEvent.ToDatabaseEvent()
+		if err != nil {
+			return 0, err
+		}
+
+		databaseEvent.IsHandled = true
+		databaseEvent.HandledByName = w.name
+		databaseEvent.HandledByID = w.entityID.String()
+
+		databaseEvents = append(databaseEvents, databaseEvent)
+	}
+
+	version, err := w.newEventStore(tx).Append(w.streamID, w.version, databaseEvents...)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, databaseEvent := range databaseEvents {
+		err = evolve(w.evolvers, getRelativeTypeName(domainEvents[i].TypeName), domainEvents[i].Data)
+		if err != nil {
+			return 0, err
+		}
+
+		err = w.publishStoredInTx(tx, databaseEvent)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return version, nil
+}
+
+// callHandler decodes (and validates) the request and hands it to its handler, along with the context of the event that
+// carried it (at the given sequence)
+func (w *WriterImplementation) callHandler(ctx context.Context, event *events.Event, request *calls.Request, sequence int64) (interface{}, error) {
+	requestData, err := DecodeAndValidate(w, request.Endpoint, request.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := w.GetHandlerWithContext(request.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(newEventHandlerContext(ctx, event, sequence, false), event.TenantID, event.SourceID, requestData)
+}
+
+// tryHandle appends the event, hands it to the handler and records the outcome (and the side effects of that outcome)
+// in a single transaction; a rejection by the handler is still committed (as a rejected event) but is returned as an error
+// (an event sourced writer stores the domain events in place of the request, unless it's rejected)
+//
+// The handler is given the context of the request and nothing is committed for a caller that has given up on it; any
+// outgoing events it decided on (see Outcome) go out through the outbox, so they're only published once the request has
+// been committed
+func (w *WriterImplementation) tryHandle(ctx context.Context, db *gorm.DB, event *events.Event, request *calls.Request, databaseEvent *events.DatabaseEvent) error {
+	var err error
+	var preimage json.RawMessage
+
+	// the handler mutates the aggregate in memory, so if the transaction fails after that we need a way to put it back
+	if w.restoreStateCallback != nil {
+		preimage, err = w.getStateJSON()
+		if err != nil {
+			return err
+		}
+	}
+
+	var version int64
+	var handlerErr error
+	handled, snapshotted := false, false
+	appended := int64(1) // towards the next snapshot
+
+	w.dbMu.Lock()
+	// the context is checked rather than handed to the transaction; the SQLite driver throws away a connection whose
+	// transaction is cancelled out from under it (and an in-memory database along with it)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		var result interface{}
+		var outgoing []OutgoingEvent
+		var domainEvents, outgoingEvents []*events.Event
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		// duplicates are caught here, as the append comes after the handler (so it doesn't hold the position lock)
+		original, err := w.getOriginal(w.newEventStore(tx), w.streamID, databaseEvent)
+		if err != nil {
+			return err
+		}
+
+		if original != nil {
+			return fmt.Errorf("%w; stream=%#+v already has event_id=%v for event_id=%v", events.ErrDuplicateEvent, w.streamID, original.EventID, databaseEvent.EventID)
+		}
+
+		result, handlerErr = w.callHandler(ctx, event, request, w.version+1)
+		handled = handlerErr == nil
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		if handlerErr == nil {
+			result, outgoing = getOutcome(result)
+			outgoingEvents, handlerErr = w.newOutgoingEvents(event, outgoing)
+		}
+
+		if handlerErr == nil && w.evolvers != nil {
+			domainEvents, handlerErr = w.newDomainEvents(event, result)
+		}
+
+		if handlerErr != nil {
+			version, err = w.newEventStore(tx).Append(w.streamID, w.version, databaseEvent)
+			if err != nil {
+				return err
+			}
+
+			return w.rejectInTx(tx, event, request, databaseEvent, handlerErr)
+		}
+
+		state := result
+
+		if w.evolvers == nil {
+			databaseEvent.IsHandled = true
+			databaseEvent.HandledByName = w.name
+			databaseEvent.HandledByID = w.entityID.String()
+
+			version, err = w.newEventStore(tx).Append(w.streamID, w.version, databaseEvent)
+			if err != nil {
+				return err
+			}
+
+			err = w.publishStoredInTx(tx, databaseEvent)
+			if err != nil {
+				return err
+			}
+		} else {
+			version, err = w.appendDomainEventsInTx(tx, domainEvents)
+			if err != nil {
+				return err
+			}
+
+			appended = int64(len(domainEvents))
+
+			state, err = w.getStateCallback()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = w.publishOutgoingInTx(tx, outgoingEvents)
+		if err != nil {
+			return err
+		}
+
+		stateJSON, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		err = w.setStateInTx(tx, version, stateJSON)
+		if err != nil {
+			return err
+		}
+
+		if w.snapshotDue(w.eventsSinceSnapshot + appended) {
+			err = w.snapshot(tx, version)
+			if err != nil {
+				return err
+			}
+
+			snapshotted = true
+		}
+
+		return nil
+	})
+	w.dbMu.Unlock()
+
+	if err != nil {
+		if handled {
+			if preimage != nil {
+				restoreErr := w.restoreStateCallback(preimage)
+				if restoreErr != nil {
+					err = fmt.Errorf("transaction failed with %w requiring state restoration which caused %v", err, restoreErr)
+				}
+			} else {
+				err = fmt.Errorf("transaction failed with %w after the handler had already changed state", err)
+			}
+		}
+
+		databaseEvent.IsHandled = false
+		databaseEvent.IsRejected = false
+		databaseEvent.RejectionReason = ""
+		databaseEvent.HandledByName = ""
+		databaseEvent.HandledByID = ""
+
+		return err
+	}
+
+	w.version = version
+
+	// the handler got as far as changing state, but what it came up with (e.g. an outgoing event) got the request rejected
+	if handled && handlerErr != nil {
+		if preimage != nil {
+			restoreErr := w.restoreStateCallback(preimage)
+			if restoreErr != nil {
+				handlerErr = fmt.Errorf("%w; rejection required state restoration which caused %v", handlerErr, restoreErr)
+			}
+		} else {
+			handlerErr = fmt.Errorf("%w; rejected after the handler had already changed state", handlerErr)
+		}
+	}
+
+	if handlerErr == nil {
+		if snapshotted {
+			w.eventsSinceSnapshot = 0
+			w.lastSnapshotAt = helpers.GetNow()
+		} else {
+			w.eventsSinceSnapshot += appended
+		}
+	}
+
+	// if this fails the relay will get to it on its own schedule
+	err = w.relay.Flush()
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+	}
+
+	return handlerErr
+}
+
+func (w *WriterImplementation) handle(ctx context.Context, db *gorm.DB, event *events.Event, request *calls.Request, databaseEvent *events.DatabaseEvent) error {
+	err := w.tryHandle(ctx, db, event, request, databaseEvent)
+
+	// another writer in our queue group got in first; replay what it wrote and have one more go
+	if errors.Is(err, events.ErrVersionConflict) {
+		log.Printf("%v - warning: %v", w.name, err)
+
+		err = w.catchUp(db)
+		if err != nil {
+			return err
+		}
+
+		err = w.tryHandle(ctx, db, event, request, databaseEvent)
+	}
+
+	return err
+}
+
+func (w *WriterImplementation) handler(msg *nats.Msg) {
+	var err error
+
+	db, err := w.databaseWorker.GetDB()
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	event, codec, err := decodeMsg(msg)
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	databaseEvent, err := event.ToDatabaseEvent()
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	// a writer's own events (e.g. rejections) can match its own subscription, but they aren't requests for it
+	if event.SourceName == w.name && event.SourceID == w.entityID {
+		return
+	}
+
+	responseNeeded := msg.Reply != ""
+
+	if !w.ignoreResponseNeeded && responseNeeded {
+		defer func() {
+			w.responder(msg, codec, event, nil, err)
+		}()
+	}
+
+	// the subject says which tenant the event was sent to and the event says which tenant it's from, and they both have
+	// to be ours
+	subjectTenantID, _ := tenants.FromName(msg.Subject)
+	if event.TenantID != subjectTenantID || !tenants.Matches(w.tenantID, event.TenantID) {
+		err = fmt.Errorf("refusing event for tenant_id=%#+v (on a subject for tenant_id=%#+v)", event.TenantID, subjectTenantID)
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	if !w.ignoreEventTypeName && !strings.HasPrefix(event.TypeName, w.name) {
+		err = fmt.Errorf("unknown domain and / or entity ID in typeName=%#+v", event.TypeName)
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+
+	var request *calls.Request
+
+	if w.handleEvents {
+		// the event is recorded as it was received, but handled as if it had been written in the current schema
+		handledEvent := *event
+
+		err = w.Upcast(&handledEvent)
+		if err != nil {
+			log.Printf("%v - warning: %v", w.name, err)
+			return
+		}
+
+		request, err = calls.RequestFromJSON(handledEvent.Data)
+		if err != nil {
+			log.Printf("%v - warning: %v", w.name, err)
+			return
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// writers that don't handle events (e.g. history) record them against the stream they were destined for
+	streamID := w.streamID
+
+	if w.handleEvents {
+		ctx, cancel := getMsgContext(msg, event)
+		defer cancel()
+
+		err = w.handle(ctx, db, event, request, databaseEvent)
+	} else {
+		streamID = tenants.GetName(event.TenantID, events.GetStreamID(event.TypeName))
+		err = w.append(db, streamID, databaseEvent)
+	}
+
+	if errors.Is(err, events.ErrDuplicateEvent) {
+		log.Printf("%v - warning: ignoring redelivery; %v", w.name, err)
+		err = w.getOriginalOutcome(streamID, databaseEvent)
+		return
+	}
+
+	if err != nil {
+		log.Printf("%v - warning: %v", w.name, err)
+		return
+	}
+}
+
+func (w *WriterImplementation) getStateJSON() (json.RawMessage, error) {
+	state, err := w.getStateCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(state)
+}
+
+func (w *WriterImplementation) getStateData(version int64, data json.RawMessage) ([]byte, error) {
+	state := states.NewForTenant(w.streamID, w.tenantID, w.entityID, data)
+	state.Sequence = version
+
+	return state.ToJSON()
+}
+
+// setStateInTx defers the write to the read model until the given transaction has committed
+func (w *WriterImplementation) setStateInTx(tx *gorm.DB, version int64, data json.RawMessage) error {
+	stateJSON, err := w.getStateData(version, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = outbox.NewRedisSet(w.streamID, w.streamID, stateJSON).Create(tx)
+
+	return err
+}
+
+// SetEvolvers makes the writer event sourced (see AddDecider); requests stored before the switch are still replayed
+// through their handlers
+func (w *WriterImplementation) SetEvolvers(evolvers Evolvers) {
+	w.evolvers = evolvers
+}
+
+// SetAggregateFactory gives the writer a way to make new aggregates, so that it can rebuild state as of a point in the
+// stream without touching its own
+func (w *WriterImplementation) SetAggregateFactory(newAggregate func() *Aggregate) {
+	w.newAggregate = newAggregate
+}
 
 func (w *WriterImplementation) SetState(data json.RawMessage) (err error) {
+	return w.SetStateWithContext(context.Background(), data)
+}
+
+func (w *WriterImplementation) SetStateWithContext(ctx context.Context, data json.RawMessage) (err error) {
 	redisClient, err := w.redisWorker.GetRedisClient()
 	if err != nil {
 		return err
 	}
 
-	state := states.New(w.name, w.entityID, data)
-
-	stateJSON, err := state.ToJSON()
+	stateJSON, err := w.getStateData(w.version, data)
 	if err != nil {
 		return err
 	}
 
-	err = redisClient.Set(context.Background(), w.name, stateJSON, time.Duration(0)).Err()
+	err = redisClient.Set(ctx, w.streamID, stateJSON, time.Duration(0)).Err()
 	if err != nil {
 		return err
 	}
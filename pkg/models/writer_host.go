@@ -0,0 +1,506 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/models/outbox"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
+	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/ksuid"
+)
+
+// WriterHost brings up a writer per entity on demand and takes it down once it's idle
+type WriterHost interface {
+	lifecycles.Worker
+	events.Upcasters
+	GetEntityCount() int
+}
+
+// hostedEntity is an entity's writer and its queue (handled in order, on a goroutine of its own)
+type hostedEntity struct {
+	writer     *WriterImplementation
+	msgs       chan hostedMsg
+	pending    int // queued or being handled
+	lastUsedAt time.Time
+	evicting   bool // taken down as soon as it has nothing pending (see Evict)
+	stopped    chan bool
+}
+
+type hostedMsg struct {
+	msg    *nats.Msg
+	handle func(*WriterImplementation, *nats.Msg)
+}
+
+type WriterHostImplementation struct {
+	lifecycles.Worker
+	events.Upcasters
+	databaseWorker database_worker.Worker
+	redisWorker    redis_worker.Worker
+	natsWorker     nats_worker.Worker
+	reaper         lifecycles.Worker
+	relay          *outbox.Relay // for every entity's stream (the entities' writers don't have relays running of their own)
+	dbMu           sync.Locker   // per writer, unless it's SQLite (see WriterImplementation.dbMu)
+	useSharedDBMu  bool
+	mu             sync.Mutex
+	stopping       bool
+	dispatching    sync.WaitGroup // messages on their way onto an entity's queue
+	name           string
+	tenantID       string
+	queue          string
+	newAggregate   func(ksuid.KSUID) *Aggregate
+	idleTimeout    time.Duration
+	maxEntities    int
+	entities       map[string]*hostedEntity
+	subscriptions  []*nats.Subscription
+}
+
+// NewWriterHost returns a host for the named domain (e.g. "wallet"); newAggregate is called per entity
+func NewWriterHost(name string, tenantID string, newAggregate func(ksuid.KSUID) *Aggregate) *WriterHostImplementation {
+	workerName := fmt.Sprintf("writer_host_%v", name)
+
+	h := WriterHostImplementation{
+		Upcasters:      events.NewUpcasters(),
+		databaseWorker: dependencies.Get().NewDatabaseWorker(workerName),
+		redisWorker:    dependencies.Get().NewRedisWorker(workerName),
+		natsWorker:     dependencies.Get().NewNatsWorker(workerName),
+		dbMu:           &sync.Mutex{},
+		name:           name,
+		tenantID:       tenantID,
+		queue:          name,
+		newAggregate:   newAggregate,
+		entities:       make(map[string]*hostedEntity),
+	}
+
+	if tenantID != tenants.AnyTenantID {
+		h.queue = tenants.GetName(tenantID, name)
+	}
+
+	h.Worker = lifecycles.NewLazyWorker(workerName, h.setup, h.teardown)
+
+	return &h
+}
+
+func (h *WriterHostImplementation) setup() (err error) {
+	err = tenants.Validate(h.tenantID, true)
+	if err != nil {
+		return err
+	}
+
+	h.idleTimeout, h.maxEntities, err = getWriterHostLimits()
+	if err != nil {
+		return err
+	}
+
+	err = lifecycles.Setup(h.databaseWorker, h.redisWorker, h.natsWorker)
+	if err != nil {
+		return err
+	}
+
+	db, err := h.databaseWorker.GetDB()
+	if err != nil {
+		_ = lifecycles.Teardown(h.natsWorker, h.redisWorker, h.databaseWorker)
+		return err
+	}
+
+	err = migrations.Migrate(db)
+	if err != nil {
+		_ = lifecycles.Teardown(h.natsWorker, h.redisWorker, h.databaseWorker)
+		return err
+	}
+
+	h.useSharedDBMu = helpers.IsSQLite(db)
+
+	h.mu.Lock()
+	h.stopping = false
+	h.mu.Unlock()
+
+	natsConn, err := h.natsWorker.GetNatsConn()
+	if err != nil {
+		_ = lifecycles.Teardown(h.natsWorker, h.redisWorker, h.databaseWorker)
+		return err
+	}
+
+	h.relay = outbox.NewPatternRelay(
+		fmt.Sprintf("writer_host_%v", h.name),
+		tenants.GetSubjects(h.tenantID, fmt.Sprintf("%v.*", h.name)),
+		h.databaseWorker,
+		h.redisWorker,
+		h.natsWorker,
+		h.dbMu,
+	)
+
+	err = lifecycles.Setup(h.relay)
+	if err != nil {
+		_ = lifecycles.Teardown(h.natsWorker, h.redisWorker, h.databaseWorker)
+		return err
+	}
+
+	if h.idleTimeout > 0 {
+		// stopping a scheduled worker waits out its period, so that can't be too long
+		reaperPeriod := h.idleTimeout / 2
+		if reaperPeriod > maxReaperPeriod {
+			reaperPeriod = maxReaperPeriod
+		}
+
+		h.reaper = lifecycles.NewScheduledWorker(fmt.Sprintf("writer_host_reaper_%v", h.name), nil, h.evictIdle, nil, nil, reaperPeriod)
+
+		err = lifecycles.Setup(h.reaper)
+		if err != nil {
+			_ = lifecycles.Teardown(h.relay, h.natsWorker, h.redisWorker, h.databaseWorker)
+			return err
+		}
+	}
+
+	handlers := map[string]func(*WriterImplementation, *nats.Msg){
+		fmt.Sprintf("event.%v.*.*", h.name):          (*WriterImplementation).handler,
+		getStateSubject(fmt.Sprintf("%v.*", h.name)): (*WriterImplementation).stateHandler,
+	}
+
+	// every replica gets these (not just one of the queue group), as any of them could have the entity up
+	for _, subject := range tenants.GetSubjects(h.tenantID, getEvictSubject(fmt.Sprintf("%v.*", h.name))) {
+		subscription, err := natsConn.Subscribe(subject, h.evictHandler)
+		if err != nil {
+			_ = h.teardown()
+			return err
+		}
+
+		h.subscriptions = append(h.subscriptions, subscription)
+	}
+
+	for subject, handle := range handlers {
+		handle := handle
+
+		for _, subject := range tenants.GetSubjects(h.tenantID, subject) {
+			log.Printf("%v - subscribing to %#+v", h.name, subject)
+
+			subscription, err := natsConn.QueueSubscribe(subject, h.queue, func(msg *nats.Msg) {
+				h.dispatch(msg, handle)
+			})
+			if err != nil {
+				_ = h.teardown()
+				return err
+			}
+
+			h.subscriptions = append(h.subscriptions, subscription)
+		}
+	}
+
+	return nil
+}
+
+func (h *WriterHostImplementation) teardown() (err error) {
+	h.mu.Lock()
+	h.stopping = true
+	h.mu.Unlock()
+
+	for _, subscription := range h.subscriptions {
+		_ = subscription.Unsubscribe()
+	}
+
+	h.subscriptions = nil
+
+	h.dispatching.Wait()
+
+	if h.reaper != nil && h.reaper.IsStarted() {
+		err = lifecycles.Teardown(h.reaper)
+		if err != nil {
+			return err
+		}
+	}
+
+	// anything already queued is handled before the writers go down
+	h.mu.Lock()
+	entities := h.entities
+	h.entities = make(map[string]*hostedEntity)
+	for _, entity := range entities {
+		close(entity.msgs)
+	}
+	h.mu.Unlock()
+
+	for _, entity := range entities {
+		<-entity.stopped
+	}
+
+	if h.relay != nil && h.relay.IsStarted() {
+		err = lifecycles.Teardown(h.relay)
+		if err != nil {
+			return err
+		}
+	}
+
+	return lifecycles.Teardown(h.natsWorker, h.redisWorker, h.databaseWorker)
+}
+
+// getEntity parses e.g. event.wallet.[ksuid].credit or state.wallet.[ksuid]
+func (h *WriterHostImplementation) getEntity(subject string) (string, ksuid.KSUID, error) {
+	tenantID, name := tenants.FromName(subject)
+
+	parts := strings.Split(name, ".")
+	if len(parts) < 3 || parts[1] != h.name {
+		return "", ksuid.Nil, fmt.Errorf("subject=%#+v is not for an entity in domain=%#+v", subject, h.name)
+	}
+
+	entityID, err := ksuid.Parse(parts[2])
+	if err != nil {
+		return "", ksuid.Nil, fmt.Errorf("subject=%#+v has an invalid entity ID: %v", subject, err)
+	}
+
+	return tenantID, entityID, nil
+}
+
+func (h *WriterHostImplementation) newEntity(tenantID string, entityID ksuid.KSUID) *hostedEntity {
+	aggregate := h.newAggregate(entityID)
+
+	dbMu := sync.Locker(&sync.Mutex{})
+	if h.useSharedDBMu {
+		dbMu = h.dbMu
+	}
+
+	writer := newWriter(
+		fmt.Sprintf("%v.%v", h.name, entityID.String()),
+		tenantID,
+		entityID,
+		aggregate.GetState,
+		aggregate.RestoreState,
+		"",
+		"",
+		false,
+		false,
+		true,
+		h.databaseWorker,
+		h.redisWorker,
+		h.natsWorker,
+		dbMu,
+		false,
+	)
+
+	writer.Handlers = aggregate.Handlers
+	writer.Upcasters = h.Upcasters
+
+	if aggregate.Evolvers != nil {
+		writer.SetEvolvers(aggregate.Evolvers)
+	}
+
+	writer.SetAggregateFactory(func() *Aggregate {
+		return h.newAggregate(entityID)
+	})
+
+	entity := hostedEntity{
+		writer:  writer,
+		msgs:    make(chan hostedMsg, hostedEntityBufferSize),
+		stopped: make(chan bool),
+	}
+
+	return &entity
+}
+
+// dispatch is only called from one subscription goroutine at a time, which keeps each entity's messages in order
+func (h *WriterHostImplementation) dispatch(msg *nats.Msg, handle func(*WriterImplementation, *nats.Msg)) {
+	tenantID, entityID, err := h.getEntity(msg.Subject)
+	if err != nil {
+		log.Printf("%v - warning: %v", h.name, err)
+		return
+	}
+
+	key := tenants.GetName(tenantID, entityID.String())
+
+	h.mu.Lock()
+
+	if h.stopping {
+		h.mu.Unlock()
+		return
+	}
+
+	entity, ok := h.entities[key]
+	if !ok {
+		if h.maxEntities > 0 && len(h.entities) >= h.maxEntities && !h.evictLeastRecentlyUsed() {
+			log.Printf("%v - warning: all %v entities are busy; going over WRITER_MAX_ENTITIES", h.name, len(h.entities))
+		}
+
+		entity = h.newEntity(tenantID, entityID)
+		h.entities[key] = entity
+
+		go h.run(key, entity)
+	}
+
+	// nothing pending is ever evicted, so the queue stays open until we're done with it
+	entity.pending++
+	entity.lastUsedAt = helpers.GetNow()
+
+	h.dispatching.Add(1)
+	defer h.dispatching.Done()
+
+	h.mu.Unlock()
+
+	// don't block on a full queue; that would hold up every other entity
+	select {
+	case entity.msgs <- hostedMsg{msg: msg, handle: handle}:
+	default:
+		h.mu.Lock()
+		entity.pending--
+		h.mu.Unlock()
+
+		h.refuse(entity.writer, msg, fmt.Errorf("%v is busy (%v messages queued already); try again later", key, len(entity.msgs)))
+	}
+}
+
+func (h *WriterHostImplementation) refuse(writer *WriterImplementation, msg *nats.Msg, err error) {
+	log.Printf("%v - warning: %v", h.name, err)
+
+	if msg.Reply == "" {
+		return
+	}
+
+	event, codec, decodeErr := decodeMsg(msg)
+	if decodeErr != nil {
+		log.Printf("%v - warning: %v", h.name, decodeErr)
+		return
+	}
+
+	writer.responder(msg, codec, event, nil, err)
+}
+
+func (h *WriterHostImplementation) run(key string, entity *hostedEntity) {
+	defer close(entity.stopped)
+
+	for hostedMsg := range entity.msgs {
+		if !entity.writer.IsStarted() {
+			err := entity.writer.Start()
+			if err != nil {
+				h.refuse(entity.writer, hostedMsg.msg, fmt.Errorf("failed to start writer for %v: %v", key, err))
+			}
+		}
+
+		if entity.writer.IsStarted() {
+			hostedMsg.handle(entity.writer, hostedMsg.msg)
+		}
+
+		h.mu.Lock()
+		entity.pending--
+		if entity.evicting && entity.pending == 0 && h.entities[key] == entity {
+			h.evict(key)
+		}
+		h.mu.Unlock()
+	}
+
+	if entity.writer.IsStarted() {
+		err := entity.writer.Stop()
+		if err != nil {
+			log.Printf("%v - warning: failed to stop writer for %v: %v", h.name, key, err)
+		}
+	}
+}
+
+// evict must be called with h.mu held, for an entity with nothing pending
+func (h *WriterHostImplementation) evict(key string) {
+	entity := h.entities[key]
+
+	delete(h.entities, key)
+
+	close(entity.msgs)
+
+	log.Printf("%v - evicted %v", h.name, key)
+}
+
+// evictLeastRecentlyUsed must be called with h.mu held
+func (h *WriterHostImplementation) evictLeastRecentlyUsed() bool {
+	keys := make([]string, 0, len(h.entities))
+
+	for key, entity := range h.entities {
+		if entity.pending == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return false
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return h.entities[keys[i]].lastUsedAt.Before(h.entities[keys[j]].lastUsedAt)
+	})
+
+	h.evict(keys[0])
+
+	return true
+}
+
+// evictHandler takes down the writer for the entity the message is for (if it's up), once it has nothing pending
+func (h *WriterHostImplementation) evictHandler(msg *nats.Msg) {
+	tenantID, entityID, err := h.getEntity(msg.Subject)
+	if err != nil {
+		log.Printf("%v - warning: %v", h.name, err)
+		return
+	}
+
+	key := tenants.GetName(tenantID, entityID.String())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entity, ok := h.entities[key]
+	if !ok {
+		return
+	}
+
+	if entity.pending > 0 {
+		entity.evicting = true
+		return
+	}
+
+	h.evict(key)
+}
+
+func (h *WriterHostImplementation) evictIdle() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, entity := range h.entities {
+		if entity.pending == 0 && helpers.GetNow().Sub(entity.lastUsedAt) >= h.idleTimeout {
+			h.evict(key)
+		}
+	}
+
+	// we may have gone over while everything was busy
+	for h.maxEntities > 0 && len(h.entities) > h.maxEntities {
+		if !h.evictLeastRecentlyUsed() {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Evict tells every writer host to take down its writer for the given stream (e.g. wallet.[ksuid]) if it has one up, so
+// that the next thing for it brings it up from the store again (e.g. once the stream has been shredded, so that nothing
+// is left holding its plaintext); a writer that's busy is taken down as soon as it has nothing pending
+func Evict(natsConn *nats.Conn, streamID string) error {
+	tenantID, name := tenants.FromName(streamID)
+
+	err := natsConn.Publish(tenants.GetName(tenantID, getEvictSubject(name)), nil)
+	if err != nil {
+		return err
+	}
+
+	return natsConn.Flush()
+}
+
+func (h *WriterHostImplementation) GetEntityCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.entities)
+}
@@ -0,0 +1,348 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/codecs"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/ksuid"
+)
+
+// testThings records what the "add" handler of each hosted entity was given; an entity can be held up in its handler
+// until released
+type testThings struct {
+	mu      sync.Mutex
+	added   map[ksuid.KSUID][]float64
+	gates   map[ksuid.KSUID]chan bool
+	entered chan ksuid.KSUID
+}
+
+func (things *testThings) newAggregate(entityID ksuid.KSUID) *Aggregate {
+	handlers := NewHandlers()
+
+	_ = handlers.AddHandler("add", func(_ ksuid.KSUID, requestBody interface{}) (interface{}, error) {
+		things.mu.Lock()
+		gate := things.gates[entityID]
+		things.mu.Unlock()
+
+		if gate != nil {
+			things.entered <- entityID
+			<-gate
+		}
+
+		things.mu.Lock()
+		things.added[entityID] = append(things.added[entityID], requestBody.(map[string]interface{})["value"].(float64))
+		things.mu.Unlock()
+
+		return nil, nil
+	})
+
+	return &Aggregate{
+		Handlers: handlers,
+		GetState: func() (interface{}, error) {
+			return nil, nil
+		},
+	}
+}
+
+// hold has the given entity's handler wait until the returned func is called
+func (things *testThings) hold(entityID ksuid.KSUID) func() {
+	gate := make(chan bool)
+
+	things.mu.Lock()
+	things.gates[entityID] = gate
+	things.mu.Unlock()
+
+	return func() {
+		things.mu.Lock()
+		delete(things.gates, entityID)
+		things.mu.Unlock()
+
+		close(gate)
+	}
+}
+
+func (things *testThings) getAdded(entityID ksuid.KSUID) []float64 {
+	things.mu.Lock()
+	defer things.mu.Unlock()
+
+	return append([]float64{}, things.added[entityID]...)
+}
+
+func setupWriterHostTest(t *testing.T) (*WriterHostImplementation, *testThings, *nats.Conn) {
+	t.Helper()
+
+	// no reaper (which would take up to its period to stop)
+	t.Setenv("WRITER_IDLE_TIMEOUT", "0s")
+
+	d := in_memory.Setup(t)
+
+	things := &testThings{
+		added:   make(map[ksuid.KSUID][]float64),
+		gates:   make(map[ksuid.KSUID]chan bool),
+		entered: make(chan ksuid.KSUID, 16),
+	}
+
+	host := NewWriterHost("thing", tenants.DefaultTenantID, things.newAggregate)
+
+	natsWorker := d.NewNatsWorker("test")
+
+	in_memory.Start(t, host, natsWorker)
+
+	natsConn, err := natsWorker.GetNatsConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return host, things, natsConn
+}
+
+// send makes an "add" call for the given entity without waiting on it; its response goes to the given inbox
+func send(t *testing.T, natsConn *nats.Conn, inbox string, entityID ksuid.KSUID, value int) {
+	t.Helper()
+
+	codec, err := codecs.GetDefault()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestJSON, err := (&calls.Request{Endpoint: "add", Data: json.RawMessage(fmt.Sprintf(`{"value": %v}`, value))}).ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := fmt.Sprintf("thing.%v.add", entityID)
+
+	msg, err := newMsg(fmt.Sprintf("event.%v", address), events.NewWithoutCorrelation(address, requestJSON), codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg.Reply = inbox
+
+	err = natsConn.PublishMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the error of each of the next count responses on the given subscription ("" for success)
+func receive(t *testing.T, subscription *nats.Subscription, count int) []string {
+	t.Helper()
+
+	errs := make([]string, 0, count)
+
+	for len(errs) < count {
+		msg, err := subscription.NextMsg(time.Second * 10)
+		if err != nil {
+			t.Fatalf("after %v of %v responses: %v", len(errs), count, err)
+		}
+
+		event, _, err := decodeMsg(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := calls.ResponseFromJSON(event.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs = append(errs, response.Error)
+	}
+
+	return errs
+}
+
+func subscribeInbox(t *testing.T, natsConn *nats.Conn) (string, *nats.Subscription) {
+	t.Helper()
+
+	inbox := nats.NewInbox()
+
+	subscription, err := natsConn.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = subscription.SetPendingLimits(-1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return inbox, subscription
+}
+
+func waitForEntityCount(t *testing.T, host *WriterHostImplementation, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 10)
+
+	for host.GetEntityCount() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v entities, have %v", count, host.GetEntityCount())
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWriterHostEvictsOnceNothingIsPending(t *testing.T) {
+	host, things, natsConn := setupWriterHostTest(t)
+	inbox, subscription := subscribeInbox(t, natsConn)
+
+	entityID := ksuid.New()
+
+	release := things.hold(entityID)
+
+	send(t, natsConn, inbox, entityID, 1)
+
+	<-things.entered
+
+	err := Evict(natsConn, fmt.Sprintf("thing.%v", entityID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler hasn't finished, so the writer has to stay up
+	time.Sleep(time.Millisecond * 100)
+	if host.GetEntityCount() != 1 {
+		t.Fatalf("expected the busy entity to still be up, have %v entities", host.GetEntityCount())
+	}
+
+	release()
+
+	if errs := receive(t, subscription, 1); errs[0] != "" {
+		t.Fatal(errs[0])
+	}
+
+	waitForEntityCount(t, host, 0)
+
+	// and the next call brings it back up from the store (replaying the first call ahead of it)
+	send(t, natsConn, inbox, entityID, 2)
+
+	if errs := receive(t, subscription, 1); errs[0] != "" {
+		t.Fatal(errs[0])
+	}
+
+	if added := things.getAdded(entityID); fmt.Sprint(added) != fmt.Sprint([]float64{1, 1, 2}) {
+		t.Fatalf("expected [1 1 2], got %v", added)
+	}
+}
+
+func TestWriterHostRefusesWhenTheQueueIsFull(t *testing.T) {
+	_, things, natsConn := setupWriterHostTest(t)
+	inbox, subscription := subscribeInbox(t, natsConn)
+
+	entityID := ksuid.New()
+
+	release := things.hold(entityID)
+
+	// one being handled, a queue's worth waiting and the rest more than it can take
+	count := hostedEntityBufferSize + 10
+
+	for i := 0; i < count; i++ {
+		send(t, natsConn, inbox, entityID, i)
+	}
+
+	<-things.entered
+
+	refusals := receive(t, subscription, count-hostedEntityBufferSize-1)
+
+	for _, refusal := range refusals {
+		if !strings.Contains(refusal, "busy") {
+			t.Fatalf("expected a refusal for being busy, got %#+v", refusal)
+		}
+	}
+
+	release()
+
+	errs := receive(t, subscription, hostedEntityBufferSize+1)
+
+	for _, err := range errs {
+		if err != "" && !strings.Contains(err, "busy") {
+			t.Fatalf("expected success or a refusal for being busy, got %#+v", err)
+		}
+	}
+
+	refused := len(refusals)
+	for _, err := range errs {
+		if err != "" {
+			refused++
+		}
+	}
+
+	if added := things.getAdded(entityID); len(added) != count-refused {
+		t.Fatalf("expected %v added (of %v sent, %v refused), got %v", count-refused, count, refused, len(added))
+	}
+}
+
+func TestWriterHostOrdersPerEntityAndDispatchesEntitiesIndependently(t *testing.T) {
+	host, things, natsConn := setupWriterHostTest(t)
+	slowInbox, slowSubscription := subscribeInbox(t, natsConn)
+	fastInbox, fastSubscription := subscribeInbox(t, natsConn)
+
+	slowEntityID := ksuid.New()
+	fastEntityID := ksuid.New()
+
+	release := things.hold(slowEntityID)
+
+	for i := 1; i <= 5; i++ {
+		send(t, natsConn, slowInbox, slowEntityID, i)
+	}
+
+	<-things.entered
+
+	for i := 1; i <= 5; i++ {
+		send(t, natsConn, fastInbox, fastEntityID, i)
+	}
+
+	// the other entity gets a writer and a queue of its own rather than waiting behind the held up one (on SQLite the
+	// writers share a lock on the database, so it's only its handler that has to wait its turn)
+	deadline := time.Now().Add(time.Second * 10)
+
+	for {
+		host.mu.Lock()
+		entity := host.entities[fastEntityID.String()]
+		pending := 0
+		if entity != nil {
+			pending = entity.pending
+		}
+		host.mu.Unlock()
+
+		if pending == 5 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 5 pending for the other entity, have %v", pending)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	release()
+
+	for _, subscription := range []*nats.Subscription{slowSubscription, fastSubscription} {
+		for _, err := range receive(t, subscription, 5) {
+			if err != "" {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, entityID := range []ksuid.KSUID{slowEntityID, fastEntityID} {
+		added := things.getAdded(entityID)
+		if fmt.Sprint(added) != fmt.Sprint([]float64{1, 2, 3, 4, 5}) {
+			t.Errorf("expected [1 2 3 4 5] for %v, got %v", entityID, added)
+		}
+	}
+}
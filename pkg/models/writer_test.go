@@ -0,0 +1,983 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/calls"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/states"
+	"github.com/initialed85/uneventful/pkg/models/tenants"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/ksuid"
+)
+
+// testLedgerVersion is the version of the ledger's state; a snapshot of any other can't be restored
+const testLedgerVersion = 2
+
+// testLedger is the aggregate for the writer tests; "add" takes a value as of the time of the request, unless it would
+// take the total below zero, and lets the notifications domain know of it if asked to
+type testLedger struct {
+	Version   int               `json:"version"`
+	Total     float64           `json:"total"`
+	Entries   []testLedgerEntry `json:"entries"`
+	entityID  ksuid.KSUID
+	decisions int    // how many times "add" has been handled
+	onDecide  func() // called as "add" is handled (e.g. to cancel the request)
+}
+
+type testLedgerEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+type testValue struct {
+	Value  float64 `json:"value"`
+	Notify bool    `json:"notify"`
+}
+
+func (l *testLedger) decide(ctx HandlerContext, value testValue) (testLedgerEntry, error) {
+	l.decisions++
+
+	if l.onDecide != nil {
+		l.onDecide()
+	}
+
+	if l.Total+value.Value < 0 {
+		return testLedgerEntry{}, fmt.Errorf("adding %v would take the total of %v below zero", value.Value, l.Total)
+	}
+
+	return testLedgerEntry{Timestamp: ctx.Timestamp, Value: value.Value}, nil
+}
+
+func (l *testLedger) getOutgoing(value testValue, entry testLedgerEntry) []OutgoingEvent {
+	if !value.Notify {
+		return nil
+	}
+
+	return []OutgoingEvent{{Name: "notifications", EntityID: l.entityID, Endpoint: "ledger_added", Data: entry}}
+}
+
+func (l *testLedger) apply(entry testLedgerEntry) {
+	l.Total += entry.Value
+	l.Entries = append(l.Entries, entry)
+}
+
+// addTestLedgerHandlers adds the "add" handler for the given ledger; for an event sourced writer it decides on an "added"
+// domain event and leaves taking it to the evolvers
+func addTestLedgerHandlers(handlers Handlers, ledger *testLedger, eventSourced bool) {
+	if !eventSourced {
+		_ = AddTypedHandler(handlers, "add", func(ctx HandlerContext, tenantID string, _ ksuid.KSUID, value testValue) (interface{}, error) {
+			entry, err := ledger.decide(ctx, value)
+			if err != nil {
+				return nil, err
+			}
+
+			ledger.apply(entry)
+
+			return Outcome{Result: ledger, Outgoing: ledger.getOutgoing(value, entry)}, nil
+		})
+
+		return
+	}
+
+	_ = AddDecider(handlers, "add", func(ctx HandlerContext, tenantID string, _ ksuid.KSUID, value testValue) (Outcome, error) {
+		entry, err := ledger.decide(ctx, value)
+		if err != nil {
+			return Outcome{}, err
+		}
+
+		return Outcome{Result: []DomainEvent{{TypeName: "added", Data: entry}}, Outgoing: ledger.getOutgoing(value, entry)}, nil
+	})
+}
+
+func newTestLedgerEvolvers(ledger *testLedger) Evolvers {
+	evolvers := NewEvolvers()
+
+	_ = AddTypedEvolver(evolvers, "added", func(entry testLedgerEntry) error {
+		ledger.apply(entry)
+
+		return nil
+	})
+
+	return evolvers
+}
+
+// newTestLedgerAggregate returns a ledger of its own along with its handlers (and evolvers)
+func newTestLedgerAggregate(entityID ksuid.KSUID, eventSourced bool) *Aggregate {
+	ledger := &testLedger{Version: testLedgerVersion, entityID: entityID}
+
+	handlers := NewHandlers()
+
+	addTestLedgerHandlers(handlers, ledger, eventSourced)
+
+	aggregate := Aggregate{
+		Handlers: handlers,
+		GetState: func() (interface{}, error) {
+			return ledger, nil
+		},
+		RestoreState: func(data json.RawMessage) error {
+			restored := testLedger{entityID: ledger.entityID, decisions: ledger.decisions, onDecide: ledger.onDecide}
+
+			err := json.Unmarshal(data, &restored)
+			if err != nil {
+				return err
+			}
+
+			if restored.Version != testLedgerVersion {
+				return fmt.Errorf("snapshot is of version %v of the ledger, not %v", restored.Version, testLedgerVersion)
+			}
+
+			*ledger = restored
+
+			return nil
+		},
+	}
+
+	if eventSourced {
+		aggregate.Evolvers = newTestLedgerEvolvers(ledger)
+	}
+
+	return &aggregate
+}
+
+// newTestLedgerWriter returns a writer for a ledger; it isn't subscribed to anything, requests are handed straight to
+// it (see handleTestRequest)
+func newTestLedgerWriter(entityID ksuid.KSUID, eventSourced bool) *WriterImplementation {
+	aggregate := newTestLedgerAggregate(entityID, eventSourced)
+
+	w := NewWriterForTenantWithOverrides(
+		fmt.Sprintf("ledger.%v", entityID),
+		tenants.DefaultTenantID,
+		entityID,
+		aggregate.GetState,
+		aggregate.RestoreState,
+		"",
+		"",
+		false,
+		false,
+		true,
+	)
+
+	w.Handlers = aggregate.Handlers
+
+	if eventSourced {
+		w.SetEvolvers(aggregate.Evolvers)
+	}
+
+	w.SetAggregateFactory(func() *Aggregate {
+		return newTestLedgerAggregate(entityID, eventSourced)
+	})
+
+	return w
+}
+
+// newTestRequest returns a request (as the event that carries it) for the given endpoint of the given ledger
+func newTestRequest(t *testing.T, entityID ksuid.KSUID, endpoint string, value float64) *events.Event {
+	t.Helper()
+
+	return newTestRequestWithData(t, entityID, endpoint, fmt.Sprintf(`{"value": %v}`, value))
+}
+
+func newTestRequestWithData(t *testing.T, entityID ksuid.KSUID, endpoint string, data string) *events.Event {
+	t.Helper()
+
+	requestJSON, err := (&calls.Request{Endpoint: endpoint, Data: json.RawMessage(data)}).ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events.NewWithoutCorrelation(fmt.Sprintf("ledger.%v.%v", entityID, endpoint), requestJSON)
+}
+
+// handleTestRequest hands the request carried by the given event to the writer, as its handler would (less the message)
+func handleTestRequest(ctx context.Context, w *WriterImplementation, event *events.Event) error {
+	databaseEvent, err := event.ToDatabaseEvent()
+	if err != nil {
+		return err
+	}
+
+	handledEvent := *event
+
+	err = w.Upcast(&handledEvent)
+	if err != nil {
+		return err
+	}
+
+	request, err := calls.RequestFromJSON(handledEvent.Data)
+	if err != nil {
+		return err
+	}
+
+	db, err := w.databaseWorker.GetDB()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.handle(ctx, db, event, request, databaseEvent)
+}
+
+func getTestLedger(t *testing.T, w *WriterImplementation) *testLedger {
+	t.Helper()
+
+	state, err := w.getStateCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state.(*testLedger)
+}
+
+func getTestState(t *testing.T, w *WriterImplementation) []byte {
+	t.Helper()
+
+	stateJSON, err := w.getStateJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stateJSON
+}
+
+func getTestDatabaseEvents(t *testing.T, w *WriterImplementation) []*events.DatabaseEvent {
+	t.Helper()
+
+	db, err := w.databaseWorker.GetDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	databaseEvents := make([]*events.DatabaseEvent, 0)
+
+	err = db.Where("stream_id = ?", w.streamID).Order("sequence").Find(&databaseEvents).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return databaseEvents
+}
+
+// getTestEvents returns the writer's stream as stored (less the times the database keeps for itself)
+func getTestEvents(t *testing.T, w *WriterImplementation) []byte {
+	t.Helper()
+
+	databaseEvents := getTestDatabaseEvents(t, w)
+
+	for _, databaseEvent := range databaseEvents {
+		databaseEvent.CreatedAt = time.Time{}
+		databaseEvent.UpdatedAt = time.Time{}
+	}
+
+	data, err := json.Marshal(databaseEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestWriterReplayIsDeterministic(t *testing.T) {
+	requestedAt := time.Date(2024, 2, 29, 13, 14, 15, 0, time.UTC)
+	replayedAt := requestedAt.Add(time.Hour * 24 * 365)
+
+	t.Cleanup(func() {
+		helpers.SetClock(nil)
+	})
+
+	entityID := ksuid.New()
+
+	helpers.SetClock(helpers.ClockFunc(func() time.Time { return requestedAt }))
+
+	// the same requests (IDs and all) for every run; the third is refused
+	requests := make([]*events.Event, 0)
+	for _, value := range []float64{10, -3, -100, 5} {
+		requests = append(requests, newTestRequest(t, entityID, "add", value))
+	}
+
+	for _, eventSourced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("event_sourced=%v", eventSourced), func(t *testing.T) {
+			var stateJSONs, eventsJSONs [2][]byte
+
+			for i := range stateJSONs {
+				t.Run(fmt.Sprintf("run=%v", i), func(t *testing.T) {
+					_ = in_memory.Setup(t)
+
+					helpers.SetClock(helpers.ClockFunc(func() time.Time { return requestedAt }))
+
+					w := newTestLedgerWriter(entityID, eventSourced)
+
+					in_memory.Start(t, w)
+
+					for j, request := range requests {
+						err := handleTestRequest(context.Background(), w, request)
+						if (err != nil) != (j == 2) {
+							t.Fatalf("unexpected outcome for request %v: %v", j, err)
+						}
+					}
+
+					// a fresh writer comes up a year later with nothing but the stream to go on
+					helpers.SetClock(helpers.ClockFunc(func() time.Time { return replayedAt }))
+
+					replayed := newTestLedgerWriter(entityID, eventSourced)
+
+					in_memory.Start(t, replayed)
+
+					stateJSONs[i] = getTestState(t, replayed)
+					eventsJSONs[i] = getTestEvents(t, replayed)
+
+					if stateJSON := getTestState(t, w); !bytes.Equal(stateJSONs[i], stateJSON) {
+						t.Errorf("expected the replayed state to be %s, got %s", stateJSON, stateJSONs[i])
+					}
+				})
+			}
+
+			if !bytes.Equal(stateJSONs[0], stateJSONs[1]) {
+				t.Errorf("expected the same state from both runs, got %s and %s", stateJSONs[0], stateJSONs[1])
+			}
+
+			if !bytes.Equal(eventsJSONs[0], eventsJSONs[1]) {
+				t.Errorf("expected the same events from both runs, got %s and %s", eventsJSONs[0], eventsJSONs[1])
+			}
+		})
+	}
+}
+
+// getTestTypeNames returns the type name (relative to the entity) of each event in the writer's stream, marking those
+// that were rejected
+func getTestTypeNames(t *testing.T, w *WriterImplementation) string {
+	t.Helper()
+
+	typeNames := make([]string, 0)
+
+	for _, databaseEvent := range getTestDatabaseEvents(t, w) {
+		typeName := getRelativeTypeName(databaseEvent.TypeName)
+		if databaseEvent.IsRejected {
+			typeName += "(rejected)"
+		}
+
+		typeNames = append(typeNames, typeName)
+	}
+
+	return fmt.Sprint(typeNames)
+}
+
+func TestWriterEvolversRebuildStateOnRestart(t *testing.T) {
+	_ = in_memory.Setup(t)
+
+	entityID := ksuid.New()
+
+	w := newTestLedgerWriter(entityID, true)
+
+	in_memory.Start(t, w)
+
+	for i, value := range []float64{10, -3, -100, 5} {
+		err := handleTestRequest(context.Background(), w, newTestRequest(t, entityID, "add", value))
+		if (err != nil) != (i == 2) {
+			t.Fatalf("unexpected outcome for request %v: %v", i, err)
+		}
+	}
+
+	// what was decided is stored in place of the requests (other than the refused one)
+	if typeNames := getTestTypeNames(t, w); typeNames != "[added added add(rejected) added]" {
+		t.Fatalf("expected [added added add(rejected) added], got %v", typeNames)
+	}
+
+	restarted := newTestLedgerWriter(entityID, true)
+
+	in_memory.Start(t, restarted)
+
+	ledger := getTestLedger(t, restarted)
+
+	if ledger.Total != 12 || len(ledger.Entries) != 3 {
+		t.Errorf("expected total=12 from 3 entries, got %#+v", ledger)
+	}
+
+	// the evolvers take what was decided as it is; nothing is decided again
+	if ledger.decisions != 0 {
+		t.Errorf("expected no decisions on restart, got %v", ledger.decisions)
+	}
+}
+
+func TestWriterEvolversReplayRequestsFromBeforeTheSwitch(t *testing.T) {
+	_ = in_memory.Setup(t)
+
+	entityID := ksuid.New()
+
+	before := newTestLedgerWriter(entityID, false)
+
+	in_memory.Start(t, before)
+
+	for i, value := range []float64{10, -100, -3} {
+		err := handleTestRequest(context.Background(), before, newTestRequest(t, entityID, "add", value))
+		if (err != nil) != (i == 1) {
+			t.Fatalf("unexpected outcome for request %v: %v", i, err)
+		}
+	}
+
+	after := newTestLedgerWriter(entityID, true)
+
+	in_memory.Start(t, after)
+
+	// the requests from before are decided on once more (the refused one aside) and the domain events evolved
+	ledger := getTestLedger(t, after)
+
+	if ledger.Total != 7 || len(ledger.Entries) != 2 || ledger.decisions != 2 {
+		t.Fatalf("expected total=7 from 2 entries (and 2 decisions), got %#+v", ledger)
+	}
+
+	err := handleTestRequest(context.Background(), after, newTestRequest(t, entityID, "add", 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with what's decided from here on stored after them
+	if typeNames := getTestTypeNames(t, after); typeNames != "[add add(rejected) add added]" {
+		t.Fatalf("expected [add add(rejected) add added], got %v", typeNames)
+	}
+
+	restarted := newTestLedgerWriter(entityID, true)
+
+	in_memory.Start(t, restarted)
+
+	if stateJSON, restartedStateJSON := getTestState(t, after), getTestState(t, restarted); !bytes.Equal(stateJSON, restartedStateJSON) {
+		t.Errorf("expected the restarted state to be %s, got %s", stateJSON, restartedStateJSON)
+	}
+}
+
+func TestWriterEvolversRejectDuplicates(t *testing.T) {
+	_ = in_memory.Setup(t)
+
+	entityID := ksuid.New()
+
+	w := newTestLedgerWriter(entityID, true)
+
+	in_memory.Start(t, w)
+
+	handled := newTestRequest(t, entityID, "add", 10)
+	refused := newTestRequest(t, entityID, "add", -100)
+
+	err := handleTestRequest(context.Background(), w, handled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handleTestRequest(context.Background(), w, refused)
+	if err == nil {
+		t.Fatal("expected the request to be refused")
+	}
+
+	restarted := newTestLedgerWriter(entityID, true)
+
+	in_memory.Start(t, restarted)
+
+	// a handled request was stored as its domain event (under an ID derived from it), so that's what it's found as
+	for _, writer := range []*WriterImplementation{w, restarted} {
+		for _, c := range []struct {
+			request *events.Event
+			outcome string
+		}{
+			{request: handled, outcome: ""},
+			{request: refused, outcome: "below zero"},
+		} {
+			err = handleTestRequest(context.Background(), writer, c.request)
+			if !errors.Is(err, events.ErrDuplicateEvent) {
+				t.Fatalf("expected a duplicate, got %v", err)
+			}
+
+			databaseEvent, err := c.request.ToDatabaseEvent()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = writer.getOriginalOutcome(writer.streamID, databaseEvent)
+			if (c.outcome == "" && err != nil) || (c.outcome != "" && (err == nil || !strings.Contains(err.Error(), c.outcome))) {
+				t.Errorf("expected the original outcome %#+v, got %v", c.outcome, err)
+			}
+		}
+	}
+
+	// and none of it was decided on again
+	if decisions := getTestLedger(t, w).decisions; decisions != 2 {
+		t.Errorf("expected 2 decisions, got %v", decisions)
+	}
+
+	if decisions := getTestLedger(t, restarted).decisions; decisions != 0 {
+		t.Errorf("expected no decisions after the restart, got %v", decisions)
+	}
+
+	if typeNames := getTestTypeNames(t, w); typeNames != "[added add(rejected)]" {
+		t.Errorf("expected [added add(rejected)], got %v", typeNames)
+	}
+
+	domainEventID, err := getDomainEventID(handled.EventID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if databaseEvents := getTestDatabaseEvents(t, w); databaseEvents[0].EventID != domainEventID.String() {
+		t.Errorf("expected the domain event to have event_id=%v, got %v", domainEventID, databaseEvents[0].EventID)
+	}
+}
+
+func TestWriterPublishesOutgoingEventsOnlyOnceCommitted(t *testing.T) {
+	for _, eventSourced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("event_sourced=%v", eventSourced), func(t *testing.T) {
+			d := in_memory.Setup(t)
+
+			entityID := ksuid.New()
+
+			w := newTestLedgerWriter(entityID, eventSourced)
+			natsWorker := d.NewNatsWorker("test")
+
+			in_memory.Start(t, w, natsWorker)
+
+			natsConn, err := natsWorker.GetNatsConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// what had been committed for each outgoing event as it was published
+			type published struct {
+				event   *events.Event
+				version int64
+			}
+
+			received := make(chan published, 16)
+
+			_, err = natsConn.Subscribe("event.notifications.>", func(msg *nats.Msg) {
+				event, _, err := decodeMsg(msg)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				version, err := w.newEventStore(d.GetTestDB(t)).GetVersion(w.streamID)
+				if err != nil {
+					t.Error(err)
+				}
+
+				received <- published{event: event, version: version}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = natsConn.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectNext := func(request *events.Event, version int64) {
+				t.Helper()
+
+				select {
+				case p := <-received:
+					if p.event.CausationID != request.EventID || p.event.TypeName != fmt.Sprintf("notifications.%v.ledger_added", entityID) {
+						t.Fatalf("expected an outgoing event caused by event_id=%v, got %#+v", request.EventID, p.event)
+					}
+
+					if p.version < version {
+						t.Fatalf("expected the request to be committed (version=%v) before its outgoing event was published, was at version=%v", version, p.version)
+					}
+				case <-time.After(time.Second * 5):
+					t.Fatalf("expected an outgoing event caused by event_id=%v", request.EventID)
+				}
+			}
+
+			first := newTestRequestWithData(t, entityID, "add", `{"value": 10, "notify": true}`)
+
+			err = handleTestRequest(context.Background(), w, first)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectNext(first, 1)
+
+			// refused by the handler
+			err = handleTestRequest(context.Background(), w, newTestRequestWithData(t, entityID, "add", `{"value": -100, "notify": true}`))
+			if err == nil {
+				t.Fatal("expected the request to be refused")
+			}
+
+			// rolled back after the handler (its caller having given up on it)
+			ctx, cancel := context.WithCancel(context.Background())
+			getTestLedger(t, w).onDecide = cancel
+
+			err = handleTestRequest(ctx, w, newTestRequestWithData(t, entityID, "add", `{"value": 1, "notify": true}`))
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected the request to be cancelled, got %v", err)
+			}
+
+			getTestLedger(t, w).onDecide = nil
+
+			// the outgoing events go out in the order they're committed, so this would come after any for the above
+			last := newTestRequestWithData(t, entityID, "add", `{"value": 5, "notify": true}`)
+
+			err = handleTestRequest(context.Background(), w, last)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectNext(last, 3)
+
+			// and a replay doesn't publish them again
+			restarted := newTestLedgerWriter(entityID, eventSourced)
+
+			in_memory.Start(t, restarted)
+
+			select {
+			case p := <-received:
+				t.Fatalf("expected nothing more to be published, got %#+v", p.event)
+			case <-time.After(time.Millisecond * 100):
+			}
+		})
+	}
+}
+
+func TestWriterDoesNotHandleACallPastItsDeadline(t *testing.T) {
+	_ = in_memory.Setup(t)
+
+	entityID := ksuid.New()
+
+	aggregate := newTestLedgerAggregate(entityID, false)
+
+	w := NewWriterForTenant("ledger", tenants.DefaultTenantID, entityID, aggregate.GetState, aggregate.RestoreState)
+	w.Handlers = aggregate.Handlers
+
+	caller := NewCaller("test", ksuid.New())
+
+	in_memory.Start(t, w, caller)
+
+	// the first call holds the writer up until it's released
+	entered := make(chan bool)
+	release := make(chan bool)
+	once := sync.Once{}
+
+	getTestLedger(t, w).onDecide = func() {
+		once.Do(func() {
+			entered <- true
+			<-release
+		})
+	}
+
+	errs := make(chan error)
+
+	go func() {
+		errs <- caller.Call("ledger", entityID, "add", []byte(`{"value": 10}`))
+	}()
+
+	<-entered
+
+	// so this one waits behind it until well after its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	err := caller.CallWithContext(ctx, "ledger", entityID, "add", []byte(`{"value": 1}`), CallOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the call to reach its deadline, got %v", err)
+	}
+
+	close(release)
+
+	err = <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// calls are handled in order, so by the time this one is the one past its deadline has been dealt with
+	err = caller.Call("ledger", entityID, "add", []byte(`{"value": 100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ledger := getTestLedger(t, w); ledger.Total != 110 || ledger.decisions != 2 {
+		t.Errorf("expected total=110 from 2 decisions, got %#+v", ledger)
+	}
+
+	if typeNames := getTestTypeNames(t, w); typeNames != "[add add]" {
+		t.Errorf("expected [add add], got %v", typeNames)
+	}
+}
+
+func TestWriterRollsBackACallCancelledWhileItsHandled(t *testing.T) {
+	for _, eventSourced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("event_sourced=%v", eventSourced), func(t *testing.T) {
+			_ = in_memory.Setup(t)
+
+			entityID := ksuid.New()
+
+			w := newTestLedgerWriter(entityID, eventSourced)
+
+			in_memory.Start(t, w)
+
+			err := handleTestRequest(context.Background(), w, newTestRequest(t, entityID, "add", 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stateJSON := getTestState(t, w)
+			typeNames := getTestTypeNames(t, w)
+
+			// the handler has changed (or decided on changing) state by the time the caller gives up
+			ctx, cancel := context.WithCancel(context.Background())
+			getTestLedger(t, w).onDecide = cancel
+
+			err = handleTestRequest(ctx, w, newTestRequest(t, entityID, "add", 1))
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected the request to be cancelled, got %v", err)
+			}
+
+			getTestLedger(t, w).onDecide = nil
+
+			if cancelledStateJSON := getTestState(t, w); !bytes.Equal(stateJSON, cancelledStateJSON) {
+				t.Errorf("expected the state to be put back to %s, got %s", stateJSON, cancelledStateJSON)
+			}
+
+			if cancelledTypeNames := getTestTypeNames(t, w); cancelledTypeNames != typeNames {
+				t.Errorf("expected nothing more to be stored than %v, got %v", typeNames, cancelledTypeNames)
+			}
+
+			// and the writer carries on from where it was
+			err = handleTestRequest(context.Background(), w, newTestRequest(t, entityID, "add", 5))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.version != 2 || getTestLedger(t, w).Total != 15 {
+				t.Errorf("expected version=2 and total=15, got version=%v and %#+v", w.version, getTestLedger(t, w))
+			}
+
+			restarted := newTestLedgerWriter(entityID, eventSourced)
+
+			in_memory.Start(t, restarted)
+
+			if stateJSON, restartedStateJSON := getTestState(t, w), getTestState(t, restarted); !bytes.Equal(stateJSON, restartedStateJSON) {
+				t.Errorf("expected the restarted state to be %s, got %s", stateJSON, restartedStateJSON)
+			}
+		})
+	}
+}
+
+// getTestSnapshots returns the sequence of each snapshot of the writer's stream
+func getTestSnapshots(t *testing.T, w *WriterImplementation) string {
+	t.Helper()
+
+	db, err := w.databaseWorker.GetDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequences := make([]int64, 0)
+
+	err = db.Model(&states.DatabaseState{}).Where("name = ?", w.streamID).Order("sequence").Pluck("sequence", &sequences).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprint(sequences)
+}
+
+func TestWriterRestartsFromTheLatestSnapshot(t *testing.T) {
+	for _, eventSourced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("event_sourced=%v", eventSourced), func(t *testing.T) {
+			_ = in_memory.Setup(t)
+
+			t.Setenv("SNAPSHOT_EVENTS", "2")
+			t.Setenv("SNAPSHOT_INTERVAL", "0s")
+
+			entityID := ksuid.New()
+
+			w := newTestLedgerWriter(entityID, eventSourced)
+
+			in_memory.Start(t, w)
+
+			for _, value := range []float64{10, 5, 1, 2, 3} {
+				err := handleTestRequest(context.Background(), w, newTestRequest(t, entityID, "add", value))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if snapshots := getTestSnapshots(t, w); snapshots != "[2 4]" {
+				t.Fatalf("expected snapshots at [2 4], got %v", snapshots)
+			}
+
+			// so that what a restarted writer replayed isn't reset by it snapshotting
+			t.Setenv("SNAPSHOT_EVENTS", "0")
+
+			cases := []struct {
+				name     string
+				tamper   func(t *testing.T, databaseState *states.DatabaseState)
+				replayed int64
+			}{
+				{
+					name:     "from the latest snapshot and the event after it",
+					replayed: 1,
+				},
+				{
+					name: "a full replay if the latest snapshot is of another version",
+					tamper: func(t *testing.T, databaseState *states.DatabaseState) {
+						ledger := make(map[string]interface{})
+
+						err := json.Unmarshal(databaseState.Data.Bytes, &ledger)
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						ledger["version"] = testLedgerVersion - 1
+
+						databaseState.Data.Bytes, err = json.Marshal(ledger)
+						if err != nil {
+							t.Fatal(err)
+						}
+					},
+					replayed: 5,
+				},
+			}
+
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					if c.tamper != nil {
+						db, err := w.databaseWorker.GetDB()
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						databaseState, err := states.GetLatest(db, w.streamID)
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						c.tamper(t, databaseState)
+
+						err = db.Model(&states.DatabaseState{}).Where("version_id = ?", databaseState.VersionID).Update("data", databaseState.Data).Error
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+
+					restarted := newTestLedgerWriter(entityID, eventSourced)
+
+					in_memory.Start(t, restarted)
+
+					if restarted.eventsSinceSnapshot != c.replayed {
+						t.Errorf("expected %v events replayed, got %v", c.replayed, restarted.eventsSinceSnapshot)
+					}
+
+					ledger := getTestLedger(t, restarted)
+
+					if ledger.Version != testLedgerVersion || ledger.Total != 21 || len(ledger.Entries) != 5 {
+						t.Errorf("expected version %v with total=21 from 5 entries, got %#+v", testLedgerVersion, ledger)
+					}
+
+					if stateJSON, restartedStateJSON := getTestState(t, w), getTestState(t, restarted); !bytes.Equal(stateJSON, restartedStateJSON) {
+						t.Errorf("expected the restarted state to be %s, got %s", stateJSON, restartedStateJSON)
+					}
+				})
+			}
+		})
+	}
+}
+
+// upcastTestValueFromSchemaVersion1 handles the requests from when the value of an "add" was its amount
+func upcastTestValueFromSchemaVersion1(data json.RawMessage) (json.RawMessage, error) {
+	value := make(map[string]interface{})
+
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+
+	value["value"] = value["amount"]
+	delete(value, "amount")
+
+	return json.Marshal(value)
+}
+
+func TestWriterUpcastsOnRead(t *testing.T) {
+	_ = in_memory.Setup(t)
+
+	t.Setenv("SNAPSHOT_EVENTS", "0")
+
+	entityID := ksuid.New()
+
+	newWriter := func() *WriterImplementation {
+		w := newTestLedgerWriter(entityID, false)
+
+		err := w.AddUpcaster("ledger.*.add", 1, NewRequestDataUpcaster(upcastTestValueFromSchemaVersion1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return w
+	}
+
+	w := newWriter()
+
+	in_memory.Start(t, w)
+
+	oldRequest := newTestRequestWithData(t, entityID, "add", `{"amount": 10}`)
+	oldRequest.SchemaVersion = 1
+
+	request := newTestRequest(t, entityID, "add", 5)
+	request.SchemaVersion = 2
+
+	for _, event := range []*events.Event{oldRequest, request} {
+		err := handleTestRequest(context.Background(), w, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if total := getTestLedger(t, w).Total; total != 15 {
+		t.Fatalf("expected total=15, got %v", total)
+	}
+
+	// requests are stored as they were received
+	databaseEvents := getTestDatabaseEvents(t, w)
+
+	if len(databaseEvents) != 2 || databaseEvents[0].SchemaVersion != 1 || !strings.Contains(string(databaseEvents[0].Data.Bytes), "amount") {
+		t.Fatalf("expected the first of 2 events stored at schema version 1 with its amount, got %#+v", databaseEvents)
+	}
+
+	// as if from a writer that knows of a later schema version than we do
+	newerRequest := newTestRequest(t, entityID, "add", 100)
+	newerRequest.SchemaVersion = 3
+
+	databaseEvent, err := newerRequest.ToDatabaseEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	databaseEvent.IsHandled = true
+
+	_, err = w.eventStore.Append(w.streamID, events.AnyVersion, databaseEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newWriter()
+
+	in_memory.Start(t, restarted)
+
+	// the old request is upcast as it's read and the newer one is skipped (rather than misread)
+	if total := getTestLedger(t, restarted).Total; total != 15 {
+		t.Errorf("expected total=15, got %v", total)
+	}
+
+	if restarted.eventsSinceSnapshot != 2 {
+		t.Errorf("expected 2 events replayed, got %v", restarted.eventsSinceSnapshot)
+	}
+}
@@ -0,0 +1,289 @@
+package retention
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type archiveWriter[A any] interface {
+	Write(rows []A) error
+	Close() error
+}
+
+type jsonlWriter[A any] struct {
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (w *jsonlWriter[A]) Write(rows []A) error {
+	for _, row := range rows {
+		err := w.encoder.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *jsonlWriter[A]) Close() error {
+	return w.buffer.Flush()
+}
+
+type parquetWriter[A any] struct {
+	writer *parquet.GenericWriter[A]
+}
+
+func (w *parquetWriter[A]) Write(rows []A) error {
+	_, err := w.writer.Write(rows)
+
+	return err
+}
+
+func (w *parquetWriter[A]) Close() error {
+	return w.writer.Close()
+}
+
+func newArchiveWriter[A any](file *os.File, format string) (archiveWriter[A], error) {
+	switch format {
+	case FormatJSONL:
+		buffer := bufio.NewWriter(file)
+		return &jsonlWriter[A]{buffer: buffer, encoder: json.NewEncoder(buffer)}, nil
+	case FormatParquet:
+		return &parquetWriter[A]{writer: parquet.NewGenericWriter[A](file)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown archive format %#+v", format)
+}
+
+// readArchive calls the callback with batches of rows from the archive until it's exhausted
+func readArchive[A any](path string, format string, callback func([]A) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	batch := make([]A, 0, archiveBatchSize)
+
+	switch format {
+	case FormatJSONL:
+		decoder := json.NewDecoder(bufio.NewReader(file))
+
+		for {
+			var row A
+
+			err = decoder.Decode(&row)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				return err
+			}
+
+			batch = append(batch, row)
+
+			if len(batch) >= archiveBatchSize {
+				err = callback(batch)
+				if err != nil {
+					return err
+				}
+
+				batch = batch[:0]
+			}
+		}
+
+		if len(batch) > 0 {
+			return callback(batch)
+		}
+
+		return nil
+	case FormatParquet:
+		reader := parquet.NewGenericReader[A](file)
+
+		defer func() {
+			_ = reader.Close()
+		}()
+
+		batch = batch[:archiveBatchSize]
+
+		for {
+			n, err := reader.Read(batch)
+			if n > 0 {
+				callbackErr := callback(batch[:n])
+				if callbackErr != nil {
+					return callbackErr
+				}
+			}
+
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+
+				return err
+			}
+		}
+	}
+
+	return fmt.Errorf("unknown archive format %#+v", format)
+}
+
+// GetArchiveFormat infers the format of an archive from its file extension
+func GetArchiveFormat(path string) (string, error) {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+
+	if format != FormatJSONL && format != FormatParquet {
+		return "", fmt.Errorf("cannot infer archive format from %#+v (expected .%v or .%v)", path, FormatJSONL, FormatParquet)
+	}
+
+	return format, nil
+}
+
+func getArchivePath(archivePath string, tableName string, start time.Time, end time.Time, format string) string {
+	return filepath.Join(
+		archivePath,
+		tableName,
+		fmt.Sprintf("%v_%v_%v.%v", tableName, start.UTC().Format(archiveTimeFormat), end.UTC().Format(archiveTimeFormat), format),
+	)
+}
+
+// archiveRows writes every row (including soft-deleted ones) created in [start, end) to path, going via a temporary
+// file so that a partially written archive is never mistaken for a complete one
+func archiveRows[D any, A any](db *gorm.DB, start time.Time, end time.Time, path string, format string, convert func(*D) A) (count int64, err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return 0, err
+	}
+
+	tempPath := fmt.Sprintf("%v.tmp", path)
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = file.Close()
+
+		if err != nil || count == 0 {
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	writer, err := newArchiveWriter[A](file, format)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Unscoped().Model(new(D)).Where("created_at >= ? AND created_at < ?", start, end).Order("created_at ASC").Rows()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	batch := make([]A, 0, archiveBatchSize)
+
+	for rows.Next() {
+		row := new(D)
+
+		err = db.ScanRows(rows, row)
+		if err != nil {
+			return 0, err
+		}
+
+		batch = append(batch, convert(row))
+
+		if len(batch) >= archiveBatchSize {
+			err = writer.Write(batch)
+			if err != nil {
+				return 0, err
+			}
+
+			count += int64(len(batch))
+			batch = batch[:0]
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(batch) > 0 {
+		err = writer.Write(batch)
+		if err != nil {
+			return 0, err
+		}
+
+		count += int64(len(batch))
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// importRows inserts every row from an archive, skipping any that are already present
+func importRows[D any, A any](db *gorm.DB, path string, format string, convert func(*A) (*D, error)) (int64, error) {
+	count := int64(0)
+
+	err := readArchive[A](path, format, func(archivedRows []A) error {
+		rows := make([]*D, 0, len(archivedRows))
+
+		for i := range archivedRows {
+			row, err := convert(&archivedRows[i])
+			if err != nil {
+				return err
+			}
+
+			rows = append(rows, row)
+		}
+
+		returnedDB := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+		if returnedDB.Error != nil {
+			return returnedDB.Error
+		}
+
+		count += returnedDB.RowsAffected
+
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,259 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
+	"gorm.io/gorm"
+)
+
+type window struct {
+	start time.Time
+	end   time.Time
+}
+
+// Archiver applies the retention policies on a schedule; for TimescaleDB it archives (unless there's no archive format)
+// and then drops whole chunks, for SQLite it does the same thing a day at a time
+type Archiver struct {
+	lifecycles.Worker
+	name           string
+	databaseWorker database_worker.Worker
+	policies       []*Policy
+	archivePath    string
+	archivePeriod  time.Duration
+	lastArchivedAt time.Time
+	useSQLite      bool
+}
+
+func NewArchiver(name string) (*Archiver, error) {
+	policies, err := GetPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	archivePath, err := helpers.GetEnvironmentVariable("ARCHIVE_PATH", false, defaultArchivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	archivePeriod, err := getDuration("ARCHIVE_PERIOD", defaultArchivePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	if archivePeriod == 0 {
+		return nil, fmt.Errorf("ARCHIVE_PERIOD: must be greater than zero")
+	}
+
+	name = fmt.Sprintf("archiver_%v", name)
+
+	a := Archiver{
+		name:           name,
+		databaseWorker: dependencies.Get().NewDatabaseWorker(name),
+		policies:       policies,
+		archivePath:    archivePath,
+		archivePeriod:  archivePeriod,
+	}
+
+	// stopping a scheduled worker waits for its next tick, so tick often and only do the work once per period
+	a.Worker = lifecycles.NewScheduledWorker(name, a.setup, a.work, a.workErrorHandler, a.teardown, archiveTick)
+
+	return &a, nil
+}
+
+func (a *Archiver) setup() error {
+	err := lifecycles.Setup(a.databaseWorker)
+	if err != nil {
+		return err
+	}
+
+	db, err := a.databaseWorker.GetDB()
+	if err != nil {
+		_ = lifecycles.Teardown(a.databaseWorker)
+		return err
+	}
+
+	a.useSQLite = helpers.IsSQLite(db)
+
+	for _, policy := range a.policies {
+		err = Apply(db, policy)
+		if err != nil {
+			_ = lifecycles.Teardown(a.databaseWorker)
+			return err
+		}
+
+		log.Printf(
+			"%v - %v: compress_after=%v, drop_after=%v, archive_format=%#+v",
+			a.name, policy.Table, policy.CompressAfter, policy.DropAfter, policy.ArchiveFormat,
+		)
+	}
+
+	return nil
+}
+
+func (a *Archiver) teardown() error {
+	return lifecycles.Teardown(a.databaseWorker)
+}
+
+func (a *Archiver) workErrorHandler(err error) {
+	log.Printf("%v - warning: %v", a.name, err)
+}
+
+func (a *Archiver) getWindows(db *gorm.DB, t table, cutoff time.Time) ([]window, error) {
+	windows := make([]window, 0)
+
+	if !a.useSQLite {
+		rows, err := db.Raw(getChunksSQL, t.name, cutoff).Rows()
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		for rows.Next() {
+			w := window{}
+
+			err = rows.Scan(&w.start, &w.end)
+			if err != nil {
+				return nil, err
+			}
+
+			windows = append(windows, w)
+		}
+
+		return windows, rows.Err()
+	}
+
+	var createdAt struct {
+		CreatedAt time.Time
+	}
+
+	err := db.Unscoped().Model(t.model).Select("created_at").Where("created_at < ?", cutoff).Order("created_at ASC").Take(&createdAt).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return windows, nil
+		}
+
+		return nil, err
+	}
+
+	for start := createdAt.CreatedAt.UTC().Truncate(archiveWindow); !start.Add(archiveWindow).After(cutoff); start = start.Add(archiveWindow) {
+		windows = append(windows, window{start: start, end: start.Add(archiveWindow)})
+	}
+
+	return windows, nil
+}
+
+func (a *Archiver) drop(db *gorm.DB, t table, w window) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if t.beforeDrop != nil {
+			err := t.beforeDrop(tx, w.start, w.end)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !a.useSQLite {
+			return tx.Exec(dropChunksSQL, t.name, w.end, w.start).Error
+		}
+
+		return tx.Unscoped().Where("created_at >= ? AND created_at < ?", w.start, w.end).Delete(t.model).Error
+	})
+}
+
+func (a *Archiver) apply(db *gorm.DB, policy *Policy) error {
+	t, ok := tablesByName[policy.Table]
+	if !ok {
+		return fmt.Errorf("unknown table %#+v", policy.Table)
+	}
+
+	if policy.DropAfter == 0 {
+		return nil
+	}
+
+	cutoff := helpers.GetNow().Add(-policy.DropAfter)
+
+	// nothing from the first row that writers still need onwards is dropped, however old it is (and dropping is by
+	// whole window, so neither is anything else in its window)
+	keepFrom, err := t.getKeepFrom(db, cutoff, policy)
+	if err != nil {
+		return err
+	}
+
+	if keepFrom != nil {
+		log.Printf("%v - %v: not dropping past %v (still needed by writers)", a.name, t.name, keepFrom)
+		cutoff = *keepFrom
+	}
+
+	windows, err := a.getWindows(db, t, cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range windows {
+		if policy.ArchiveFormat != "" {
+			path := getArchivePath(a.archivePath, t.name, w.start, w.end, policy.ArchiveFormat)
+
+			count, err := t.archive(db, w.start, w.end, path, policy.ArchiveFormat)
+			if err != nil {
+				return fmt.Errorf("failed to archive %v from %v to %v: %v", t.name, w.start, w.end, err)
+			}
+
+			if count > 0 {
+				log.Printf("%v - archived %v rows from %v to %#+v", a.name, count, t.name, path)
+			}
+		}
+
+		err = a.drop(db, t, w)
+		if err != nil {
+			return fmt.Errorf("failed to drop %v from %v to %v: %v", t.name, w.start, w.end, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Archiver) work() error {
+	if !a.lastArchivedAt.IsZero() && helpers.GetNow().Sub(a.lastArchivedAt) < a.archivePeriod {
+		return nil
+	}
+
+	db, err := a.databaseWorker.GetDB()
+	if err != nil {
+		return err
+	}
+
+	a.lastArchivedAt = helpers.GetNow()
+
+	for _, policy := range a.policies {
+		err = a.apply(db, policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import loads an archive (as written by an Archiver) back into the given table, skipping rows that are already there
+func Import(db *gorm.DB, tableName string, path string) (int64, error) {
+	t, ok := tablesByName[tableName]
+	if !ok {
+		return 0, fmt.Errorf("unknown table %#+v", tableName)
+	}
+
+	format, err := GetArchiveFormat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.restore(db, path, format)
+}
@@ -0,0 +1,160 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/migrations"
+	"github.com/initialed85/uneventful/pkg/workers/in_memory"
+	"gorm.io/gorm"
+)
+
+func countEvents(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+
+	var count int64
+
+	err := db.Unscoped().Model(&events.DatabaseEvent{}).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestArchiverSQLite(t *testing.T) {
+	cases := []struct {
+		name              string
+		dropUnsnapshotted string
+		archived          bool
+	}{
+		{name: "archived then dropped", dropUnsnapshotted: "true", archived: true},
+		{name: "kept for a writer to replay", dropUnsnapshotted: "false", archived: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := in_memory.Setup(t)
+			db := d.GetTestDB(t, migrations.Migrate)
+			store := events.NewEventStore(db)
+
+			archivePath := t.TempDir()
+
+			t.Setenv("ARCHIVE_PATH", archivePath)
+			t.Setenv("EVENT_DROP_AFTER", "24h")
+			t.Setenv("EVENT_ARCHIVE_FORMAT", FormatJSONL)
+			t.Setenv("EVENT_DROP_UNSNAPSHOTTED", c.dropUnsnapshotted)
+
+			for i := 1; i <= 3; i++ {
+				databaseEvent, err := events.NewWithoutCorrelation("thing.1.happened", json.RawMessage(fmt.Sprintf(`{"n": %v}`, i))).ToDatabaseEvent()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = store.Append("thing.1", events.AnyVersion, databaseEvent)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// long enough later that the whole day the events were created in is past the cutoff
+			later := time.Now().Add(time.Hour * 24 * 3)
+
+			helpers.SetClock(helpers.ClockFunc(func() time.Time { return later }))
+
+			t.Cleanup(func() {
+				helpers.SetClock(nil)
+			})
+
+			a, err := NewArchiver("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = a.setup()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() {
+				_ = a.teardown()
+			})
+
+			err = a.work()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			paths, err := filepath.Glob(filepath.Join(archivePath, "event", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !c.archived {
+				if len(paths) != 0 || countEvents(t, db) != 3 {
+					t.Fatalf("expected nothing archived or dropped, got %v and %v events", paths, countEvents(t, db))
+				}
+
+				return
+			}
+
+			if len(paths) != 1 || filepath.Ext(paths[0]) != fmt.Sprintf(".%v", FormatJSONL) {
+				t.Fatalf("expected one archive, got %v", paths)
+			}
+
+			if count := countEvents(t, db); count != 0 {
+				t.Fatalf("expected every event dropped, got %v", count)
+			}
+
+			// the drop is recorded, so verification tells it from the events having been deleted
+			verification, err := events.Verify(db, "thing.1", nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if verification.Break != nil || verification.Dropped != 3 {
+				t.Errorf("expected 3 dropped, got %#+v (break %v)", verification, verification.Break)
+			}
+
+			// another pass (as if a period had gone by) finds nothing left to archive
+			a.lastArchivedAt = time.Time{}
+
+			err = a.work()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			again, err := filepath.Glob(filepath.Join(archivePath, "event", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(again) != fmt.Sprint(paths) {
+				t.Fatalf("expected only %v, got %v", paths, again)
+			}
+
+			imported, err := Import(db, "event", paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if imported != 3 || countEvents(t, db) != 3 {
+				t.Errorf("expected 3 imported, got %v (%v events)", imported, countEvents(t, db))
+			}
+
+			imported, err = Import(db, "event", paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if imported != 0 || countEvents(t, db) != 3 {
+				t.Errorf("expected nothing imported again, got %v (%v events)", imported, countEvents(t, db))
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package retention
+
+import "time"
+
+const (
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+const (
+	defaultCompressAfter     = "0s" // 0s = never compress
+	defaultDropAfter         = "0s" // 0s = keep forever
+	defaultArchiveFormat     = ""   // "" = drop without archiving
+	defaultDropUnsnapshotted = "false"
+	defaultArchivePath       = "/var/lib/uneventful/archive"
+	defaultArchivePeriod     = "1h"
+	archiveTick              = time.Second * 5
+	archiveWindow            = time.Hour * 24 // matches the hypertable chunk_time_interval
+	archiveBatchSize         = 1000
+	archiveTimeFormat        = "20060102T150405Z"
+)
+
+const (
+	compressSQL                = "ALTER TABLE %v SET (timescaledb.compress, timescaledb.compress_segmentby = '%v', timescaledb.compress_orderby = 'created_at DESC');"
+	addCompressionPolicySQL    = "SELECT add_compression_policy(?, compress_after => make_interval(secs => ?));"
+	removeCompressionPolicySQL = "SELECT remove_compression_policy(?, if_exists => true);"
+	removeRetentionPolicySQL   = "SELECT remove_retention_policy(?, if_exists => true);"
+	getChunksSQL               = "SELECT range_start, range_end FROM timescaledb_information.chunks WHERE hypertable_name = ? AND range_end <= ? ORDER BY range_start;"
+	dropChunksSQL              = "SELECT drop_chunks(?, older_than => ?::timestamptz, newer_than => ?::timestamptz);"
+	latestStatesSQL            = "SELECT name, MAX(sequence) AS sequence FROM state WHERE deleted_at IS NULL GROUP BY name"
+)
@@ -0,0 +1,141 @@
+package retention
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/initialed85/uneventful/internal/helpers"
+	"gorm.io/gorm"
+)
+
+// Policy describes what happens to a hypertable's chunks as they age
+type Policy struct {
+	Table         string
+	CompressAfter time.Duration // 0 = never compress
+	DropAfter     time.Duration // 0 = keep forever
+	ArchiveFormat string        // "" = drop without archiving, otherwise FormatJSONL / FormatParquet
+	// for the event table, whether events of a stream without any snapshot can be dropped (only for an event store that
+	// no writer replays from, e.g. the history writer's); a stream's events past its latest snapshot never are
+	DropUnsnapshotted bool
+}
+
+func getDuration(key string, defaultValue string) (time.Duration, error) {
+	rawDuration, err := helpers.GetEnvironmentVariable(key, false, defaultValue)
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := time.ParseDuration(rawDuration)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", key, err)
+	}
+
+	if duration < 0 {
+		return 0, fmt.Errorf("%v: must not be negative", key)
+	}
+
+	return duration, nil
+}
+
+func getPolicy(prefix string, tableName string) (*Policy, error) {
+	compressAfter, err := getDuration(fmt.Sprintf("%v_COMPRESS_AFTER", prefix), defaultCompressAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	dropAfter, err := getDuration(fmt.Sprintf("%v_DROP_AFTER", prefix), defaultDropAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%v_ARCHIVE_FORMAT", prefix)
+
+	archiveFormat, err := helpers.GetEnvironmentVariable(key, false, defaultArchiveFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveFormat = strings.ToLower(archiveFormat)
+
+	if archiveFormat != "" && archiveFormat != FormatJSONL && archiveFormat != FormatParquet {
+		return nil, fmt.Errorf("%v: unknown format %#+v (expected %#+v or %#+v)", key, archiveFormat, FormatJSONL, FormatParquet)
+	}
+
+	key = fmt.Sprintf("%v_DROP_UNSNAPSHOTTED", prefix)
+
+	rawDropUnsnapshotted, err := helpers.GetEnvironmentVariable(key, false, defaultDropUnsnapshotted)
+	if err != nil {
+		return nil, err
+	}
+
+	dropUnsnapshotted, err := strconv.ParseBool(rawDropUnsnapshotted)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", key, err)
+	}
+
+	return &Policy{
+		Table:             tableName,
+		CompressAfter:     compressAfter,
+		DropAfter:         dropAfter,
+		ArchiveFormat:     archiveFormat,
+		DropUnsnapshotted: dropUnsnapshotted,
+	}, nil
+}
+
+// GetPolicies reads the policies for the event and state tables from the environment
+func GetPolicies() ([]*Policy, error) {
+	policies := make([]*Policy, 0)
+
+	for _, prefix := range []string{"EVENT", "STATE"} {
+		t := tablesByPrefix[prefix]
+
+		policy, err := getPolicy(prefix, t.name)
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// Apply configures the TimescaleDB compression job for a policy; dropping is left to the Archiver (so that it can
+// archive first and never drop what writers still need), so any retention job from before that is removed
+func Apply(db *gorm.DB, policy *Policy) error {
+	t, ok := tablesByName[policy.Table]
+	if !ok {
+		return fmt.Errorf("unknown table %#+v", policy.Table)
+	}
+
+	// there are no background jobs for SQLite; the Archiver does the dropping and there's no compression
+	if helpers.IsSQLite(db) {
+		return nil
+	}
+
+	err := db.Exec(removeCompressionPolicySQL, t.name).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove compression policy for %#+v: %v", t.name, err)
+	}
+
+	if policy.CompressAfter > 0 {
+		err = db.Exec(fmt.Sprintf(compressSQL, t.name, t.segmentBy)).Error
+		if err != nil {
+			return fmt.Errorf("failed to enable compression for %#+v: %v", t.name, err)
+		}
+
+		err = db.Exec(addCompressionPolicySQL, t.name, policy.CompressAfter.Seconds()).Error
+		if err != nil {
+			return fmt.Errorf("failed to add compression policy for %#+v: %v", t.name, err)
+		}
+	}
+
+	err = db.Exec(removeRetentionPolicySQL, t.name).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove retention policy for %#+v: %v", t.name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/initialed85/uneventful/pkg/models/events"
+	"github.com/initialed85/uneventful/pkg/models/states"
+	"gorm.io/gorm"
+)
+
+type table struct {
+	name      string
+	segmentBy string
+	model     interface{}
+	archive   func(db *gorm.DB, start time.Time, end time.Time, path string, format string) (int64, error)
+	restore   func(db *gorm.DB, path string, format string) (int64, error)
+	// called in the same transaction as dropping a window, for a table that has to keep track of what it's dropped
+	beforeDrop func(tx *gorm.DB, start time.Time, end time.Time) error
+	// returns the earliest row (created before the cutoff) that writers still need, which nothing from is to be dropped
+	getKeepFrom func(db *gorm.DB, cutoff time.Time, policy *Policy) (*time.Time, error)
+}
+
+var eventTable = table{
+	name:      (&events.DatabaseEvent{}).TableName(),
+	segmentBy: "stream_id",
+	model:     &events.DatabaseEvent{},
+	archive: func(db *gorm.DB, start time.Time, end time.Time, path string, format string) (int64, error) {
+		return archiveRows[events.DatabaseEvent, events.ArchivedEvent](db, start, end, path, format, (*events.DatabaseEvent).ToArchivedEvent)
+	},
+	restore: func(db *gorm.DB, path string, format string) (int64, error) {
+		return importRows[events.DatabaseEvent, events.ArchivedEvent](db, path, format, (*events.ArchivedEvent).ToDatabaseEvent)
+	},
+	// so that verification can tell events dropped by retention from events deleted by anything else
+	beforeDrop:  events.RecordWatermarks,
+	getKeepFrom: getEventKeepFrom,
+}
+
+var stateTable = table{
+	name:      (&states.DatabaseState{}).TableName(),
+	segmentBy: "name",
+	model:     &states.DatabaseState{},
+	archive: func(db *gorm.DB, start time.Time, end time.Time, path string, format string) (int64, error) {
+		return archiveRows[states.DatabaseState, states.ArchivedState](db, start, end, path, format, (*states.DatabaseState).ToArchivedState)
+	},
+	restore: func(db *gorm.DB, path string, format string) (int64, error) {
+		return importRows[states.DatabaseState, states.ArchivedState](db, path, format, (*states.ArchivedState).ToDatabaseState)
+	},
+	getKeepFrom: getStateKeepFrom,
+}
+
+// getCreatedAt returns the created_at of the first row the query finds (nil if it finds none)
+func getCreatedAt(query *gorm.DB, column string) (*time.Time, error) {
+	var createdAt struct {
+		CreatedAt time.Time
+	}
+
+	err := query.Select(fmt.Sprintf("%v AS created_at", column)).Order(fmt.Sprintf("%v ASC", column)).Take(&createdAt).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &createdAt.CreatedAt, nil
+}
+
+// getEventKeepFrom returns the earliest event that's after its stream's latest snapshot (a writer replays it on top
+// of that snapshot), or, unless the policy says otherwise, that's for a stream without any snapshot at all
+func getEventKeepFrom(db *gorm.DB, cutoff time.Time, policy *Policy) (*time.Time, error) {
+	query := db.Unscoped().Model(&events.DatabaseEvent{}).
+		Joins(fmt.Sprintf("LEFT JOIN (%v) AS latest ON latest.name = event.stream_id", latestStatesSQL)).
+		Where("event.created_at < ?", cutoff)
+
+	if policy.DropUnsnapshotted {
+		query = query.Where("event.sequence > latest.sequence")
+	} else {
+		query = query.Where("latest.name IS NULL OR event.sequence > latest.sequence")
+	}
+
+	return getCreatedAt(query, "event.created_at")
+}
+
+// getStateKeepFrom returns the earliest snapshot that's the latest for its stream (a writer restores from it)
+func getStateKeepFrom(db *gorm.DB, cutoff time.Time, _ *Policy) (*time.Time, error) {
+	query := db.Unscoped().Model(&states.DatabaseState{}).
+		Joins(fmt.Sprintf("JOIN (%v) AS latest ON latest.name = state.name AND latest.sequence = state.sequence", latestStatesSQL)).
+		Where("state.created_at < ? AND state.deleted_at IS NULL", cutoff)
+
+	return getCreatedAt(query, "state.created_at")
+}
+
+var tablesByPrefix = map[string]table{
+	"EVENT": eventTable,
+	"STATE": stateTable,
+}
+
+var tablesByName = map[string]table{
+	eventTable.name: eventTable,
+	stateTable.name: stateTable,
+}
@@ -8,21 +8,32 @@ import (
 	"gorm.io/gorm"
 )
 
-type Worker struct {
+type Worker interface {
 	lifecycles.Worker
-	db *gorm.DB
+	GetDB() (*gorm.DB, error)
 }
 
-func New(name string) *Worker {
-	w := Worker{}
+type WorkerImplementation struct {
+	lifecycles.Worker
+	dial func() (*gorm.DB, error)
+	db   *gorm.DB
+}
+
+func New(name string) *WorkerImplementation {
+	return NewWithDial(name, helpers.GetDatabase)
+}
+
+// NewWithDial creates a Worker that gets its database from the given function rather than from the environment
+func NewWithDial(name string, dial func() (*gorm.DB, error)) *WorkerImplementation {
+	w := WorkerImplementation{dial: dial}
 
 	w.Worker = lifecycles.NewLazyWorker(fmt.Sprintf("database_%v", name), w.setup, w.teardown)
 
 	return &w
 }
 
-func (w *Worker) setup() (err error) {
-	w.db, err = helpers.GetDatabase()
+func (w *WorkerImplementation) setup() (err error) {
+	w.db, err = w.dial()
 	if err != nil {
 		return err
 	}
@@ -30,13 +41,13 @@ func (w *Worker) setup() (err error) {
 	return nil
 }
 
-func (w *Worker) teardown() error {
+func (w *WorkerImplementation) teardown() error {
 	w.db = nil
 
 	return nil
 }
 
-func (w *Worker) GetDB() (*gorm.DB, error) {
+func (w *WorkerImplementation) GetDB() (*gorm.DB, error) {
 	if !w.IsStarted() {
 		return nil, fmt.Errorf("not started")
 	}
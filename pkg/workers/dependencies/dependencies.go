@@ -0,0 +1,55 @@
+package dependencies
+
+import (
+	"sync"
+
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
+	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
+)
+
+// Dependencies creates the workers that writers, readers, callers (and anything else) use to reach the database, Redis
+// and NATS
+type Dependencies interface {
+	NewDatabaseWorker(name string) database_worker.Worker
+	NewRedisWorker(name string) redis_worker.Worker
+	NewNatsWorker(name string) nats_worker.Worker
+}
+
+// DependenciesImplementation creates workers that dial the services described by the environment
+type DependenciesImplementation struct{}
+
+func NewDependencies() *DependenciesImplementation {
+	return &DependenciesImplementation{}
+}
+
+func (d *DependenciesImplementation) NewDatabaseWorker(name string) database_worker.Worker {
+	return database_worker.New(name)
+}
+
+func (d *DependenciesImplementation) NewRedisWorker(name string) redis_worker.Worker {
+	return redis_worker.New(name)
+}
+
+func (d *DependenciesImplementation) NewNatsWorker(name string) nats_worker.Worker {
+	return nats_worker.New(name)
+}
+
+var mu sync.Mutex
+var current Dependencies = NewDependencies()
+
+// Get returns the Dependencies that constructors should create their workers with
+func Get() Dependencies {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return current
+}
+
+// Set replaces the Dependencies for anything constructed from now on (e.g. with in-memory ones for tests)
+func Set(dependencies Dependencies) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current = dependencies
+}
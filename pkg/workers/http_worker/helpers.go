@@ -44,3 +44,12 @@ func HandleResponse(responseWriter http.ResponseWriter, request *http.Request, s
 func HandleErrorResponse(responseWriter http.ResponseWriter, request *http.Request, statusCode int, errorToSend error) error {
 	return HandleResponse(responseWriter, request, statusCode, GetErrorResponse("An error occurred", request.Method, request.URL.String(), errorToSend))
 }
+
+// HandleErrorResponseWithErrors is HandleErrorResponse with the details of what went wrong (e.g. which fields of the
+// request body were invalid)
+func HandleErrorResponseWithErrors(responseWriter http.ResponseWriter, request *http.Request, statusCode int, errorToSend error, errors interface{}) error {
+	response := GetErrorResponse("An error occurred", request.Method, request.URL.String(), errorToSend)
+	response.Errors = errors
+
+	return HandleResponse(responseWriter, request, statusCode, response)
+}
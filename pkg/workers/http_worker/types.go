@@ -12,9 +12,10 @@ type Response struct {
 
 type ErrorResponse struct {
 	Response
-	Method string `json:"method"`
-	URL    string `json:"url"`
-	Error  string `json:"error"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Error  string      `json:"error"`
+	Errors interface{} `json:"errors,omitempty"`
 }
 
 var (
@@ -1,6 +1,7 @@
 package http_worker
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -11,14 +12,13 @@ import (
 
 type Worker struct {
 	lifecycles.Worker
+	addr     string
 	serveMux *http.ServeMux
 	server   *http.Server
 }
 
 func New(name string, port int64, handlerByPattern map[string]http.HandlerFunc) *Worker {
-	w := Worker{serveMux: http.NewServeMux()}
-
-	w.server = &http.Server{Addr: fmt.Sprintf(":%v", port), Handler: w.serveMux}
+	w := Worker{addr: fmt.Sprintf(":%v", port), serveMux: http.NewServeMux()}
 
 	for pattern, handler := range handlerByPattern {
 		w.serveMux.HandleFunc(pattern, handler)
@@ -32,9 +32,14 @@ func New(name string, port int64, handlerByPattern map[string]http.HandlerFunc)
 func (w *Worker) setup() error {
 	errors := helpers.GetErrorChannel()
 
+	// a server can't be started again once it's been shut down, so each start gets a fresh one
+	w.server = &http.Server{Addr: w.addr, Handler: w.serveMux}
+
+	server := w.server
+
 	go func() {
-		err := w.server.ListenAndServe()
-		if err != nil {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			errors <- err
 		}
 	}()
@@ -48,5 +53,5 @@ func (w *Worker) setup() error {
 }
 
 func (w *Worker) teardown() error {
-	return nil
+	return w.server.Shutdown(context.Background())
 }
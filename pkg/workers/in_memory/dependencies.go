@@ -0,0 +1,102 @@
+package in_memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/glebarez/sqlite"
+	"github.com/go-redis/redis/v8"
+	"github.com/initialed85/uneventful/pkg/workers/database_worker"
+	"github.com/initialed85/uneventful/pkg/workers/nats_worker"
+	"github.com/initialed85/uneventful/pkg/workers/redis_worker"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+// Dependencies creates workers backed by an in-memory SQLite database, an in-memory Redis and an in-process NATS
+// server, all shared by every worker it creates; it's for wiring writers, readers, callers and servers together in a
+// single process (e.g. a test) without any external services
+type Dependencies struct {
+	db          *gorm.DB
+	redisServer *miniredis.Miniredis
+	natsServer  *server.Server
+}
+
+func New() (*Dependencies, error) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	// an in-memory database only lives as long as its connection, so there can only ever be the one
+	sqlDB.SetMaxOpenConns(1)
+	sqlDB.SetMaxIdleConns(1)
+	sqlDB.SetConnMaxLifetime(0)
+	sqlDB.SetConnMaxIdleTime(0)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		_ = sqlDB.Close()
+		return nil, err
+	}
+
+	natsServer, err := server.NewServer(&server.Options{DontListen: true, NoLog: true, NoSigs: true})
+	if err != nil {
+		redisServer.Close()
+		_ = sqlDB.Close()
+		return nil, err
+	}
+
+	go natsServer.Start()
+
+	if !natsServer.ReadyForConnections(time.Second * 5) {
+		natsServer.Shutdown()
+		redisServer.Close()
+		_ = sqlDB.Close()
+		return nil, fmt.Errorf("in-memory NATS server not ready for connections")
+	}
+
+	d := Dependencies{
+		db:          db,
+		redisServer: redisServer,
+		natsServer:  natsServer,
+	}
+
+	return &d, nil
+}
+
+func (d *Dependencies) NewDatabaseWorker(name string) database_worker.Worker {
+	return database_worker.NewWithDial(name, func() (*gorm.DB, error) {
+		return d.db, nil
+	})
+}
+
+func (d *Dependencies) NewRedisWorker(name string) redis_worker.Worker {
+	return redis_worker.NewWithDial(name, func() (*redis.Client, error) {
+		return redis.NewClient(&redis.Options{Addr: d.redisServer.Addr()}), nil
+	})
+}
+
+func (d *Dependencies) NewNatsWorker(name string) nats_worker.Worker {
+	return nats_worker.NewWithDial(name, func() (*nats.Conn, error) {
+		return nats.Connect("", nats.InProcessServer(d.natsServer), nats.MaxReconnects(0))
+	})
+}
+
+// Close stops the in-memory services; anything still using them will start failing
+func (d *Dependencies) Close() {
+	d.natsServer.Shutdown()
+	d.redisServer.Close()
+
+	sqlDB, err := d.db.DB()
+	if err == nil {
+		_ = sqlDB.Close()
+	}
+}
@@ -0,0 +1,62 @@
+package in_memory
+
+import (
+	"testing"
+
+	"github.com/initialed85/uneventful/pkg/lifecycles"
+	"github.com/initialed85/uneventful/pkg/workers/dependencies"
+	"gorm.io/gorm"
+)
+
+// Setup creates Dependencies for a test and has everything constructed during it use them; both are undone when the
+// test is done
+func Setup(t testing.TB) *Dependencies {
+	t.Helper()
+
+	d, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dependencies.Set(d)
+
+	t.Cleanup(func() {
+		dependencies.Set(dependencies.NewDependencies())
+		d.Close()
+	})
+
+	return d
+}
+
+// Start starts the given workers for a test and stops them (in reverse) when it's done
+func Start(t testing.TB, workers ...lifecycles.Worker) {
+	t.Helper()
+
+	err := lifecycles.Setup(workers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		reversed := make([]lifecycles.Worker, 0, len(workers))
+		for i := len(workers) - 1; i >= 0; i-- {
+			reversed = append(reversed, workers[i])
+		}
+
+		_ = lifecycles.Teardown(reversed...)
+	})
+}
+
+// GetTestDB returns the database for a test after running the given setups (e.g. migrations.Migrate) against it
+func (d *Dependencies) GetTestDB(t testing.TB, setups ...func(db *gorm.DB) error) *gorm.DB {
+	t.Helper()
+
+	for _, setup := range setups {
+		err := setup(d.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return d.db
+}
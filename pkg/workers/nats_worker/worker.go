@@ -8,21 +8,32 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-type Worker struct {
+type Worker interface {
 	lifecycles.Worker
+	GetNatsConn() (*nats.Conn, error)
+}
+
+type WorkerImplementation struct {
+	lifecycles.Worker
+	dial     func() (*nats.Conn, error)
 	natsConn *nats.Conn
 }
 
-func New(name string) *Worker {
-	w := Worker{}
+func New(name string) *WorkerImplementation {
+	return NewWithDial(name, helpers.GetNatsConn)
+}
+
+// NewWithDial creates a Worker that gets its NATS connection from the given function rather than from the environment
+func NewWithDial(name string, dial func() (*nats.Conn, error)) *WorkerImplementation {
+	w := WorkerImplementation{dial: dial}
 
 	w.Worker = lifecycles.NewLazyWorker(fmt.Sprintf("nats_%v", name), w.setup, w.teardown)
 
 	return &w
 }
 
-func (w *Worker) setup() (err error) {
-	w.natsConn, err = helpers.GetNatsConn()
+func (w *WorkerImplementation) setup() (err error) {
+	w.natsConn, err = w.dial()
 	if err != nil {
 		return err
 	}
@@ -30,14 +41,14 @@ func (w *Worker) setup() (err error) {
 	return nil
 }
 
-func (w *Worker) teardown() error {
+func (w *WorkerImplementation) teardown() error {
 	w.natsConn.Close()
 	w.natsConn = nil
 
 	return nil
 }
 
-func (w *Worker) GetNatsConn() (*nats.Conn, error) {
+func (w *WorkerImplementation) GetNatsConn() (*nats.Conn, error) {
 	if !w.IsStarted() {
 		return nil, fmt.Errorf("not started")
 	}
@@ -8,21 +8,32 @@ import (
 	"github.com/initialed85/uneventful/pkg/lifecycles"
 )
 
-type Worker struct {
+type Worker interface {
 	lifecycles.Worker
+	GetRedisClient() (*redis.Client, error)
+}
+
+type WorkerImplementation struct {
+	lifecycles.Worker
+	dial        func() (*redis.Client, error)
 	redisClient *redis.Client
 }
 
-func New(name string) *Worker {
-	w := Worker{}
+func New(name string) *WorkerImplementation {
+	return NewWithDial(name, helpers.GetRedisClient)
+}
+
+// NewWithDial creates a Worker that gets its Redis client from the given function rather than from the environment
+func NewWithDial(name string, dial func() (*redis.Client, error)) *WorkerImplementation {
+	w := WorkerImplementation{dial: dial}
 
 	w.Worker = lifecycles.NewLazyWorker(fmt.Sprintf("redis_%v", name), w.setup, w.teardown)
 
 	return &w
 }
 
-func (w *Worker) setup() (err error) {
-	w.redisClient, err = helpers.GetRedisClient()
+func (w *WorkerImplementation) setup() (err error) {
+	w.redisClient, err = w.dial()
 	if err != nil {
 		return err
 	}
@@ -30,14 +41,14 @@ func (w *Worker) setup() (err error) {
 	return nil
 }
 
-func (w *Worker) teardown() error {
+func (w *WorkerImplementation) teardown() error {
 	_ = w.redisClient.Close()
 	w.redisClient = nil
 
 	return nil
 }
 
-func (w *Worker) GetRedisClient() (*redis.Client, error) {
+func (w *WorkerImplementation) GetRedisClient() (*redis.Client, error) {
 	if !w.IsStarted() {
 		return nil, fmt.Errorf("not started")
 	}